@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// attrsSupported reports whether file attributes are read by the scan on this platform.
+const attrsSupported = false
+
+// fileAttrs is not supported on this platform.
+func fileAttrs(info os.FileInfo) uint32 {
+	return 0
+}
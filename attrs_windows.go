@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// attrsSupported reports whether file attributes are read by the scan on this platform.
+const attrsSupported = true
+
+// ATTR_MASK selects the attribute bits compared by --check-attrs.
+const ATTR_MASK = syscall.FILE_ATTRIBUTE_READONLY | syscall.FILE_ATTRIBUTE_HIDDEN |
+	syscall.FILE_ATTRIBUTE_SYSTEM | syscall.FILE_ATTRIBUTE_ARCHIVE
+
+// fileAttrs returns the readonly, hidden, system and archive attribute bits of a file.
+func fileAttrs(info os.FileInfo) uint32 {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return 0
+	}
+	return data.FileAttributes & ATTR_MASK
+}
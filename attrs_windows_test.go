@@ -0,0 +1,87 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// hideFile sets the hidden attribute of path.
+func hideFile(t *testing.T, path string) {
+	t.Helper()
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		t.Fatalf("reading attributes failed: %v", err)
+	}
+	if err := syscall.SetFileAttributes(p, attrs|syscall.FILE_ATTRIBUTE_HIDDEN); err != nil {
+		t.Fatalf("hiding the file failed: %v", err)
+	}
+}
+
+func TestCheckAttrs(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "file"), "content")
+		createFile(t, filepath.Join(dir, "same"), "content")
+	}
+	// only the file of B is hidden
+	hideFile(t, filepath.Join(dirB, "file"))
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedErr    error
+	}{
+		{"Attributes Ignored", nil, "", nil},
+		{"Attributes Compared", []string{"--check-attrs"}, "^ file\n", ErrDiffsFound},
+		{"Not Failing", []string{"--check-attrs", "--fail-on", "modified"}, "^ file\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected error %v, got: %v", tt.expectedErr, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestCheckAttrsModified(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "file"), "old content")
+	createFile(t, filepath.Join(dirB, "file"), "new content")
+	hideFile(t, filepath.Join(dirB, "file"))
+
+	// a single file reporting both changes must not block the workers
+	done := make(chan struct{})
+	var stdout string
+	var err error
+	go func() {
+		defer close(done)
+		stdout, _, err = runApp(t, "--no-color", "--silent", "--check-attrs", dirA, dirB)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the run to finish")
+	}
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if expected := "~ file\n^ file\n"; stdout != expected {
+		t.Errorf("expected output %q, got %q", expected, stdout)
+	}
+}
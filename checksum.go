@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+// newHash returns a new hash.Hash for the given algorithm name.
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+}
+
+// runChecksum hashes every file of a single local directory and writes the
+// hashes in the format of sha256sum and friends (`<hex>  <relpath>`).
+// Hashes are always computed over the full file content, also the one a symlink points to.
+func runChecksum(ctx context.Context, cmd *cli.Command) error {
+	args := cmd.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("--checksum-file expects exactly one directory argument")
+	}
+	if isRemotePath(args[0]) || isGitPath(args[0]) || isEmptyPath(args[0]) {
+		return fmt.Errorf("--checksum-file only supports local directories")
+	}
+
+	algo := cmd.String("checksum-algo")
+	if _, err := newHash(algo); err != nil {
+		return err
+	}
+	hashOpts, err := hashOptions(cmd)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	files, _, issues, err := coreScan(ctx, root, scanOptions(cmd))
+	if err != nil {
+		return fmt.Errorf("scan error: %w", err)
+	}
+	for _, issue := range issues {
+		slog.Warn("skipping inaccessible path", "path", issue.Path, "error", issue.Err)
+	}
+
+	var out io.Writer = cmd.Writer
+	var outFile *os.File
+	if dest := cmd.String("checksum-file"); dest != "-" {
+		if outFile, err = os.Create(dest); err != nil {
+			return err
+		}
+		defer outFile.Close() // only on an early return, otherwise it is closed below
+		out = outFile
+	}
+
+	var relPaths []string
+	for relPath, meta := range files {
+		if meta.Special != "" {
+			slog.Warn("skipping special file", "path", relPath, "type", meta.Special)
+			continue
+		}
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	for _, relPath := range relPaths {
+		h, _ := newHash(algo)
+		fullPath := filepath.Join(root, filepath.FromSlash(relPath))
+		sum, err := computeSparseHash(fullPath, h, 0, true, hashOpts)
+		if err != nil {
+			return fmt.Errorf("hashing %s failed: %w", relPath, err)
+		}
+		name, escaped := escapeChecksumName(relPath)
+		if escaped {
+			sum = "\\" + sum
+		}
+		if _, err := fmt.Fprintf(out, "%s  %s\n", sum, name); err != nil {
+			return err
+		}
+	}
+	if outFile != nil {
+		return outFile.Close()
+	}
+	return nil
+}
+
+// escapeChecksumName escapes a name containing a backslash or a line break the way
+// coreutils does, and reports whether the line needs the leading backslash marking it.
+func escapeChecksumName(name string) (string, bool) {
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return name, false
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(name), true
+}
+
+// parseChecksums reads a file in the format of sha256sum and friends into a map of
+// relative paths to lowercase hashes. Both the text (`<hex>  <path>`) and the binary
+// (`<hex> *<path>`) marker are accepted, as well as escaped names (`\<hex>  <path>`).
+// Every hash must have the size in bytes of the selected algorithm.
+func parseChecksums(r io.Reader, size int) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || sum == "" || name == "" || (name[0] != ' ' && name[0] != '*') {
+			return nil, fmt.Errorf("line %d: expected <hash>  <path> or <hash> *<path>", lineNo)
+		}
+		decoded, err := hex.DecodeString(sum)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid hash %q", lineNo, sum)
+		}
+		if len(decoded) != size {
+			return nil, fmt.Errorf("line %d: hash %q has %d bytes, expected %d for the selected --checksum-algo", lineNo, sum, len(decoded), size)
+		}
+		name = name[1:]
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(name)
+		}
+		sums[path.Clean(filepath.ToSlash(name))] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
+
+// runVerify compares a single local directory against a checksum file, which takes the
+// place of directory A: files missing in the directory are removed, files not listed are
+// added and files with another hash are modified.
+func runVerify(ctx context.Context, cmd *cli.Command) error {
+	args := cmd.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("--verify-against expects exactly one directory argument")
+	}
+	if isRemotePath(args[0]) || isGitPath(args[0]) || isEmptyPath(args[0]) {
+		return fmt.Errorf("--verify-against only supports local directories")
+	}
+	if err := setupColor(cmd); err != nil {
+		return err
+	}
+
+	algo := cmd.String("checksum-algo")
+	algoHash, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+	hashOpts, err := hashOptions(cmd)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(cmd.String("verify-against"))
+	if err != nil {
+		return err
+	}
+	sums, err := parseChecksums(f, algoHash.Size())
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %w", cmd.String("verify-against"), err)
+	}
+
+	root, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	files, _, issues, err := coreScan(ctx, root, scanOptions(cmd))
+	if err != nil {
+		return fmt.Errorf("scan error: %w", err)
+	}
+	for _, issue := range issues {
+		slog.Warn("skipping inaccessible path", "path", issue.Path, "error", issue.Err)
+	}
+
+	var results []DiffItem
+	for relPath, want := range sums {
+		meta, ok := files[relPath]
+		if !ok {
+			results = append(results, DiffItem{Path: relPath, Type: Removed})
+			continue
+		}
+		if meta.Special != "" {
+			// a special file has no content to hash, so it can't match the listed hash
+			slog.Warn("special file can't be verified", "path", relPath, "type", meta.Special)
+			results = append(results, DiffItem{Path: relPath, Type: Modified})
+			continue
+		}
+		h, _ := newHash(algo)
+		// like the checksum file, a symlink is hashed by the content it points to
+		sum, err := computeSparseHash(filepath.Join(root, filepath.FromSlash(relPath)), h, 0, true, hashOpts)
+		if err != nil {
+			slog.Warn("failed to hash file", "path", relPath, "error", err)
+			results = append(results, DiffItem{Path: relPath, Type: Errored, Size: meta.Size})
+		} else if sum != want {
+			results = append(results, DiffItem{Path: relPath, Type: Modified, Size: meta.Size})
+		}
+	}
+	for relPath, meta := range files {
+		if _, ok := sums[relPath]; ok {
+			continue
+		}
+		if meta.Special != "" {
+			// like the checksum file, which never lists them
+			slog.Warn("skipping special file", "path", relPath, "type", meta.Special)
+			continue
+		}
+		results = append(results, DiffItem{Path: relPath, Type: Added, Size: meta.Size})
+	}
+
+	return printAndDetermineExit(results, cmd, false)
+}
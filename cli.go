@@ -4,24 +4,40 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
 )
 
 type ParsedArgs struct {
 	PathA, PathB         string
 	AgentBinA, AgentBinB string
 	SudoA, SudoB         bool
+	Rsh                  []string
+	RemoteConcurrency    int // RPC calls in flight per remote connection
 	FastLimit            int64
 	GlobalLimit          int64
 	FollowSym            bool
+	DerefRoot            bool // resolve symlinked root arguments, independent of FollowSym
 	Verbose              bool
+	LogLevel             slog.Level
+	Since                int64 // unix nanoseconds, 0 = no cutoff
+	Norm                 TextNorm
+	Only                 ContentClass
+	Hash                 HashOptions
+	PathsFrom            string
+	ConfirmFiles         int   // ask before comparing more files, 0 = never
+	ConfirmBytes         int64 // ask before hashing more bytes, 0 = never
 }
 
 func main() {
@@ -29,19 +45,224 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := app.Run(ctx, os.Args); err != nil {
-		if errors.Is(err, ErrASubsetB) {
-			os.Exit(3)
+	args, err := withEnvOptions(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	os.Args = args // parseArgs locates the --sudo flags in os.Args
+
+	err = app.Run(ctx, expandNullFlag(args))
+	code := exitCode(err)
+	if code == 2 || code == 5 || code == 6 || code == 7 {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	os.Exit(mappedExitCode(err, app))
+}
+
+// ENV_OPTIONS is the environment variable holding default flags.
+const ENV_OPTIONS = "DIRDIFF_OPTS"
+
+// withEnvOptions inserts the flags of DIRDIFF_OPTS, split like shell words, right after
+// the program name. Flags given on the command line come later and therefore override them.
+func withEnvOptions(args []string) ([]string, error) {
+	opts := os.Getenv(ENV_OPTIONS)
+	if strings.TrimSpace(opts) == "" || len(args) == 0 {
+		return args, nil
+	}
+	words, err := splitShellWords(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ENV_OPTIONS, err)
+	}
+	return slices.Concat(args[:1], words, args[1:]), nil
+}
+
+// expandNullFlag rewrites -0 to --null before the first "--", since the
+// flag parser treats arguments starting with a dash and a digit as positional.
+func expandNullFlag(args []string) []string {
+	expanded := slices.Clone(args)
+	for i, arg := range expanded {
+		if arg == "--" {
+			break
+		}
+		if arg == "-0" {
+			expanded[i] = "--null"
+		}
+	}
+	return expanded
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// exitCode maps the error returned by a run to the process exit code:
+// 0 identical, 1 divergent, 2 runtime error, 3 A subset of B, 4 B subset of A,
+// 5 remote connection failure, 6 a directory became inaccessible during the run,
+// 7 the run exceeded --timeout.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrRemoteConnection):
+		return 5
+	case errors.Is(err, ErrRootVanished):
+		return 6
+	case errors.Is(err, ErrTimeout):
+		return 7
+	case errors.Is(err, ErrInaccessible):
+		return 2
+	case errors.Is(err, ErrASubsetB):
+		return 3
+	case errors.Is(err, ErrBSubsetA):
+		return 4
+	case errors.Is(err, ErrDiffsFound):
+		return 1
+	}
+	return 2
+}
+
+// EXIT_MAP_KEYS are the verdicts whose exit code --exit-map can override.
+// modified is the divergent verdict with modified entries, falling back to divergent if unmapped.
+var EXIT_MAP_KEYS = []string{"identical", "a_subset_b", "b_subset_a", "divergent", "modified"}
+
+// parseExitMap parses the verdict=code pairs of --exit-map.
+func parseExitMap(pairs []string) (map[string]int, error) {
+	exitMap := make(map[string]int, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --exit-map %q, expected verdict=code", pair)
 		}
-		if errors.Is(err, ErrBSubsetA) {
-			os.Exit(4)
+		if !slices.Contains(EXIT_MAP_KEYS, key) {
+			return nil, fmt.Errorf("invalid --exit-map verdict %q, expected one of %s", key, strings.Join(EXIT_MAP_KEYS, ", "))
 		}
-		if errors.Is(err, ErrDiffsFound) {
-			os.Exit(1)
+		code, err := strconv.Atoi(value)
+		if err != nil || code < 0 || code > 125 {
+			return nil, fmt.Errorf("invalid --exit-map code %q for %s, expected 0-125", value, key)
+		}
+		exitMap[key] = code
+	}
+	return exitMap, nil
+}
+
+// sudoFlags returns the --sudo (true) and --no-sudo (false) flags in the order they appear in argv.
+// The values of the other flags are skipped, so e.g. the label of "--label-a -n" isn't a --no-sudo.
+func sudoFlags(argv []string, flags []cli.Flag) []bool {
+	takesValue := make(map[string]bool)
+	for _, flag := range flags {
+		if f, ok := flag.(cli.DocGenerationFlag); ok && f.TakesValue() {
+			for _, name := range flag.Names() {
+				takesValue[name] = true
+			}
+		}
+	}
+
+	var sudo []bool
+	for i := 0; i < len(argv); i++ {
+		switch arg := argv[i]; arg {
+		case "--sudo", "-s":
+			sudo = append(sudo, true)
+		case "--no-sudo", "-n":
+			sudo = append(sudo, false)
+		case "--":
+			return sudo
+		default:
+			if strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") && takesValue[strings.TrimLeft(arg, "-")] {
+				i++ // the value of the flag
+			}
+		}
+	}
+	return sudo
+}
+
+// mapSudoFlags assigns the sudo flags to the remote paths.
+// A single flag applies to every remote path, two flags are assigned to the remote paths in order.
+// Two remote paths on the same host with differing sudo are served by separate connections.
+func mapSudoFlags(flags []bool, isRemoteA, isRemoteB bool) (bool, bool, error) {
+	sudoA, sudoB := false, false
+	switch len(flags) {
+	case 0:
+	case 1:
+		sudoA = isRemoteA && flags[0]
+		sudoB = isRemoteB && flags[0]
+	case 2:
+		idx := 0
+		if isRemoteA {
+			sudoA = flags[idx]
+			idx++
+		}
+		if isRemoteB {
+			sudoB = flags[idx]
+		}
+	default:
+		return false, false, fmt.Errorf("too many --sudo or --no-sudo flags")
+	}
+	return sudoA, sudoB, nil
+}
+
+// mappedExitCode applies the --exit-map of cmd to the exit code of the error of a run.
+// Runtime and connection errors keep their codes.
+func mappedExitCode(runErr error, cmd *cli.Command) int {
+	code := exitCode(runErr)
+	verdicts := map[int]string{0: "identical", 1: "divergent", 3: "a_subset_b", 4: "b_subset_a"}
+	verdict, ok := verdicts[code]
+	if !ok {
+		return code
+	}
+	exitMap, err := parseExitMap(cmd.StringSlice("exit-map"))
+	if err != nil {
+		return code // already rejected by parseArgs
+	}
+	var verdictErr *VerdictError
+	if verdict == "divergent" && errors.As(runErr, &verdictErr) && verdictErr.Stats.FailingOnly(cmd.StringSlice("fail-on")).HasModified() {
+		if mapped, ok := exitMap["modified"]; ok {
+			return mapped
+		}
+	}
+	if mapped, ok := exitMap[verdict]; ok {
+		return mapped
+	}
+	return code
+}
+
+// explainExit returns a human readable description of the exit code of a run.
+func explainExit(err error, cmd *cli.Command) string {
+	return fmt.Sprintf("Exit code %d: %s", mappedExitCode(err, cmd), verdictText(err))
+}
+
+// verdictText describes the outcome of a run, naming the directories if known.
+func verdictText(err error) string {
+	var verdict *VerdictError
+	if errors.As(err, &verdict) {
+		switch exitCode(err) {
+		case 1:
+			return fmt.Sprintf("%s and %s have divergent differences", verdict.PathA, verdict.PathB)
+		case 3:
+			return fmt.Sprintf("%s is a subset of %s", verdict.PathA, verdict.PathB)
+		case 4:
+			return fmt.Sprintf("%s is a subset of %s", verdict.PathB, verdict.PathA)
 		}
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(2)
 	}
+	switch exitCode(err) {
+	case 0:
+		return "directories are identical"
+	case 1:
+		return "directories have divergent differences"
+	case 3:
+		return "directory A is a subset of directory B"
+	case 4:
+		return "directory B is a subset of directory A"
+	case 5:
+		return fmt.Sprintf("remote connection error (%v)", err)
+	case 6:
+		return fmt.Sprintf("directory became inaccessible (%v)", err)
+	case 7:
+		return fmt.Sprintf("timed out (%v)", err)
+	}
+	return fmt.Sprintf("runtime error (%v)", err)
 }
 
 func newApp() *cli.Command {
@@ -53,50 +274,203 @@ func newApp() *cli.Command {
 		Flags: []cli.Flag{
 			&cli.StringSliceFlag{Name: "include", Aliases: []string{"i"}, Usage: "Glob patterns to include files/dirs in the comparison"},
 			&cli.StringSliceFlag{Name: "exclude", Aliases: []string{"e"}, Usage: "Glob patterns to exclude files/dirs from the comparison"},
+			&cli.BoolFlag{Name: "exclude-vcs", Usage: "Exclude .git, .svn, .hg, .bzr, CVS and _darcs directories at any depth"},
+			&cli.StringSliceFlag{Name: "include-dir", Usage: "Glob patterns of directories whose subtrees are compared, matched against directories only"},
+			&cli.StringSliceFlag{Name: "exclude-dir", Usage: "Glob patterns of directories not to descend into, matched against directories only"},
+			&cli.StringSliceFlag{Name: "include-a", Usage: "Glob patterns to include files/dirs only on side A"},
+			&cli.StringSliceFlag{Name: "include-b", Usage: "Glob patterns to include files/dirs only on side B"},
+			&cli.StringSliceFlag{Name: "exclude-a", Usage: "Glob patterns to exclude files/dirs only on side A"},
+			&cli.StringSliceFlag{Name: "exclude-b", Usage: "Glob patterns to exclude files/dirs only on side B"},
+			&cli.StringFlag{Name: "strip-prefix-a", Usage: "Remove this leading directory from the paths of side A before comparing"},
+			&cli.StringFlag{Name: "strip-prefix-b", Usage: "Remove this leading directory from the paths of side B before comparing"},
+			&cli.StringFlag{Name: "rename-map", Usage: "Compare differently named files of A and B paired by this file, one pathA<TAB>pathB per line"},
+			&cli.BoolFlag{Name: "ignore-case-in-names", Usage: "Match the paths of A and B regardless of case, e.g. README.md with readme.md"},
+			&cli.StringFlag{Name: "paths-from", Usage: "Only compare the relative paths listed in this file (- for stdin) instead of scanning"},
+			&cli.StringFlag{Name: "since", Usage: "Only compare files modified after this RFC3339 timestamp or duration ago (e.g. 24h)"},
 			&cli.IntFlag{Name: "workers", Aliases: []string{"w", "j"}, Value: int(runtime.NumCPU()), Usage: "Number of parallel workers"},
+			&cli.StringFlag{Name: "state", Usage: "Record compared files in this file to resume an interrupted run; removed on completion, refused if written with other comparison options"},
+			&cli.IntFlag{Name: "read-retries", Usage: "Repeat reads failing with transient errors, e.g. on network filesystems, up to this many times", HideDefault: true},
+			&cli.DurationFlag{Name: "timeout", Usage: "Abort the whole run after this long, e.g. 10m, printing the differences found so far and exiting with code 7 (default 0 = no timeout)", HideDefault: true},
+			&cli.DurationFlag{Name: "file-timeout", Usage: "Report a file as errored if comparing it takes longer than this, e.g. 30s (default 0 = no timeout)", HideDefault: true},
+			&cli.StringFlag{Name: "confirm-over", Usage: "After scanning, ask on a terminal before comparing more files (a plain number) or bytes (a size, e.g. 50GB) than this"},
+			&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}, Usage: "Don't ask for confirmation, proceed with --confirm-over"},
+			&cli.BoolFlag{Name: "no-recurse", Usage: "Only compare the direct children of both directories, listing subdirectories without descending"},
+			&cli.BoolFlag{Name: "one-file-system", Aliases: []string{"x"}, Usage: "Don't descend into mount points of other file systems than the compared directories, like find -xdev"},
 			&cli.BoolFlag{Name: "follow-symlinks", Aliases: []string{"L"}, Usage: "Follow symbolic links"},
+			&cli.BoolFlag{Name: "special-files", Usage: "Compare FIFOs, sockets and devices by type and device number instead of skipping them"},
+			&cli.BoolFlag{Name: "dereference-root", Value: true, Usage: "Resolve root arguments which are symbolic links"},
 			// hashing
 			&cli.StringSliceFlag{Name: "fast", Aliases: []string{"f"}, Usage: "Glob patterns to use fast SHA256 hashes (sparse-hashing) for"},
+			&cli.StringFlag{Name: "glob", Value: "classic", Usage: "Pattern syntax: classic ('*' also matches '/') or doublestar (only '**' matches across directories)"},
+			&cli.BoolFlag{Name: "check-patterns", Usage: "Only validate the include, exclude and fast patterns"},
 			&cli.StringFlag{Name: "fast-limit", Aliases: []string{"l"}, Usage: "Size limit for fast SHA256 hashes (default 1MB)", HideDefault: true, Value: "1MB"},
 			&cli.StringFlag{Name: "global-limit", Aliases: []string{"g"}, Usage: "Size limit for all SHA256 hashes (default 0 = no limit)", HideDefault: true, Value: "0"},
+			&cli.IntFlag{Name: "sparse-chunks", Value: 3, Usage: "Number of evenly spaced chunks read by sparse hashes, which add up to the limit"},
+			&cli.BoolFlag{Name: "strong", Usage: "Hash every file in full, ignoring --fast and --global-limit (slower for large files, but no change is missed)"},
+			&cli.StringFlag{Name: "hash-cmd", Usage: "Compare files by the output of this program, run with the content on stdin on the host of each side (slow, and runs with your privileges)"},
+			&cli.StringFlag{Name: "buffer-size", Usage: "Size of the read buffer for hashing, e.g. 1MB for fast sequential disks (default 32KB)", HideDefault: true},
+			&cli.StringFlag{Name: "checksum-file", Usage: "Write full-content hashes of a single directory in sha256sum format to the file (- for stdout)"},
+			&cli.StringFlag{Name: "checksum-algo", Usage: "Hash algorithm for --checksum-file and --verify-against (md5, sha1, sha256, sha512)", Value: "sha256"},
+			&cli.StringFlag{Name: "verify-against", Usage: "Compare a single directory with the hashes of a file in sha256sum format, as if the file listed directory A"},
+			&cli.BoolFlag{Name: "ignore-eol", Usage: "Treat CRLF and LF line endings of text files as equal"},
+			&cli.BoolFlag{Name: "ignore-trailing-ws", Usage: "Ignore trailing whitespace in text files"},
+			&cli.BoolFlag{Name: "ignore-bom", Usage: "Ignore a leading UTF-8 byte order mark in text files"},
+			&cli.BoolFlag{Name: "only-text", Usage: "Only compare the content of text files"},
+			&cli.BoolFlag{Name: "only-binary", Usage: "Only compare the content of binary files"},
+			&cli.BoolFlag{Name: "check-hardlinks", Usage: "Report files whose hardlink grouping differs between both sides"},
+			&cli.BoolFlag{Name: "check-dir-mtime", Usage: "Report directories whose modification time differs between both sides"},
+			&cli.BoolFlag{Name: "check-xattr", Usage: "Report files whose extended attributes differ between both sides"},
+			&cli.BoolFlag{Name: "check-attrs", Usage: "Report files whose readonly, hidden, system or archive attributes differ between both sides (Windows only)"},
+			&cli.BoolFlag{Name: "fingerprint", Usage: "Print an aggregate fingerprint of each directory and whether they match, as a record after the summary with --format=jsonl"},
+			&cli.BoolFlag{Name: "metadata-only", Usage: "Treat files of the same size as equal without reading them (misses same-size changes)"},
+			&cli.BoolFlag{Name: "dirs-only", Usage: "Only compare which directories exist, ignoring all files"},
+			&cli.BoolFlag{Name: "files-only", Usage: "Don't report added or removed directories, only the files within them"},
+			&cli.BoolFlag{Name: "bytewise", Usage: "Compare local files of the same size byte by byte instead of hashing, stopping at the first difference"},
+			&cli.BoolFlag{Name: "block-compare", Usage: "Report how many 64KB blocks of modified local files differ, reading them again"},
+			&cli.BoolFlag{Name: "report-dupes", Usage: "Also hash files of the same size within each side and list groups of identical files, limited like the content comparison (groups of sparsely hashed files are marked, use --strong to hash them in full)"},
+			&cli.BoolFlag{Name: "sparse-aware", Usage: "Report files with equal content but different holes as modified"},
 			// verbosity
 			&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "Disable all output except exit code"},
-			&cli.BoolFlag{Name: "verbose", Aliases: []string{"V"}, Usage: "Print debug info"},
-			&cli.BoolFlag{Name: "no-progressbar", Aliases: []string{"P"}, Usage: "Disable progress bar"},
-			&cli.BoolFlag{Name: "no-color", Aliases: []string{"C"}, Usage: "Disable color output"},
+			&cli.BoolFlag{Name: "quiet-if-subset", Usage: "Suppress the listing if one directory is a subset of the other"},
+			&cli.BoolFlag{Name: "summary", Usage: "Print the summary line of --verbose on stderr, even with --quiet"},
+			&cli.BoolFlag{Name: "bytes", Usage: "Print sizes as plain byte numbers instead of human-readable, e.g. 1.2GB"},
+			&cli.BoolFlag{Name: "verbose", Aliases: []string{"V"}, Usage: "Print debug info (alias for --log-level=debug)"},
+			&cli.StringFlag{Name: "log-level", Usage: "Log level: debug, info, warn or error (default warn)"},
+			&cli.StringFlag{Name: "log-file", Usage: "Write log messages to this file instead of stderr"},
+			&cli.BoolFlag{Name: "watch", Aliases: []string{"W"}, Usage: "Re-run the comparison whenever a local directory changes"},
+			&cli.BoolFlag{Name: "explain", Usage: "Print the meaning of the exit code after the run"},
+			&cli.BoolFlag{Name: "no-progressbar", Aliases: []string{"P", "silent"}, Usage: "Disable progress bar"},
+			&cli.DurationFlag{Name: "progress-interval", Usage: "Redraw the progress bar at most once per this duration, e.g. 1s (default 0 = on every file)", HideDefault: true},
+			&cli.BoolFlag{Name: "quiet-progress", Usage: "Instead of the progress bar, print a single line with the number of compared files at the end"},
+			&cli.BoolFlag{Name: "progress-to-stdout", Usage: "Draw the progress bar on stdout instead of stderr"},
+			&cli.IntFlag{Name: "progress-fd", Usage: "Draw the progress bar on this file descriptor", HideDefault: true},
+			&cli.StringFlag{Name: "color", Value: "auto", Usage: "Color output: always, auto (if stdout is a terminal) or never"},
+			&cli.BoolFlag{Name: "no-color", Aliases: []string{"C"}, Usage: "Disable color output (alias for --color=never)"},
+			&cli.StringFlag{Name: "sort", Usage: "Order of the output: name, size (largest first), status, type (dirs first) or magnitude (most changed bytes first)", Value: "name"},
+			&cli.BoolFlag{Name: "reverse", Usage: "Reverse the output order"},
+			&cli.BoolFlag{Name: "natural-sort", Usage: "Order numbers within names by value, e.g. file2 before file10"},
+			&cli.IntFlag{Name: "max-diffs", Usage: "Stop after this many differences were found (default 0 = no limit)", HideDefault: true},
+			&cli.StringSliceFlag{Name: "fail-on", Usage: "Only these categories cause a nonzero exit code: added, removed, modified, errored, link_changed, xattr_changed, attr_changed, dir_modified (default all)"},
+			&cli.StringSliceFlag{Name: "exit-map", Usage: "Override the exit codes of verdicts, e.g. identical=0,a_subset_b=0,divergent=7,modified=8 (codes 0-125), where modified is divergent with modified entries"},
+			&cli.BoolFlag{Name: "list-unreadable", Usage: "List every path which could not be read while scanning or comparing, with the error, after the differences"},
+			&cli.BoolFlag{Name: "strict", Usage: "Exit with a runtime error if any path could not be read"},
+			&cli.BoolFlag{Name: "ignore-empty-dirs", Usage: "Don't report added or removed directories without any files below them"},
+			&cli.BoolFlag{Name: "mirror", Usage: "Only check that A is fully contained in B, ignoring entries only present in B"},
+			&cli.BoolFlag{Name: "print-identical", Usage: "Also list files which compared equal, prefixed by ="},
+			&cli.BoolFlag{Name: "interactive", Usage: "After the output, step through modified files on a terminal to view a diff, skip or quit"},
 			&cli.BoolFlag{Name: "show-all", Aliases: []string{"a"}, Usage: "Traverse also files in added/removed directories"},
+			&cli.StringFlag{Name: "format", Usage: "Output format: text or jsonl (one JSON object per diff and a final summary)", Value: "text"},
+			&cli.StringFlag{Name: "stats-json", Usage: "Write counts, bytes hashed, elapsed time, workers and verdict of the run as JSON to this file"},
+			&cli.BoolFlag{Name: "flat", Usage: "Print one status letter (A added, D removed, M modified, E errored, L link, X xattr, T attributes, I identical) and path per line, without colors"},
+			&cli.BoolFlag{Name: "null", Aliases: []string{"0"}, Usage: "Terminate each entry with a NUL byte instead of a newline, without colors"},
+			&cli.BoolFlag{Name: "rollup", Usage: "Also print a summary status and child change counts per directory"},
 			&cli.BoolFlag{Name: "tree", Aliases: []string{"t"}, Usage: "Print side-by-side tree view of differences"},
+			&cli.BoolFlag{Name: "columns", Usage: "Print the differences as two aligned columns of A and B paths"},
+			&cli.BoolFlag{Name: "header", Usage: "Print the compared paths above the line-by-line output"},
+			&cli.BoolFlag{Name: "no-header", Usage: "Omit the compared paths above the tree and columns output"},
+			&cli.StringFlag{Name: "relative-to", Usage: "Show tree headers relative to this directory"},
+			&cli.StringFlag{Name: "label-a", Usage: "Show this name instead of path A in headers"},
+			&cli.StringFlag{Name: "label-b", Usage: "Show this name instead of path B in headers"},
 			// remote
 			&cli.StringSliceFlag{Name: "remote-bin", Aliases: []string{"r"}, Usage: "Path to dirdiff binary on remote host."},
-			&cli.BoolFlag{Name: "sudo", Aliases: []string{"s"}, Usage: "Escalate privileges via sudo on remote host(s)"},
+			&cli.BoolFlag{Name: "sudo", Aliases: []string{"s"}, Usage: "Escalate privileges via sudo on remote host(s); give --sudo and --no-sudo to pick per remote path, which needs a separate connection on a shared host"},
 			&cli.BoolFlag{Name: "no-sudo", Aliases: []string{"n"}, Usage: "Explicitly disable sudo for a remote host"},
+			&cli.IntFlag{Name: "remote-concurrency", Value: 8, Usage: "Maximum number of concurrent requests to each remote host, independent of --workers"},
+			&cli.StringFlag{Name: "rsh", Aliases: []string{"R"}, Usage: "Remote shell command used instead of ssh (e.g. \"ssh -J jumphost\")"},
+			&cli.BoolFlag{Name: "selftest", Hidden: true, Usage: "Benchmark worker counts and hash algorithms on a generated temporary tree"},
+			&cli.StringFlag{Name: "selftest-size", Hidden: true, Usage: "Total size of the generated --selftest tree", Value: "64MB"},
+			&cli.IntFlag{Name: "selftest-files", Hidden: true, Usage: "Number of files in the generated --selftest tree", Value: 256},
 			&cli.BoolFlag{Name: "agent", Hidden: true, Usage: "Run as RPC agent over stdin/stdout"},
 		},
 		Action: func(ctx context.Context, cmd *cli.Command) error {
 			if cmd.Bool("agent") {
 				return runAgent()
 			}
+			if err := checkGlobSyntax(cmd.String("glob")); err != nil {
+				return err
+			}
+			if _, err := hashOptions(cmd); err != nil {
+				return err
+			}
+			if cmd.Bool("selftest") {
+				return runSelftest(ctx, cmd)
+			}
+			if cmd.String("checksum-file") != "" || cmd.String("verify-against") != "" {
+				// the skipped files are logged like those of a comparison
+				level, err := parseLogLevel(cmd)
+				if err != nil {
+					return err
+				}
+				logCloser, err := setupLogger(cmd, level)
+				if err != nil {
+					return err
+				}
+				defer logCloser.Close()
+				if cmd.String("checksum-file") != "" {
+					return runChecksum(ctx, cmd)
+				}
+				return runVerify(ctx, cmd)
+			}
+			if cmd.Bool("check-patterns") {
+				return runCheckPatterns(cmd)
+			}
 			parsedArgs, err := parseArgs(cmd)
 			if err != nil {
 				return err
 			}
-			return runMaster(ctx, parsedArgs, cmd)
+			logCloser, err := setupLogger(cmd, parsedArgs.LogLevel)
+			if err != nil {
+				return err
+			}
+			defer logCloser.Close()
+			if cmd.Bool("watch") {
+				return runWatch(ctx, parsedArgs, cmd)
+			}
+			if timeout := cmd.Duration("timeout"); timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			err = runMaster(ctx, parsedArgs, cmd)
+			if cmd.Bool("explain") {
+				fmt.Fprintln(cmd.ErrWriter, explainExit(err, cmd))
+			}
+			return err
 		},
 	}
 }
 
+// setupColor enables or disables colored output according to --color and --no-color.
+func setupColor(cmd *cli.Command) error {
+	colorMode := cmd.String("color")
+	if cmd.Bool("no-color") {
+		colorMode = "never"
+	}
+	switch colorMode {
+	case "always":
+		color.NoColor = false
+	case "never":
+		color.NoColor = true
+	case "auto":
+		color.NoColor = os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" || !isTerminal(cmd.Writer)
+	default:
+		return fmt.Errorf("invalid --color %q, expected always, auto or never", colorMode)
+	}
+	return nil
+}
+
 func parseArgs(cmd *cli.Command) (*ParsedArgs, error) {
 	args := cmd.Args().Slice()
 	if len(args) != 2 {
 		return &ParsedArgs{}, fmt.Errorf("too few arguments")
 	}
 
-	if cmd.Bool("no-color") {
-		color.NoColor = true
+	if err := setupColor(cmd); err != nil {
+		return &ParsedArgs{}, err
 	}
 
-	isRemoteA := strings.Contains(args[0], ":") && !filepath.IsAbs(args[0])
-	isRemoteB := strings.Contains(args[1], ":") && !filepath.IsAbs(args[1])
+	isRemoteA := isRemotePath(args[0])
+	isRemoteB := isRemotePath(args[1])
 
 	remoteBins := cmd.StringSlice("remote-bin")
 
@@ -114,36 +488,24 @@ func parseArgs(cmd *cli.Command) (*ParsedArgs, error) {
 		return &ParsedArgs{}, fmt.Errorf("too many --remote-bin arguments")
 	}
 
-	// parse sudo flags based on position in os.Args
-	var sudoFlags []bool
-	for _, arg := range os.Args {
-		switch arg {
-		case "--sudo":
-			sudoFlags = append(sudoFlags, true)
-		case "--no-sudo":
-			sudoFlags = append(sudoFlags, false)
-		}
+	sudoA, sudoB, err := mapSudoFlags(sudoFlags(os.Args, cmd.Flags), isRemoteA, isRemoteB)
+	if err != nil {
+		return &ParsedArgs{}, err
 	}
 
-	sudoA, sudoB := false, false
-	if len(sudoFlags) == 1 {
-		if isRemoteA {
-			sudoA = sudoFlags[0]
-		}
-		if isRemoteB {
-			sudoB = sudoFlags[0]
-		}
-	} else if len(sudoFlags) == 2 {
-		idx := 0
-		if isRemoteA {
-			sudoA = sudoFlags[idx]
-			idx++
-		}
-		if isRemoteB && idx < len(sudoFlags) {
-			sudoB = sudoFlags[idx]
+	logLevel, err := parseLogLevel(cmd)
+	if err != nil {
+		return &ParsedArgs{}, err
+	}
+	verbose := logLevel <= slog.LevelDebug
+
+	var rsh []string
+	if rshStr := cmd.String("rsh"); rshStr != "" {
+		words, err := splitShellWords(rshStr)
+		if err != nil || len(words) == 0 {
+			return &ParsedArgs{}, fmt.Errorf("invalid --rsh")
 		}
-	} else if len(sudoFlags) > 2 {
-		return &ParsedArgs{}, fmt.Errorf("too many --sudo or --no-sudo flags")
+		rsh = words
 	}
 
 	fastLimit, err := units.RAMInBytes(cmd.String("fast-limit"))
@@ -156,16 +518,208 @@ func parseArgs(cmd *cli.Command) (*ParsedArgs, error) {
 		return &ParsedArgs{}, fmt.Errorf("invalid --global-limit")
 	}
 
+	// --strong hashes every file in full, overriding both limits
+	if cmd.Bool("strong") {
+		fastLimit, globalLimit = 0, 0
+	}
+
+	if cmd.Int("workers") < 1 {
+		return &ParsedArgs{}, fmt.Errorf("invalid --workers %d, at least 1 is required", cmd.Int("workers"))
+	}
+	if cmd.Int("remote-concurrency") < 1 {
+		return &ParsedArgs{}, fmt.Errorf("invalid --remote-concurrency %d, at least 1 is required", cmd.Int("remote-concurrency"))
+	}
+
+	for _, key := range cmd.StringSlice("fail-on") {
+		if !slices.Contains(FAIL_ON_KEYS, key) {
+			return &ParsedArgs{}, fmt.Errorf("invalid --fail-on %q, expected one of %s", key, strings.Join(FAIL_ON_KEYS, ", "))
+		}
+	}
+
+	if _, err := parseExitMap(cmd.StringSlice("exit-map")); err != nil {
+		return &ParsedArgs{}, err
+	}
+
+	if cmd.Duration("file-timeout") < 0 {
+		return &ParsedArgs{}, fmt.Errorf("invalid --file-timeout")
+	}
+	if cmd.Duration("timeout") < 0 {
+		return &ParsedArgs{}, fmt.Errorf("invalid --timeout")
+	}
+	if cmd.Duration("timeout") > 0 && cmd.Bool("watch") {
+		return &ParsedArgs{}, fmt.Errorf("--timeout can't be combined with --watch")
+	}
+
+	if cmd.Int("max-diffs") < 0 {
+		return &ParsedArgs{}, fmt.Errorf("invalid --max-diffs")
+	}
+
+	if !slices.Contains(SORT_KEYS, cmd.String("sort")) {
+		return &ParsedArgs{}, fmt.Errorf("invalid --sort %q", cmd.String("sort"))
+	}
+
+	switch cmd.String("format") {
+	case "text", "jsonl":
+	default:
+		return &ParsedArgs{}, fmt.Errorf("invalid --format %q", cmd.String("format"))
+	}
+
+	if cmd.Bool("tree") && cmd.Bool("columns") {
+		return &ParsedArgs{}, fmt.Errorf("--tree and --columns are mutually exclusive")
+	}
+	if cmd.Bool("null") && (cmd.Bool("tree") || cmd.Bool("columns") || cmd.Bool("rollup") || cmd.String("format") != "text") {
+		return &ParsedArgs{}, fmt.Errorf("--null only applies to the text format")
+	}
+
+	if cmd.Bool("flat") && (cmd.Bool("tree") || cmd.Bool("columns") || cmd.Bool("null") || cmd.Bool("header") || cmd.String("format") != "text") {
+		return &ParsedArgs{}, fmt.Errorf("--flat can't be combined with other output formats")
+	}
+
+	if cmd.Bool("list-unreadable") && (cmd.Bool("null") || cmd.String("format") != "text") {
+		return &ParsedArgs{}, fmt.Errorf("--list-unreadable only applies to the text format")
+	}
+	if cmd.Bool("report-dupes") && (cmd.Bool("null") || cmd.String("format") != "text") {
+		return &ParsedArgs{}, fmt.Errorf("--report-dupes only applies to the text format")
+	}
+	if cmd.Bool("interactive") && (cmd.Bool("null") || cmd.String("format") != "text") {
+		return &ParsedArgs{}, fmt.Errorf("--interactive only applies to the text format")
+	}
+
+	if cmd.Bool("dirs-only") && cmd.Bool("files-only") {
+		return &ParsedArgs{}, fmt.Errorf("--dirs-only and --files-only are mutually exclusive")
+	}
+
+	if cmd.Bool("header") && cmd.Bool("no-header") {
+		return &ParsedArgs{}, fmt.Errorf("--header and --no-header are mutually exclusive")
+	}
+	if cmd.Bool("header") && (cmd.Bool("tree") || cmd.Bool("columns") || cmd.Bool("null") || cmd.String("format") != "text") {
+		return &ParsedArgs{}, fmt.Errorf("--header only applies to the line-by-line text output")
+	}
+
+	if (cmd.Bool("progress-to-stdout") || cmd.Int("progress-fd") == 1) && cmd.String("format") == "jsonl" {
+		// jsonl items are streamed while the progress bar is drawn
+		return &ParsedArgs{}, fmt.Errorf("progress on stdout can't be combined with --format=jsonl")
+	}
+	if cmd.Duration("progress-interval") < 0 {
+		return &ParsedArgs{}, fmt.Errorf("invalid --progress-interval")
+	}
+	if cmd.Int("progress-fd") < 0 {
+		return &ParsedArgs{}, fmt.Errorf("invalid --progress-fd")
+	}
+
+	if cmd.Bool("metadata-only") {
+		for _, name := range []string{"strong", "bytewise", "block-compare", "sparse-aware", "report-dupes", "check-xattr", "ignore-eol", "ignore-trailing-ws", "ignore-bom", "only-text", "only-binary"} {
+			if cmd.Bool(name) {
+				return &ParsedArgs{}, fmt.Errorf("--metadata-only can't be combined with --%s, which reads the files", name)
+			}
+		}
+		if cmd.String("hash-cmd") != "" {
+			return &ParsedArgs{}, fmt.Errorf("--metadata-only can't be combined with --hash-cmd, which reads the files")
+		}
+	}
+
+	only := ClassAny
+	if cmd.Bool("only-text") && cmd.Bool("only-binary") {
+		return &ParsedArgs{}, fmt.Errorf("--only-text and --only-binary are mutually exclusive")
+	} else if cmd.Bool("only-text") {
+		only = ClassText
+	} else if cmd.Bool("only-binary") {
+		only = ClassBinary
+	}
+	if only != ClassAny && cmd.String("hash-cmd") != "" {
+		// the output of --hash-cmd decides without detecting the content class
+		return &ParsedArgs{}, fmt.Errorf("--hash-cmd can't be combined with --only-text or --only-binary")
+	}
+
+	var confirmFiles int
+	var confirmBytes int64
+	if over := cmd.String("confirm-over"); over != "" {
+		// a plain number counts files, a size with a unit counts bytes
+		if confirmFiles, err = strconv.Atoi(over); err != nil {
+			confirmFiles = 0
+			if confirmBytes, err = units.RAMInBytes(over); err != nil {
+				return &ParsedArgs{}, fmt.Errorf("invalid --confirm-over %q, expected a file count or a size", over)
+			}
+		}
+		if confirmFiles < 0 || confirmBytes < 0 {
+			return &ParsedArgs{}, fmt.Errorf("invalid --confirm-over %q", over)
+		}
+	}
+
+	hashOpts, err := hashOptions(cmd)
+	if err != nil {
+		return &ParsedArgs{}, err
+	}
+
+	var since int64
+	if sinceStr := cmd.String("since"); sinceStr != "" {
+		cutoff, err := parseSince(sinceStr, time.Now())
+		if err != nil {
+			return &ParsedArgs{}, fmt.Errorf("invalid --since: %w", err)
+		}
+		since = cutoff.UnixNano()
+	}
+
 	return &ParsedArgs{
-		PathA:       args[0],
-		PathB:       args[1],
-		AgentBinA:   agentBinA,
-		AgentBinB:   agentBinB,
-		SudoA:       sudoA,
-		SudoB:       sudoB,
-		FastLimit:   fastLimit,
-		GlobalLimit: globalLimit,
-		FollowSym:   cmd.Bool("follow-symlinks"),
-		Verbose:     cmd.Bool("verbose") && !cmd.Bool("quiet"),
+		PathA:             args[0],
+		PathB:             args[1],
+		AgentBinA:         agentBinA,
+		AgentBinB:         agentBinB,
+		SudoA:             sudoA,
+		SudoB:             sudoB,
+		Rsh:               rsh,
+		RemoteConcurrency: int(cmd.Int("remote-concurrency")),
+		FastLimit:         fastLimit,
+		GlobalLimit:       globalLimit,
+		FollowSym:         cmd.Bool("follow-symlinks"),
+		DerefRoot:         cmd.Bool("dereference-root"),
+		Verbose:           verbose && !cmd.Bool("quiet"),
+		LogLevel:          logLevel,
+		Since:             since,
+		Norm: TextNorm{
+			EOL:        cmd.Bool("ignore-eol"),
+			TrailingWS: cmd.Bool("ignore-trailing-ws"),
+			BOM:        cmd.Bool("ignore-bom"),
+		},
+		Only:         only,
+		Hash:         hashOpts,
+		PathsFrom:    cmd.String("paths-from"),
+		ConfirmFiles: confirmFiles,
+		ConfirmBytes: confirmBytes,
+	}, nil
+}
+
+// hashOptions returns the HashOptions selected on the command line.
+func hashOptions(cmd *cli.Command) (HashOptions, error) {
+	bufferSize, err := parseBufferSize(cmd.String("buffer-size"))
+	if err != nil {
+		return HashOptions{}, err
+	}
+	if cmd.Int("sparse-chunks") < 1 {
+		return HashOptions{}, fmt.Errorf("invalid --sparse-chunks %d, at least 1 is required", cmd.Int("sparse-chunks"))
+	}
+	if err := checkHashCmd(cmd.String("hash-cmd")); err != nil {
+		return HashOptions{}, err
+	}
+	if cmd.Int("read-retries") < 0 {
+		return HashOptions{}, fmt.Errorf("invalid --read-retries %d", cmd.Int("read-retries"))
+	}
+	return HashOptions{
+		BufferSize:   bufferSize,
+		SparseChunks: int(cmd.Int("sparse-chunks")),
+		HashCmd:      cmd.String("hash-cmd"),
+		ReadRetries:  int(cmd.Int("read-retries")),
 	}, nil
 }
+
+// parseSince parses an RFC3339 timestamp or a duration relative to now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 timestamp nor a duration", s)
+	}
+	return now.Add(-d), nil
+}
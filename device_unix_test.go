@@ -0,0 +1,55 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOneFileSystem(t *testing.T) {
+	root := t.TempDir()
+	createFile(t, filepath.Join(root, "file"), "content")
+	createFile(t, filepath.Join(root, "mnt", "mounted"), "content")
+	createFile(t, filepath.Join(root, "sub", "other.img"), "content")
+
+	defer func(orig func(os.FileInfo) (uint64, bool)) { deviceOf = orig }(deviceOf)
+	realDeviceOf := deviceOf
+	// mnt and other.img simulate entries on another device
+	deviceOf = func(info os.FileInfo) (uint64, bool) {
+		dev, ok := realDeviceOf(info)
+		if info.Name() == "mnt" || info.Name() == "other.img" {
+			dev++
+		}
+		return dev, ok
+	}
+
+	tests := []struct {
+		name          string
+		oneFS         bool
+		expectedFiles []string
+		expectedDirs  []string
+	}{
+		{"Across File Systems", false, []string{"file", "mnt/mounted", "sub/other.img"}, []string{"mnt", "sub"}},
+		// the mount point is listed, but not descended into
+		{"One File System", true, []string{"file"}, []string{"mnt", "sub"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, dirs, issues, err := coreScan(context.Background(), root, ScanOptions{OneFS: tt.oneFS})
+			if err != nil || len(issues) > 0 {
+				t.Fatalf("scan failed: %v %v", err, issues)
+			}
+			if got := slices.Sorted(maps.Keys(files)); !slices.Equal(got, tt.expectedFiles) {
+				t.Errorf("expected files %q, got %q", tt.expectedFiles, got)
+			}
+			if got := slices.Sorted(maps.Keys(dirs)); !slices.Equal(got, tt.expectedDirs) {
+				t.Errorf("expected dirs %q, got %q", tt.expectedDirs, got)
+			}
+		})
+	}
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/docker/go-units"
+	"github.com/fatih/color"
 	"github.com/gobwas/glob"
 	"github.com/schollz/progressbar/v3"
 	"github.com/urfave/cli/v3"
@@ -21,26 +34,151 @@ const (
 	VERSION      = "0.1.4"
 	READY_MSG    = "__DIRDIFF_AGENT_READY__"
 	TIME_WARNING = 2 * time.Second
+
+	// PROGRESS_NAME_WIDTH is the number of characters of the current file shown in the progress bar
+	PROGRESS_NAME_WIDTH = 30
+	// PROGRESS_REFRESH is how often the progress bar picks up the current file while no file completes
+	PROGRESS_REFRESH = 200 * time.Millisecond
 )
 
 var (
-	ErrDiffsFound = errors.New("divergent differences found")
-	ErrASubsetB   = errors.New("dir A is a subset of dir B")
-	ErrBSubsetA   = errors.New("dir B is a subset of dir A")
+	ErrDiffsFound       = errors.New("divergent differences found")
+	ErrASubsetB         = errors.New("dir A is a subset of dir B")
+	ErrBSubsetA         = errors.New("dir B is a subset of dir A")
+	ErrInaccessible     = errors.New("paths were inaccessible")
+	ErrRemoteConnection = errors.New("connection to remote host failed")
+	ErrAborted          = errors.New("comparison aborted")
+	ErrRootVanished     = errors.New("directory became inaccessible during comparison")
+	ErrTimeout          = errors.New("run timed out")
 )
 
+// VerdictError is returned when the compared directories are not identical.
+// It wraps one of the sentinel errors above, so errors.Is keeps working,
+// and carries the compared directories and the counts behind the verdict.
+type VerdictError struct {
+	Verdict      error
+	PathA, PathB string
+	Stats        Stats
+}
+
+func (e *VerdictError) Error() string { return e.Verdict.Error() }
+func (e *VerdictError) Unwrap() error { return e.Verdict }
+
+// beforeCompareHook is called between scanning and comparing file contents (for testing purposes).
+var beforeCompareHook func()
+
 type ChangeType int
 
 const (
 	Added ChangeType = iota
 	Removed
 	Modified
+	Errored
+	LinkChanged
+	XattrChanged
+	DirModified
+	AttrChanged
+	Identical // only listed with --print-identical, never a difference
 )
 
+func (t ChangeType) String() string {
+	switch t {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case Errored:
+		return "errored"
+	case LinkChanged:
+		return "link_changed"
+	case XattrChanged:
+		return "xattr_changed"
+	case DirModified:
+		return "dir_modified"
+	case AttrChanged:
+		return "attr_changed"
+	case Identical:
+		return "identical"
+	}
+	return "unknown"
+}
+
+// Letter returns the single-letter status of the change type in the --flat output.
+func (t ChangeType) Letter() string {
+	switch t {
+	case Added:
+		return "A"
+	case Removed:
+		return "D"
+	case Modified, DirModified:
+		return "M"
+	case Errored:
+		return "E"
+	case LinkChanged:
+		return "L"
+	case XattrChanged:
+		return "X"
+	case AttrChanged:
+		return "T"
+	case Identical:
+		return "I"
+	}
+	return "?"
+}
+
+// Symbol returns the prefix of the change type in the line-based output.
+func (t ChangeType) Symbol() string {
+	switch t {
+	case Added:
+		return "+"
+	case Removed:
+		return "-"
+	case Modified:
+		return "~"
+	case Errored:
+		return "!"
+	case LinkChanged:
+		return "&"
+	case XattrChanged:
+		return "@"
+	case DirModified:
+		return "~"
+	case AttrChanged:
+		return "^"
+	case Identical:
+		return "="
+	}
+	return "?"
+}
+
 type DiffItem struct {
 	Path  string
 	Type  ChangeType
 	IsDir bool
+	Size  int64 // scanned file size, the larger one for files on both sides
+	Delta int64 // absolute difference of the scanned sizes of a modified file
+
+	// TargetA and TargetB are the targets of a modified symlink which isn't followed
+	TargetA, TargetB string
+	// Mismatch locates the difference of a modified file, only set if verbose
+	Mismatch *Mismatch
+	// Blocks counts the differing blocks of a modified file, only set with --block-compare
+	Blocks *BlockDiff
+}
+
+// BlockDiff is the number of differing blocks of a modified file.
+type BlockDiff struct {
+	Changed int64 `json:"changed"`
+	Total   int64 `json:"total"`
+}
+
+// Mismatch describes where the content of a modified file differs.
+type Mismatch struct {
+	Offset int64 `json:"offset"` // first differing byte, -1 if unknown, e.g. for remote files
+	SizeA  int64 `json:"size_a"`
+	SizeB  int64 `json:"size_b"`
 }
 
 func isInside(slashPath string, dirSet map[string]bool) bool {
@@ -54,52 +192,23 @@ func isInside(slashPath string, dirSet map[string]bool) bool {
 	return false
 }
 
-func runMaster(ctx context.Context, args *ParsedArgs, cmd *cli.Command) error {
-	nodeA, _, err := createNode(ctx, args.PathA, args.AgentBinA, args.SudoA, args.Verbose)
-	if err != nil {
-		return fmt.Errorf("setup A failed: %w", err)
-	}
-	defer nodeA.Close()
-
-	nodeB, _, err := createNode(ctx, args.PathB, args.AgentBinB, args.SudoB, args.Verbose)
-	if err != nil {
-		return fmt.Errorf("setup B failed: %w", err)
-	}
-	defer nodeB.Close()
-
-	includes := cmd.StringSlice("include")
-	excludes := cmd.StringSlice("exclude")
-	fasts := cmd.StringSlice("fast")
-
-	fastGlobs, err := compileGlobs(fasts)
-	if err != nil {
-		return fmt.Errorf("invalid fast globs: %w", err)
-	}
-
-	filesA, dirsA, err := nodeA.Scan(includes, excludes, args.FollowSym)
-	if err != nil {
-		return fmt.Errorf("scan A error: %w", err)
-	}
-	filesB, dirsB, err := nodeB.Scan(includes, excludes, args.FollowSym)
-	if err != nil {
-		return fmt.Errorf("scan B error: %w", err)
-	}
-
+// diffDirs computes the set difference of the directory lists of both sides.
+// Every directory unique to one side, including empty leaf directories, is
+// reported. Unless showAll is set, directories nested inside an already
+// reported directory are skipped. The returned sets contain all added and
+// removed directories, reported or not.
+func diffDirs(dirsA, dirsB map[string]FileMeta, showAll bool) ([]DiffItem, map[string]bool, map[string]bool) {
 	var results []DiffItem
-	var commonFiles []string
-
-	showAll := cmd.Bool("show-all")
 
 	dirMapA := make(map[string]bool)
-	for _, d := range dirsA {
+	for d := range dirsA {
 		dirMapA[d] = true
 	}
 
 	addedDirs := make(map[string]bool)
 	removedDirs := make(map[string]bool)
 
-	sort.Strings(dirsB)
-	for _, d := range dirsB {
+	for _, d := range slices.Sorted(maps.Keys(dirsB)) {
 		if !dirMapA[d] {
 			addedDirs[d] = true
 			if !showAll && isInside(d, addedDirs) {
@@ -123,54 +232,443 @@ func runMaster(ctx context.Context, args *ParsedArgs, cmd *cli.Command) error {
 		results = append(results, DiffItem{Path: d, Type: Removed, IsDir: true})
 	}
 
+	return results, addedDirs, removedDirs
+}
+
+// pruneEmptyDirs drops added and removed directories without any file below them,
+// on the side they exist, from the diff items.
+func pruneEmptyDirs(results []DiffItem, filesA, filesB map[string]FileMeta) []DiffItem {
+	withFiles := func(files map[string]FileMeta) map[string]bool {
+		dirs := make(map[string]bool)
+		for relPath := range files {
+			for d := path.Dir(relPath); d != "." && !dirs[d]; d = path.Dir(d) {
+				dirs[d] = true
+			}
+		}
+		return dirs
+	}
+	dirsWithFilesA, dirsWithFilesB := withFiles(filesA), withFiles(filesB)
+	return slices.DeleteFunc(results, func(item DiffItem) bool {
+		return item.IsDir && (item.Type == Added && !dirsWithFilesB[item.Path] || item.Type == Removed && !dirsWithFilesA[item.Path])
+	})
+}
+
+// diffDirMTimes reports the directories present on both sides whose modification times differ.
+// The root is not part of the scanned directories, so it is never reported.
+func diffDirMTimes(dirsA, dirsB map[string]FileMeta) []DiffItem {
+	var results []DiffItem
+	unknown := 0
+	for _, d := range slices.Sorted(maps.Keys(dirsA)) {
+		metaB, ok := dirsB[d]
+		if !ok {
+			continue
+		}
+		if dirsA[d].ModTime == 0 || metaB.ModTime == 0 {
+			unknown++ // e.g. git trees don't record modification times
+			continue
+		}
+		if dirsA[d].ModTime != metaB.ModTime {
+			results = append(results, DiffItem{Path: d, Type: DirModified, IsDir: true})
+		}
+	}
+	if unknown > 0 {
+		slog.Warn("no modification time available, skipping directory mtime check", "dirs", unknown)
+	}
+	return results
+}
+
+func runMaster(ctx context.Context, args *ParsedArgs, cmd *cli.Command) error {
+	start := time.Now()
+
+	if samePath, ok := isSameLocalPath(args.PathA, args.PathB); ok && args.DerefRoot {
+		if args.Verbose {
+			color.New(color.FgGreen).Fprintf(cmd.ErrWriter, "Directories are identical (same path: %s).\n", samePath)
+		}
+		if statsPath := cmd.String("stats-json"); statsPath != "" {
+			return writeRunSummary(statsPath, nil, 0, time.Since(start), 0)
+		}
+		return nil
+	}
+
+	nodeA, _, err := createNode(ctx, args.PathA, args.AgentBinA, args.SudoA, args.Rsh, args.RemoteConcurrency, args.Hash)
+	if err != nil {
+		return fmt.Errorf("setup A failed: %w", err)
+	}
+	defer nodeA.Close()
+
+	// both roots on the same host are served by a single connection
+	var nodeB DirNode
+	remoteA, isRemoteA := nodeA.(*RemoteNode)
+	if host := remoteHost(args.PathB); isRemoteA && host == remoteHost(args.PathA) &&
+		args.SudoA == args.SudoB && args.AgentBinA == args.AgentBinB {
+		slog.Info("reusing connection", "host", host)
+		nodeB = remoteA.WithRoot(strings.SplitN(args.PathB, ":", 2)[1])
+	} else {
+		if isRemoteA && host == remoteHost(args.PathA) && args.SudoA != args.SudoB {
+			// the agent runs either with or without sudo, so each side needs its own connection
+			slog.Info("opening a separate connection for differing sudo", "host", host)
+		}
+		if nodeB, _, err = createNode(ctx, args.PathB, args.AgentBinB, args.SudoB, args.Rsh, args.RemoteConcurrency, args.Hash); err != nil {
+			return fmt.Errorf("setup B failed: %w", err)
+		}
+	}
+	defer nodeB.Close()
+
+	if !args.DerefRoot {
+		if err := checkRootNotLink(nodeA, args.PathA); err != nil {
+			return err
+		}
+		if err := checkRootNotLink(nodeB, args.PathB); err != nil {
+			return err
+		}
+	}
+
+	includes := cmd.StringSlice("include")
+	excludes := excludePatterns(cmd)
+	includesA := append(append([]string(nil), includes...), cmd.StringSlice("include-a")...)
+	includesB := append(append([]string(nil), includes...), cmd.StringSlice("include-b")...)
+	excludesA := append(append([]string(nil), excludes...), cmd.StringSlice("exclude-a")...)
+	excludesB := append(append([]string(nil), excludes...), cmd.StringSlice("exclude-b")...)
+	fasts := cmd.StringSlice("fast")
+
+	fastGlobs, err := compileGlobs(fasts, cmd.String("glob"))
+	if err != nil {
+		return fmt.Errorf("invalid fast globs: %w", err)
+	}
+
+	var filesA, filesB map[string]FileMeta
+	var dirsA, dirsB map[string]FileMeta
+	var issuesA, issuesB []ScanIssue
+	err = func() error {
+		if args.PathsFrom != "" {
+			// only the listed paths are compared, the trees are not walked
+			relPaths, err := readPathList(args.PathsFrom, cmd.Reader)
+			if err != nil {
+				return fmt.Errorf("reading --paths-from failed: %w", err)
+			}
+			if filesA, dirsA, err = nodeA.StatPaths(relPaths, args.FollowSym); err != nil {
+				return fmt.Errorf("stat A error: %w", err)
+			}
+			if filesB, dirsB, err = nodeB.StatPaths(relPaths, args.FollowSym); err != nil {
+				return fmt.Errorf("stat B error: %w", err)
+			}
+			return nil
+		}
+		var err error
+		optsA, optsB := scanOptions(cmd), scanOptions(cmd)
+		optsA.Includes, optsA.Excludes, optsA.FollowSym = includesA, excludesA, args.FollowSym
+		optsB.Includes, optsB.Excludes, optsB.FollowSym = includesB, excludesB, args.FollowSym
+		if filesA, dirsA, issuesA, err = nodeA.Scan(ctx, optsA); err != nil {
+			return fmt.Errorf("scan A error: %w", err)
+		}
+		if filesB, dirsB, issuesB, err = nodeB.Scan(ctx, optsB); err != nil {
+			return fmt.Errorf("scan B error: %w", err)
+		}
+		return nil
+	}()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w while scanning", ErrTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err // canceled while stating the --paths-from paths
+	}
+	if err := checkRootsExist(nodeA, nodeB, args); err != nil {
+		return err
+	}
+	// the unknown contents of an unlistable directory would otherwise look removed from that side
+	excludeInaccessible(filesA, dirsA, filesB, dirsB, slices.Concat(issuesA, issuesB))
+	slog.Debug("scan complete", "side", "A", "files", len(filesA), "dirs", len(dirsA))
+	slog.Debug("scan complete", "side", "B", "files", len(filesB), "dirs", len(dirsB))
+
+	// FIFOs, sockets and devices are never opened; without --special-files they are skipped,
+	// while git submodules are always compared by their commit id
+	specialFiles := cmd.Bool("special-files")
+	if !specialFiles {
+		skipSpecialFiles(filesA)
+		skipSpecialFiles(filesB)
+	}
+
+	// with --dirs-only, only the directory structure is compared
+	if cmd.Bool("dirs-only") {
+		filesA, filesB = map[string]FileMeta{}, map[string]FileMeta{}
+	}
+
+	// with --strip-prefix-a/b, differently rooted trees are aligned before diffing
+	if prefix := cmd.String("strip-prefix-a"); prefix != "" {
+		var orig map[string]string
+		if filesA, dirsA, orig, err = stripPrefix(filesA, dirsA, prefix); err != nil {
+			return err
+		}
+		nodeA = &prefixedNode{DirNode: nodeA, orig: orig}
+	}
+	if prefix := cmd.String("strip-prefix-b"); prefix != "" {
+		var orig map[string]string
+		if filesB, dirsB, orig, err = stripPrefix(filesB, dirsB, prefix); err != nil {
+			return err
+		}
+		nodeB = &prefixedNode{DirNode: nodeB, orig: orig}
+	}
+
+	// with --rename-map, files of B are compared with the differently named files of A mapped to them
+	if renameMap := cmd.String("rename-map"); renameMap != "" {
+		renames, err := readRenameMap(renameMap)
+		if err != nil {
+			return fmt.Errorf("reading --rename-map failed: %w", err)
+		}
+		var orig map[string]string
+		if filesB, orig, err = renameFiles(filesB, renames); err != nil {
+			return err
+		}
+		nodeB = &prefixedNode{DirNode: nodeB, orig: orig}
+	}
+
+	// with --ignore-case-in-names, files of B are compared with the files of A differing only in case
+	if cmd.Bool("ignore-case-in-names") {
+		var orig map[string]string
+		var ambiguous []string
+		filesB, dirsB, orig, ambiguous = foldCase(filesA, dirsA, filesB, dirsB)
+		for _, name := range ambiguous {
+			slog.Warn("name differs from another only in case, compared as is", "path", name)
+		}
+		nodeB = &prefixedNode{DirNode: nodeB, orig: orig}
+	}
+
+	var commonFiles []string
+
+	// with --files-only, directories present on one side are not reported, but all files within them
+	filesOnly := cmd.Bool("files-only")
+	showAll := cmd.Bool("show-all") || filesOnly
+
+	results, addedDirs, removedDirs := diffDirs(dirsA, dirsB, showAll)
+	if filesOnly {
+		results = slices.DeleteFunc(results, func(item DiffItem) bool { return item.IsDir })
+	}
+
+	// with --ignore-empty-dirs, directories only differ if they hold files
+	if cmd.Bool("ignore-empty-dirs") {
+		results = pruneEmptyDirs(results, filesA, filesB)
+	}
+
+	// with --mirror, entries only present in B are expected and not reported
+	mirror := cmd.Bool("mirror")
+	if mirror {
+		results = slices.DeleteFunc(results, func(item DiffItem) bool { return item.Type == Added })
+	}
+
+	if cmd.Bool("check-dir-mtime") {
+		results = append(results, diffDirMTimes(dirsA, dirsB)...)
+	}
+
 	for relPath := range filesA {
 		if _, ok := filesB[relPath]; !ok {
 			if !showAll && isInside(relPath, removedDirs) {
 				continue
 			}
-			results = append(results, DiffItem{Path: relPath, Type: Removed, IsDir: false})
+			results = append(results, DiffItem{Path: relPath, Type: Removed, IsDir: false, Size: filesA[relPath].Size})
 		} else {
 			commonFiles = append(commonFiles, relPath)
 		}
 	}
 
 	for relPath := range filesB {
-		if _, ok := filesA[relPath]; !ok {
+		if _, ok := filesA[relPath]; !ok && !mirror {
 			if !showAll && isInside(relPath, addedDirs) {
 				continue
 			}
-			results = append(results, DiffItem{Path: relPath, Type: Added, IsDir: false})
+			results = append(results, DiffItem{Path: relPath, Type: Added, IsDir: false, Size: filesB[relPath].Size})
+		}
+	}
+
+	if cmd.Bool("check-hardlinks") {
+		if hasInodes(filesA) && hasInodes(filesB) {
+			results = append(results, diffHardlinks(filesA, filesB, commonFiles)...)
+		} else if len(filesA) > 0 && len(filesB) > 0 {
+			slog.Warn("no inode information available, skipping hardlink check")
+		}
+	}
+
+	// with --max-diffs, stop as soon as enough differences were found
+	maxDiffs := int(cmd.Int("max-diffs"))
+	truncated := false
+	if maxDiffs > 0 && len(results) >= maxDiffs {
+		sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+		results = results[:maxDiffs]
+		commonFiles = nil
+		truncated = true
+	}
+	compareCtx, cancelCompare := context.WithCancel(ctx)
+	defer cancelCompare()
+	var reportMu sync.Mutex
+	reported := len(results)
+
+	// a file may report several changes, so the results are appended as they are reported
+	var resultsMu sync.Mutex
+	collect := func(item DiffItem) {
+		resultsMu.Lock()
+		results = append(results, item)
+		resultsMu.Unlock()
+	}
+
+	// with jsonl output, every diff item is written as soon as it is known
+	var stream *jsonlWriter
+	if cmd.String("format") == "jsonl" && !cmd.Bool("quiet") {
+		stream = newJSONLWriter(cmd.Writer)
+		for _, item := range results {
+			stream.Emit(item)
+		}
+	}
+	report := func(item DiffItem) {
+		if maxDiffs > 0 {
+			reportMu.Lock()
+			defer reportMu.Unlock()
+			if reported >= maxDiffs {
+				return // another worker hit the limit first
+			}
+			reported++
+			if reported == maxDiffs {
+				truncated = true
+				cancelCompare()
+			}
+		}
+		if stream != nil {
+			stream.Emit(item)
 		}
+		collect(item)
+	}
+
+	// with --print-identical, files compared equal are listed too, bypassing --max-diffs
+	printIdentical := cmd.Bool("print-identical")
+	reportIdentical := func(p string) {
+		item := DiffItem{Path: p, Type: Identical, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size)}
+		if stream != nil {
+			stream.Emit(item)
+		}
+		collect(item)
+	}
+
+	if beforeCompareHook != nil {
+		beforeCompareHook()
+	}
+
+	if args.Since > 0 {
+		// files older than the cutoff on both sides are treated as equal
+		var recentFiles []string
+		for _, f := range commonFiles {
+			if filesA[f].ModTime >= args.Since || filesB[f].ModTime >= args.Since {
+				recentFiles = append(recentFiles, f)
+			}
+		}
+		commonFiles = recentFiles
+	}
+
+	// with --metadata-only, files are equal if their scanned sizes (and special types) match,
+	// so content changes keeping the size are missed
+	if cmd.Bool("metadata-only") {
+		for _, p := range commonFiles {
+			if filesA[p].Size != filesB[p].Size || filesA[p].Special != filesB[p].Special {
+				report(DiffItem{Path: p, Type: Modified, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size), Delta: sizeDelta(filesA[p], filesB[p])})
+			} else if printIdentical {
+				reportIdentical(p)
+			}
+		}
+		commonFiles = nil
 	}
 
 	sort.Slice(commonFiles, func(i, j int) bool {
-		return filesA[commonFiles[i]] > filesA[commonFiles[j]]
+		return filesA[commonFiles[i]].Size > filesA[commonFiles[j]].Size
 	})
 
+	// with --state, files compared by an interrupted run are not compared again
+	var state *compareState
+	stateCompleted := false
+	if statePath := cmd.String("state"); statePath != "" {
+		if state, err = openState(statePath, args.PathA, args.PathB, stateOptions(cmd)); err != nil {
+			return err
+		}
+		defer func() {
+			// the comparison itself is unaffected, only a resumed run compares more files again
+			if err := state.Close(stateCompleted); err != nil {
+				slog.Warn("failed to save the state", "path", statePath, "error", err)
+			}
+		}()
+
+		var pending []string
+		for _, p := range commonFiles {
+			changes, ok := state.Lookup(p, filesA[p], filesB[p])
+			if !ok {
+				pending = append(pending, p)
+				continue
+			}
+			for _, t := range changes {
+				report(DiffItem{Path: p, Type: t, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size), Delta: sizeDelta(filesA[p], filesB[p])})
+			}
+			if len(changes) == 0 && printIdentical {
+				reportIdentical(p)
+			}
+		}
+		slog.Debug("resuming from state", "compared", len(commonFiles)-len(pending), "pending", len(pending))
+		commonFiles = pending
+	}
+
+	// with --confirm-over, a huge comparison is announced and only started once confirmed on a terminal
+	if files, size := len(commonFiles), estimateHashedBytes(commonFiles, filesA, filesB, args, fastGlobs); (args.ConfirmFiles > 0 && files > args.ConfirmFiles) ||
+		(args.ConfirmBytes > 0 && size > args.ConfirmBytes) {
+		if !cmd.Bool("quiet") {
+			fmt.Fprintf(cmd.ErrWriter, "About to compare %d files, hashing %s.\n", files, units.HumanSize(float64(size)))
+		}
+		if !cmd.Bool("yes") && isInteractiveInput(cmd.Reader) && !confirm(cmd.Reader, cmd.ErrWriter, "Continue?") {
+			return ErrAborted
+		}
+	}
+
 	jobCh := make(chan string, len(commonFiles))
 	for _, f := range commonFiles {
 		jobCh <- f
 	}
 	close(jobCh)
 
-	resultCh := make(chan DiffItem, len(commonFiles))
-	progressCh := make(chan struct{}, len(commonFiles))
+	weights, progressTotal, progressBytes := progressWeights(commonFiles, filesA, filesB)
+	progressCh := make(chan int64, len(commonFiles))
+	// workers only publish the file they start on, the bar goroutine picks it up when
+	// drawing, so many small files don't add any channel traffic
+	var currentFile atomic.Pointer[string]
 	var barWg sync.WaitGroup
 
-	if !cmd.Bool("quiet") && !cmd.Bool("no-progressbar") && len(commonFiles) > 0 {
+	if !cmd.Bool("quiet") && !cmd.Bool("no-progressbar") && cmd.Bool("quiet-progress") && len(commonFiles) > 0 {
+		// no bar is drawn, only a single line once all files are compared
+		barWg.Add(1)
+		go func() {
+			defer barWg.Done()
+			compareStart := time.Now()
+			compared := 0
+			for range progressCh {
+				compared++
+			}
+			fmt.Fprintf(cmd.ErrWriter, "Compared %d/%d files in %.1fs\n", compared, len(commonFiles), time.Since(compareStart).Seconds())
+		}()
+	} else if !cmd.Bool("quiet") && !cmd.Bool("no-progressbar") && len(commonFiles) > 0 {
+		progressOut, progressCloser := progressWriter(cmd)
 		barWg.Add(1)
 		go func() {
 			defer barWg.Done()
-			bar := progressbar.NewOptions(len(commonFiles),
+			defer progressCloser.Close()
+			bar := progressbar.NewOptions64(progressTotal,
 				progressbar.OptionSetDescription("Comparing files"),
 				progressbar.OptionSetWidth(15),
-				progressbar.OptionSetWriter(cmd.ErrWriter),
-				progressbar.OptionShowBytes(false),
+				progressbar.OptionSetWriter(progressOut),
+				progressbar.OptionShowBytes(progressBytes),
 			)
-			for range progressCh {
-				bar.Add(1)
-			}
-			fmt.Fprintln(cmd.ErrWriter)
+			var shown *string
+			runProgress(bar, progressCh, cmd.Duration("progress-interval"), func() {
+				if p := currentFile.Load(); p != shown {
+					shown = p
+					bar.Describe(progressDescription(*p))
+				}
+			})
+			fmt.Fprintln(progressOut)
 		}()
 	} else {
 		go func() {
@@ -179,54 +677,158 @@ func runMaster(ctx context.Context, args *ParsedArgs, cmd *cli.Command) error {
 		}()
 	}
 
+	checkXattr := cmd.Bool("check-xattr")
+	checkAttrs := cmd.Bool("check-attrs")
+	// attributes are only compared if the scans of both sides read them
+	if checkAttrs && (!nodeA.AttrsSupported() || !nodeB.AttrsSupported()) {
+		slog.Warn("file attributes are only supported on Windows, skipping --check-attrs")
+		checkAttrs = false
+	}
+	blockCompare := cmd.Bool("block-compare")
+	var xattrWarnOnce sync.Once
+
+	compareOpts := CompareOptions{FollowSym: args.FollowSym, Norm: args.Norm, Only: args.Only, SparseAware: cmd.Bool("sparse-aware"), Bytewise: cmd.Bool("bytewise"), Hash: args.Hash}
+	if cmd.Bool("fingerprint") || cmd.Bool("report-dupes") {
+		compareOpts.Sums = newSHACache()
+	}
+	// files matching a --fast glob are hashed up to --fast-limit only
+	limitFor := func(p string) int64 {
+		if matchesAny(fastGlobs, p, false) {
+			return args.FastLimit
+		}
+		return args.GlobalLimit
+	}
+
+	fileTimeout := cmd.Duration("file-timeout")
+	// read once, as abandoned comparisons may outlive the run
+	compare := compareContent
+
+	var bytesHashed atomic.Int64
+
+	// files which failed to compare, for --list-unreadable
+	var unreadable []ScanIssue
+	var unreadableMu sync.Mutex
+	fail := func(p string, err error) {
+		slog.Debug("failed to compare file", "path", p, "error", err)
+		unreadableMu.Lock()
+		unreadable = append(unreadable, ScanIssue{Path: p, Err: err.Error()})
+		unreadableMu.Unlock()
+		report(DiffItem{Path: p, Type: Errored, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size)})
+	}
+
 	var wg sync.WaitGroup
-	workers := int(cmd.Int("workers"))
+	workers := effectiveWorkers(int(cmd.Int("workers")), len(commonFiles))
+	slog.Debug("comparing files", "files", len(commonFiles), "workers", workers)
 
 	for range workers {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for {
+				if compareCtx.Err() != nil {
+					return
+				}
 				select {
-				case <-ctx.Done():
+				case <-compareCtx.Done():
 					return
 				case path, ok := <-jobCh:
 					if !ok {
 						return
 					}
 					func(p string) {
-						defer func() { progressCh <- struct{}{} }()
+						// every job reports progress exactly once, even if it errors out
+						defer func() { progressCh <- weights[p] }()
+						// the changes reported so far, a change is appended once it is reported
+						var changes []ChangeType
+						// a panic only fails the file, the other workers carry on
+						defer func() {
+							if r := recover(); r != nil {
+								if len(changes) > 0 {
+									// the file already reported a change, so it isn't reported a second time as errored
+									slog.Warn("comparison panicked after reporting a change", "path", p, "error", panicError(p, r))
+									return
+								}
+								fail(p, panicError(p, r))
+							}
+						}()
+						currentFile.Store(&p)
+
+						limit := limitFor(p)
 
-						if filesA[p] != filesB[p] {
-							resultCh <- DiffItem{Path: p, Type: Modified, IsDir: false}
-							return
+						start := time.Now()
+						var equal bool
+						var err error
+						linkA, linkB := filesA[p].Link, filesB[p].Link
+						if linkA != "" && linkB != "" {
+							// two symlinks which aren't followed are compared by their scanned targets
+							equal = linkA == linkB
+						} else if filesA[p].Special != "" || filesB[p].Special != "" {
+							equal = filesA[p].Special == filesB[p].Special
+						} else {
+							equal, err = compareWithTimeout(compareCtx, fileTimeout, func() (equal bool, err error) {
+								// with --file-timeout, the comparison runs in a goroutine of its own
+								defer func() {
+									if r := recover(); r != nil {
+										err = panicError(p, r)
+									}
+								}()
+								return compare(nodeA, nodeB, p, filesA[p].Size, filesB[p].Size, limit, compareOpts)
+							})
+							if filesA[p].Size == filesB[p].Size || compareOpts.Only != ClassAny || compareOpts.Norm.Enabled() {
+								bytesHashed.Add(hashedBytes(filesA[p].Size, limit) + hashedBytes(filesB[p].Size, limit))
+							}
+						}
+						if compareCtx.Err() != nil {
+							return // abandoned, e.g. by --timeout, so neither a difference nor an error
+						}
+						if elapsed := time.Since(start); elapsed > TIME_WARNING {
+							slog.Info("slow comparison", "path", p, "elapsed", elapsed)
 						}
 
-						md5A, errA := nodeA.GetMD5(p, args.FollowSym)
-						md5B, errB := nodeB.GetMD5(p, args.FollowSym)
+						if err != nil {
+							fail(p, err)
+							return // errored files are not recorded in the state, so a resumed run retries them
+						}
 
-						if errA != nil || errB != nil || md5A != md5B {
-							resultCh <- DiffItem{Path: p, Type: Modified, IsDir: false}
-							return
+						if !equal {
+							item := DiffItem{Path: p, Type: Modified, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size), Delta: sizeDelta(filesA[p], filesB[p])}
+							if linkA != "" && linkB != "" {
+								item.TargetA, item.TargetB = linkA, linkB
+							} else if args.Verbose && filesA[p].Special == "" {
+								item.Mismatch = locateMismatch(nodeA, nodeB, p, filesA[p].Size, filesB[p].Size, args.FollowSym)
+							}
+							if blockCompare && item.TargetA == "" && filesA[p].Special == "" && item.Size > BLOCK_COMPARE_SIZE {
+								item.Blocks = countBlockDifferences(nodeA, nodeB, p, args.FollowSym)
+							}
+							report(item)
+							changes = append(changes, Modified)
 						}
 
-						limit := args.GlobalLimit
-						for _, g := range fastGlobs {
-							if g.Match(p) {
-								limit = args.FastLimit
-								break
+						if checkXattr {
+							sameAttrs, err := compareXattrs(nodeA, nodeB, p, args.FollowSym)
+							if errors.Is(err, ErrXattrUnsupported) {
+								xattrWarnOnce.Do(func() {
+									slog.Warn("extended attributes are not supported, skipping xattr check")
+								})
+							} else if err != nil {
+								slog.Warn("failed to read extended attributes", "path", p, "error", err)
+							} else if !sameAttrs {
+								report(DiffItem{Path: p, Type: XattrChanged, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size)})
+								changes = append(changes, XattrChanged)
 							}
 						}
 
-						start := time.Now()
-						shaA, errA := nodeA.GetSHA(p, limit, args.FollowSym)
-						shaB, errB := nodeB.GetSHA(p, limit, args.FollowSym)
-						if time.Since(start) > TIME_WARNING && args.Verbose {
-							fmt.Fprintf(cmd.ErrWriter, "SHA check for %s took %v\n", p, time.Since(start))
+						if checkAttrs && filesA[p].Attrs != filesB[p].Attrs {
+							report(DiffItem{Path: p, Type: AttrChanged, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size)})
+							changes = append(changes, AttrChanged)
 						}
 
-						if errA != nil || errB != nil || shaA != shaB {
-							resultCh <- DiffItem{Path: p, Type: Modified, IsDir: false}
+						if len(changes) == 0 && printIdentical {
+							reportIdentical(p)
+						}
+
+						if state != nil && compareCtx.Err() == nil {
+							state.Record(p, filesA[p], filesB[p], changes)
 						}
 					}(path)
 				}
@@ -235,15 +837,853 @@ func runMaster(ctx context.Context, args *ParsedArgs, cmd *cli.Command) error {
 	}
 
 	wg.Wait()
-	close(resultCh)
 	close(progressCh)
 	barWg.Wait()
 
-	for item := range resultCh {
-		results = append(results, item)
+	// files of a root which disappeared while comparing would all show up as errored
+	if err := checkRootsExist(nodeA, nodeB, args); err != nil {
+		return err
+	}
+
+	err = printAndDetermineExit(results, cmd, args.Verbose)
+	// the differences found before --timeout or a cancellation are printed, but without the rest there is no verdict
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s, the printed differences are incomplete", ErrTimeout, cmd.Duration("timeout"))
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w, the printed differences are incomplete", ctxErr)
+	}
+	if cmd.Bool("interactive") && isInteractiveInput(cmd.Reader) {
+		reviewModified(cmd.Reader, cmd.Writer, results, nodeA, nodeB, args.FollowSym)
+	}
+	if statsPath := cmd.String("stats-json"); statsPath != "" {
+		if writeErr := writeRunSummary(statsPath, results, bytesHashed.Load(), time.Since(start), workers); writeErr != nil {
+			return writeErr
+		}
+	}
+	if cmd.Bool("fingerprint") && !cmd.Bool("quiet") {
+		// the differences are already printed, so a failure only loses the fingerprints
+		fpA, fpErr := fingerprint(nodeA, filesA, dirsA, limitFor, args.FollowSym, workers, compareOpts.Sums)
+		if fpErr != nil {
+			slog.Warn("failed to compute the fingerprint", "side", "A", "error", fpErr)
+		}
+		fpB, fpErrB := fingerprint(nodeB, filesB, dirsB, limitFor, args.FollowSym, workers, compareOpts.Sums)
+		if fpErrB != nil {
+			slog.Warn("failed to compute the fingerprint", "side", "B", "error", fpErrB)
+		}
+		if fpErr == nil && fpErrB == nil {
+			printFingerprints(cmd, fpA, fpB)
+		}
+	}
+	if cmd.Bool("report-dupes") && !cmd.Bool("quiet") {
+		for _, side := range []struct {
+			name  string
+			node  DirNode
+			files map[string]FileMeta
+		}{{"A", nodeA, filesA}, {"B", nodeB, filesB}} {
+			groups, failed := duplicateGroups(side.node, side.files, limitFor, args.FollowSym, workers, compareOpts.Sums)
+			for _, p := range slices.Sorted(maps.Keys(failed)) {
+				slog.Warn("skipping unreadable file while finding duplicates", "side", side.name, "path", p, "error", failed[p])
+			}
+			listDuplicates(cmd.Writer, side.name, groups)
+		}
+	}
+	if truncated && !cmd.Bool("quiet") {
+		fmt.Fprintf(cmd.ErrWriter, "(stopped after %d diffs)\n", maxDiffs)
+	}
+	if cmd.Bool("list-unreadable") && !cmd.Bool("quiet") {
+		listUnreadable(cmd.Writer, issuesA, issuesB, unreadable)
+	}
+	if n := len(issuesA) + len(issuesB); n > 0 {
+		if !cmd.Bool("quiet") {
+			reportInaccessible(cmd.ErrWriter, issuesA, issuesB, args.Verbose)
+		}
+		if cmd.Bool("strict") {
+			// the verdict is kept, but the exit code marks the run as incomplete
+			err = errors.Join(err, fmt.Errorf("%d %w", n, ErrInaccessible))
+		}
+	}
+	stateCompleted = !truncated && ctx.Err() == nil
+	return err
+}
+
+// shaCache remembers the SHA256 sums of raw content computed while comparing, per node,
+// so that --fingerprint doesn't hash the same files again. A nil cache remembers nothing.
+type shaCache struct {
+	mu   sync.Mutex
+	sums map[DirNode]map[shaKey]string
+}
+
+type shaKey struct {
+	relPath   string
+	limit     int64
+	followSym bool
+}
+
+func newSHACache() *shaCache {
+	return &shaCache{sums: make(map[DirNode]map[shaKey]string)}
+}
+
+func (c *shaCache) add(node DirNode, key shaKey, sum string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sums[node] == nil {
+		c.sums[node] = make(map[shaKey]string)
+	}
+	c.sums[node][key] = sum
+}
+
+func (c *shaCache) get(node DirNode, key shaKey) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum, ok := c.sums[node][key]
+	return sum, ok
+}
+
+// fingerprint returns a SHA256 over the sorted relative paths of a side together with
+// the SHA256 of each file, limited to limitFor(path) bytes like the content comparison.
+// Directories contribute their path. Sums already in the cache are not computed again.
+func fingerprint(node DirNode, files, dirs map[string]FileMeta, limitFor func(string) int64, followSym bool, workers int, cache *shaCache) (string, error) {
+	paths := slices.Sorted(maps.Keys(files))
+	for d := range dirs {
+		paths = append(paths, d+"/")
+	}
+	slices.Sort(paths)
+
+	var regular []string
+	for _, p := range paths {
+		if !strings.HasSuffix(p, "/") && files[p].Special == "" {
+			regular = append(regular, p)
+		}
+	}
+	sums, failed := hashFiles(node, regular, limitFor, followSym, workers, cache)
+	for _, p := range regular {
+		if err := failed[p]; err != nil {
+			return "", err
+		}
+	}
+
+	h := sha256.New()
+	for _, p := range paths {
+		if strings.HasSuffix(p, "/") {
+			fmt.Fprintf(h, "%s\x00\n", p)
+			continue
+		}
+		if special := files[p].Special; special != "" {
+			fmt.Fprintf(h, "%s\x00%s\n", p, special)
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", p, sums[p])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFiles returns the SHA256 of the raw content of files, each limited to limitFor(path)
+// bytes, using the sums in the cache. The others are hashed by a pool of workers, so
+// a remote node sends them in batches. Files which failed to hash are returned with their error.
+func hashFiles(node DirNode, relPaths []string, limitFor func(string) int64, followSym bool, workers int, cache *shaCache) (map[string]string, map[string]error) {
+	sums := make(map[string]string, len(relPaths))
+	failed := make(map[string]error)
+	var mu sync.Mutex
+	jobCh := make(chan string)
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobCh {
+				sum, err := node.GetSHA(p, limitFor(p), followSym, TextNorm{})
+				mu.Lock()
+				if err != nil {
+					failed[p] = err
+				} else {
+					sums[p] = sum
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range relPaths {
+		if sum, ok := cache.get(node, shaKey{p, limitFor(p), followSym}); ok {
+			mu.Lock() // the workers write the sums of earlier files concurrently
+			sums[p] = sum
+			mu.Unlock()
+			continue
+		}
+		jobCh <- p
+	}
+	close(jobCh)
+	wg.Wait()
+	return sums, failed
+}
+
+// duplicateGroup is a group of files within one side with the same size and SHA256.
+// The files of an approximate group were hashed sparsely and may still differ.
+type duplicateGroup struct {
+	Paths       []string
+	Approximate bool
+}
+
+// duplicateGroups returns the groups of files within one side with identical content, each sorted
+// by path. Only non-empty regular files sharing their size with another file are hashed,
+// each limited to limitFor(path) bytes like the content comparison and reusing the sums in the cache.
+// Files which failed to hash are left out and returned with their error.
+func duplicateGroups(node DirNode, files map[string]FileMeta, limitFor func(string) int64, followSym bool, workers int, cache *shaCache) ([]duplicateGroup, map[string]error) {
+	bySize := make(map[int64][]string)
+	for p, meta := range files {
+		if meta.Special == "" && meta.Size > 0 {
+			bySize[meta.Size] = append(bySize[meta.Size], p)
+		}
+	}
+	var candidates []string
+	for _, paths := range bySize {
+		if len(paths) > 1 {
+			candidates = append(candidates, paths...)
+		}
+	}
+	sums, failed := hashFiles(node, candidates, limitFor, followSym, workers, cache)
+
+	type groupKey struct {
+		size int64
+		sum  string
+	}
+	bySum := make(map[groupKey][]string)
+	for p, sum := range sums {
+		key := groupKey{files[p].Size, sum}
+		bySum[key] = append(bySum[key], p)
+	}
+	var groups []duplicateGroup
+	for key, paths := range bySum {
+		if len(paths) < 2 {
+			continue
+		}
+		slices.Sort(paths)
+		group := duplicateGroup{Paths: paths}
+		for _, p := range paths {
+			if limit := limitFor(p); limit > 0 && key.size > limit {
+				group.Approximate = true
+			}
+		}
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b duplicateGroup) int { return strings.Compare(a.Paths[0], b.Paths[0]) })
+	return groups, failed
+}
+
+// listDuplicates prints the groups of identical files of one side, one group per line.
+// Approximate groups are marked since only the sparsely hashed parts are known to match.
+// Nothing is printed without duplicates.
+func listDuplicates(w io.Writer, side string, groups []duplicateGroup) {
+	if len(groups) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Duplicate files in %s:\n", side)
+	for _, group := range groups {
+		if group.Approximate {
+			fmt.Fprintf(w, "  %s (sparsely hashed, may differ)\n", strings.Join(group.Paths, " = "))
+		} else {
+			fmt.Fprintf(w, "  %s\n", strings.Join(group.Paths, " = "))
+		}
+	}
+}
+
+// checkRootNotLink fails if the root of a node is not a directory without following symlinks.
+// Stating the empty relative path without following symlinks reports a symlinked root as a file.
+func checkRootNotLink(node DirNode, pathStr string) error {
+	files, _, err := node.StatPaths([]string{""}, false)
+	if err != nil {
+		return err
+	}
+	if _, ok := files[""]; ok {
+		return fmt.Errorf("%s is not a directory (symlinked roots require --dereference-root)", pathStr)
+	}
+	return nil
+}
+
+// checkRootsExist returns ErrRootVanished if a compared directory no longer exists,
+// e.g. because it was deleted or unmounted since the run started.
+func checkRootsExist(nodeA, nodeB DirNode, args *ParsedArgs) error {
+	for _, side := range []struct {
+		node    DirNode
+		pathStr string
+	}{{nodeA, args.PathA}, {nodeB, args.PathB}} {
+		if !canVanish(side.node) {
+			continue
+		}
+		_, dirs, err := side.node.StatPaths([]string{""}, true)
+		if err != nil {
+			return err
+		}
+		if _, ok := dirs[""]; !ok {
+			return fmt.Errorf("%w: %s", ErrRootVanished, side.pathStr)
+		}
+	}
+	return nil
+}
+
+// canVanish reports whether the root of a node can disappear during a run.
+func canVanish(node DirNode) bool {
+	switch n := node.(type) {
+	case *EmptyNode, *GitNode:
+		return false // neither can disappear
+	case *prefixedNode:
+		return canVanish(n.DirNode)
+	}
+	return true
+}
+
+// excludeInaccessible removes everything below the directories which could not be listed on
+// either side from both sides, so their contents count neither as added nor as removed.
+// The directories themselves are kept. A root which could not be listed excludes everything.
+func excludeInaccessible(filesA, dirsA, filesB, dirsB map[string]FileMeta, issues []ScanIssue) {
+	var prefixes []string
+	for _, issue := range issues {
+		if !issue.Dir {
+			continue
+		}
+		if issue.Path == "." {
+			prefixes = []string{""}
+			break
+		}
+		prefixes = append(prefixes, issue.Path+"/")
+	}
+	if len(prefixes) == 0 {
+		return
+	}
+	below := func(p string, _ FileMeta) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(p, prefix) {
+				slog.Debug("excluding path below inaccessible directory", "path", p)
+				return true
+			}
+		}
+		return false
+	}
+	for _, m := range []map[string]FileMeta{filesA, dirsA, filesB, dirsB} {
+		maps.DeleteFunc(m, below)
+	}
+}
+
+// reportInaccessible prints how many paths could not be read during the scans
+// and, if verbose, which ones.
+func reportInaccessible(w io.Writer, issuesA, issuesB []ScanIssue, verbose bool) {
+	fmt.Fprintf(w, "%d paths were inaccessible\n", len(issuesA)+len(issuesB))
+	if !verbose {
+		return
+	}
+	for _, side := range []struct {
+		name   string
+		issues []ScanIssue
+	}{{"A", issuesA}, {"B", issuesB}} {
+		for _, issue := range side.issues {
+			fmt.Fprintf(w, "  %s: %s (%s)\n", side.name, issue.Path, issue.Err)
+		}
 	}
+}
+
+// listUnreadable prints every path which could not be read while scanning either side
+// or comparing, with the error, in a section after the differences. Nothing is printed
+// if all paths were readable.
+func listUnreadable(w io.Writer, issuesA, issuesB, compareIssues []ScanIssue) {
+	if len(issuesA)+len(issuesB)+len(compareIssues) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Unreadable paths:")
+	for _, side := range []struct {
+		name   string
+		issues []ScanIssue
+	}{{"A", issuesA}, {"B", issuesB}} {
+		for _, issue := range side.issues {
+			fmt.Fprintf(w, "  %s: %s (%s)\n", side.name, issue.Path, issue.Err)
+		}
+	}
+	slices.SortFunc(compareIssues, func(a, b ScanIssue) int { return strings.Compare(a.Path, b.Path) })
+	for _, issue := range compareIssues {
+		fmt.Fprintf(w, "  %s (%s)\n", issue.Path, issue.Err)
+	}
+}
+
+// ErrPanic is returned if comparing a single file panicked.
+var ErrPanic = errors.New("comparison panicked")
+
+// panicError converts the value recovered from a panic while comparing relPath into an error,
+// logging the stack trace for debugging.
+func panicError(relPath string, r any) error {
+	slog.Debug("recovered from panic", "path", relPath, "panic", r, "stack", string(debug.Stack()))
+	return fmt.Errorf("%w: %v", ErrPanic, r)
+}
+
+// ErrFileTimeout is returned if comparing a single file took longer than --file-timeout.
+var ErrFileTimeout = errors.New("file comparison timed out")
 
-	return printAndDetermineExit(results, cmd, args.Verbose)
+// compareWithTimeout runs compare, giving up after timeout (0 = no timeout) or once ctx is done.
+// Blocked reads can't be interrupted, so a timed out comparison is left running in the background.
+func compareWithTimeout(ctx context.Context, timeout time.Duration, compare func() (bool, error)) (bool, error) {
+	if timeout <= 0 && ctx.Done() == nil {
+		return compare()
+	}
+	type outcome struct {
+		equal bool
+		err   error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		equal, err := compare()
+		done <- outcome{equal, err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case o := <-done:
+		return o.equal, o.err
+	case <-expired:
+		return false, ErrFileTimeout
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// effectiveWorkers caps the requested number of workers to the number of jobs,
+// so no idle goroutines are spawned for small comparisons.
+func effectiveWorkers(requested, jobs int) int {
+	return max(1, min(requested, jobs))
+}
+
+// skipSpecialFiles removes FIFOs, sockets and devices from a scan, warning about each.
+func skipSpecialFiles(files map[string]FileMeta) {
+	for relPath, meta := range files {
+		if meta.Special != "" && !isSubmodule(meta) {
+			slog.Warn("skipping special file", "path", relPath, "type", meta.Special)
+			delete(files, relPath)
+		}
+	}
+}
+
+// progressWeights returns how far each common file advances the progress bar and the bar's total.
+// Files are weighted by their size so large files don't stall the bar near the end.
+// If no sizes are known, e.g. all files are empty, every file counts as one unit and bytes is false.
+func progressWeights(commonFiles []string, filesA, filesB map[string]FileMeta) (map[string]int64, int64, bool) {
+	weights := make(map[string]int64, len(commonFiles))
+	var total int64
+	for _, p := range commonFiles {
+		weights[p] = max(filesA[p].Size, filesB[p].Size)
+		total += weights[p]
+	}
+	if total > 0 {
+		return weights, total, true
+	}
+	for _, p := range commonFiles {
+		weights[p] = 1
+	}
+	return weights, int64(len(commonFiles)), false
+}
+
+// estimateHashedBytes returns the bytes read from both sides to compare commonFiles, at most,
+// with the size limits applied as by the workers.
+func estimateHashedBytes(commonFiles []string, filesA, filesB map[string]FileMeta, args *ParsedArgs, fastGlobs []glob.Glob) int64 {
+	var total int64
+	for _, p := range commonFiles {
+		limit := args.GlobalLimit
+		if matchesAny(fastGlobs, p, false) {
+			limit = args.FastLimit
+		}
+		total += hashedBytes(filesA[p].Size, limit) + hashedBytes(filesB[p].Size, limit)
+	}
+	return total
+}
+
+// runProgress adds the weights of completed files from progressCh to bar until the channel
+// is closed, calling describe before drawing. With an interval, the weights are accumulated
+// and the bar is only updated once per interval.
+func runProgress(bar *progressbar.ProgressBar, progressCh <-chan int64, interval time.Duration, describe func()) {
+	// the description is refreshed periodically too, so a stuck file shows up
+	refresh := PROGRESS_REFRESH
+	if interval > 0 {
+		refresh = interval
+	}
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	var pending int64
+	for {
+		select {
+		case weight, ok := <-progressCh:
+			if !ok {
+				if pending > 0 {
+					bar.Add64(pending)
+				}
+				return
+			}
+			if interval > 0 {
+				pending += weight
+				continue
+			}
+			describe()
+			bar.Add64(weight)
+		case <-ticker.C:
+			describe()
+			if pending > 0 {
+				bar.Add64(pending)
+				pending = 0
+			}
+		}
+	}
+}
+
+// progressDescription returns the progress bar description naming the file being compared.
+// Long paths are shortened to their last PROGRESS_NAME_WIDTH characters.
+func progressDescription(relPath string) string {
+	if runes := []rune(relPath); len(runes) > PROGRESS_NAME_WIDTH {
+		relPath = "..." + string(runes[len(runes)-PROGRESS_NAME_WIDTH+3:])
+	}
+	return "Comparing files: " + relPath
+}
+
+// hasInodes reports whether the scan of a side carries inode numbers.
+func hasInodes(files map[string]FileMeta) bool {
+	for _, meta := range files {
+		if meta.Ino != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// diffHardlinks reports common files whose hardlink grouping differs between
+// both sides, e.g. a file hardlinked to another file in A but not in B.
+// Only links among common files are considered.
+func diffHardlinks(filesA, filesB map[string]FileMeta, commonFiles []string) []DiffItem {
+	type inode struct{ dev, ino uint64 }
+
+	peers := func(files map[string]FileMeta) map[string]string {
+		groups := make(map[inode][]string)
+		for _, p := range commonFiles {
+			if meta := files[p]; meta.Ino != 0 {
+				key := inode{meta.Dev, meta.Ino}
+				groups[key] = append(groups[key], p)
+			}
+		}
+		// describe each file by the sorted list of all paths sharing its inode
+		linked := make(map[string]string)
+		for _, paths := range groups {
+			if len(paths) < 2 {
+				continue
+			}
+			sort.Strings(paths)
+			group := strings.Join(paths, "\x00")
+			for _, p := range paths {
+				linked[p] = group
+			}
+		}
+		return linked
+	}
+
+	linkedA, linkedB := peers(filesA), peers(filesB)
+
+	var results []DiffItem
+	for _, p := range commonFiles {
+		if linkedA[p] != linkedB[p] {
+			results = append(results, DiffItem{Path: p, Type: LinkChanged, IsDir: false, Size: max(filesA[p].Size, filesB[p].Size)})
+		}
+	}
+	return results
+}
+
+// readPathList reads a newline-delimited list of relative paths from a file or,
+// for "-", from stdin. Empty lines are skipped and paths are cleaned; absolute
+// paths and paths escaping the root are rejected.
+func readPathList(source string, stdin io.Reader) ([]string, error) {
+	r := stdin
+	if source != "-" {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var relPaths []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		relPath := path.Clean(filepath.ToSlash(line))
+		if path.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			return nil, fmt.Errorf("path %q is not relative to the root", line)
+		}
+		if relPath != "." && !seen[relPath] {
+			seen[relPath] = true
+			relPaths = append(relPaths, relPath)
+		}
+	}
+	return relPaths, scanner.Err()
+}
+
+// progressWriter returns the destination of the progress bar selected by
+// --progress-fd or --progress-to-stdout, defaulting to cmd.ErrWriter.
+// The returned closer closes the --progress-fd file once the bar is done.
+func progressWriter(cmd *cli.Command) (io.Writer, io.Closer) {
+	if fd := cmd.Int("progress-fd"); fd > 0 {
+		f := os.NewFile(uintptr(fd), "progress")
+		return f, f
+	}
+	if cmd.Bool("progress-to-stdout") {
+		return cmd.Writer, io.NopCloser(nil)
+	}
+	return cmd.ErrWriter, io.NopCloser(nil)
+}
+
+// compareXattrs reports whether a file carries the same extended attributes on both sides.
+func compareXattrs(nodeA, nodeB DirNode, relPath string, followSym bool) (bool, error) {
+	attrsA, err := nodeA.GetXattrs(relPath, followSym)
+	if err != nil {
+		return false, err
+	}
+	attrsB, err := nodeB.GetXattrs(relPath, followSym)
+	if err != nil {
+		return false, err
+	}
+	return maps.Equal(attrsA, attrsB), nil
+}
+
+// CompareOptions controls how the content of a common file is compared.
+type CompareOptions struct {
+	FollowSym bool
+	Norm      TextNorm
+	Only      ContentClass
+	// SparseAware additionally requires equal files to have the same holes.
+	SparseAware bool
+	// Bytewise compares local files of the same size directly instead of hashing them.
+	Bytewise bool
+	// Sums collects the computed SHA256 sums for --fingerprint and --report-dupes, nil if not needed.
+	Sums *shaCache
+	// Hash are the options the nodes hash with, e.g. a --hash-cmd deciding alone.
+	Hash HashOptions
+}
+
+// compareContent compares the content of a file on both sides, replaceable for testing purposes.
+var compareContent = compareFileContent
+
+// compareFileContent compares a file present on both sides.
+// Sizes are compared first, then a quick MD5 of a few sparse bytes and
+// finally a SHA256 limited to limit bytes (0 = no limit).
+// If a text normalization is enabled, the size and MD5 checks don't decide
+// since normalized content may be equal despite different raw bytes.
+// If only one content class is compared, files of the other class on both
+// sides are skipped and reported as equal; the class is detected during the MD5 check.
+// Two empty files are equal without being opened.
+// With Bytewise, two local files are read block by block instead of hashed.
+// A non-nil error means the file could not be read on at least one side,
+// e.g. because it vanished after the scan.
+func compareFileContent(nodeA, nodeB DirNode, relPath string, sizeA, sizeB, limit int64, opts CompareOptions) (bool, error) {
+	if sizeA == 0 && sizeB == 0 {
+		return true, nil
+	}
+	same, err := compareBytes(nodeA, nodeB, relPath, sizeA, sizeB, limit, opts)
+	if !same || err != nil || !opts.SparseAware {
+		return same, err
+	}
+	return compareSparseLayout(nodeA, nodeB, relPath, opts.FollowSym)
+}
+
+func compareBytes(nodeA, nodeB DirNode, relPath string, sizeA, sizeB, limit int64, opts CompareOptions) (bool, error) {
+	if opts.Hash.HashCmd != "" {
+		// the output of --hash-cmd decides, even for files of different sizes
+		return compareSHA(nodeA, nodeB, relPath, limit, opts)
+	}
+	if sizeA != sizeB && opts.Only == ClassAny && !opts.Norm.Enabled() {
+		return false, nil
+	}
+	if opts.Bytewise && opts.Only == ClassAny && !opts.Norm.Enabled() && (limit <= 0 || sizeA <= limit) {
+		// two local files can be read in parallel, stopping at the first difference
+		pathA, okA := localPath(nodeA, relPath)
+		pathB, okB := localPath(nodeB, relPath)
+		if okA && okB {
+			return withReadRetries(opts.Hash.ReadRetries, func() (bool, error) {
+				return compareLocalFiles(pathA, pathB, opts.FollowSym)
+			})
+		}
+	}
+	if opts.Only == ClassAny && opts.Norm.Enabled() {
+		return compareSHA(nodeA, nodeB, relPath, limit, opts)
+	}
+
+	md5A, binaryA, err := nodeA.GetMD5(relPath, opts.FollowSym)
+	if err != nil {
+		return false, err
+	}
+	md5B, binaryB, err := nodeB.GetMD5(relPath, opts.FollowSym)
+	if err != nil {
+		return false, err
+	}
+
+	switch opts.Only {
+	case ClassText:
+		if binaryA && binaryB {
+			return true, nil
+		}
+	case ClassBinary:
+		if !binaryA && !binaryB {
+			return true, nil
+		}
+	}
+
+	if opts.Norm.Enabled() {
+		return compareSHA(nodeA, nodeB, relPath, limit, opts)
+	}
+	if sizeA != sizeB || md5A != md5B {
+		return false, nil
+	}
+
+	return compareSHA(nodeA, nodeB, relPath, limit, opts)
+}
+
+// writeRunSummary writes the --stats-json sidecar of a run.
+func writeRunSummary(path string, results []DiffItem, bytesHashed int64, elapsed time.Duration, workers int) error {
+	stats := gatherStats(results)
+	summary := runSummary{
+		Verdict:     verdictName(stats.Verdict()),
+		Stats:       stats,
+		BytesHashed: bytesHashed,
+		Elapsed:     elapsed.Seconds(),
+		Workers:     workers,
+	}
+	if err := writeJSONFile(path, summary); err != nil {
+		return fmt.Errorf("writing --stats-json failed: %w", err)
+	}
+	return nil
+}
+
+// sizeDelta returns the absolute difference of the sizes of a file on both sides.
+func sizeDelta(a, b FileMeta) int64 {
+	return max(a.Size-b.Size, b.Size-a.Size)
+}
+
+// hashedBytes is the number of bytes of a file read to compare its content, at most.
+func hashedBytes(size, limit int64) int64 {
+	if limit > 0 {
+		return min(size, limit)
+	}
+	return size
+}
+
+// locateMismatch describes where a modified file differs. The first differing byte is only
+// searched for if both sides are local, otherwise just the sizes are known.
+func locateMismatch(nodeA, nodeB DirNode, relPath string, sizeA, sizeB int64, followSym bool) *Mismatch {
+	m := &Mismatch{Offset: -1, SizeA: sizeA, SizeB: sizeB}
+	pathA, okA := localPath(nodeA, relPath)
+	pathB, okB := localPath(nodeB, relPath)
+	if okA && okB {
+		offset, err := firstLocalDifference(pathA, pathB, followSym)
+		if err != nil {
+			slog.Debug("failed to locate difference", "path", relPath, "error", err)
+		} else {
+			m.Offset = offset
+		}
+	}
+	return m
+}
+
+// countBlockDifferences counts the differing blocks of a modified file larger than a block.
+// Only files on two local sides are read again, otherwise nil is returned.
+func countBlockDifferences(nodeA, nodeB DirNode, relPath string, followSym bool) *BlockDiff {
+	pathA, okA := localPath(nodeA, relPath)
+	pathB, okB := localPath(nodeB, relPath)
+	if !okA || !okB {
+		return nil
+	}
+	changed, total, err := localBlockDifferences(pathA, pathB, followSym)
+	if err != nil {
+		slog.Debug("failed to compare blocks", "path", relPath, "error", err)
+		return nil
+	}
+	return &BlockDiff{Changed: changed, Total: total}
+}
+
+// localPath returns the path of a file of a local node.
+func localPath(node DirNode, relPath string) (string, bool) {
+	switch n := node.(type) {
+	case *LocalNode:
+		return filepath.Join(n.root, filepath.FromSlash(relPath)), true
+	case *prefixedNode:
+		return localPath(n.DirNode, n.path(relPath))
+	}
+	return "", false
+}
+
+func compareSHA(nodeA, nodeB DirNode, relPath string, limit int64, opts CompareOptions) (bool, error) {
+	shaA, err := nodeA.GetSHA(relPath, limit, opts.FollowSym, opts.Norm)
+	if err != nil {
+		return false, err
+	}
+	shaB, err := nodeB.GetSHA(relPath, limit, opts.FollowSym, opts.Norm)
+	if err != nil {
+		return false, err
+	}
+	if !opts.Norm.Enabled() {
+		key := shaKey{relPath, limit, opts.FollowSym}
+		opts.Sums.add(nodeA, key, shaA)
+		opts.Sums.add(nodeB, key, shaB)
+	}
+	return shaA == shaB, nil
+}
+
+// compareSparseLayout reports whether a file has its data and holes at the same offsets on both sides.
+// If holes can't be detected on either side, only the content decides.
+func compareSparseLayout(nodeA, nodeB DirNode, relPath string, followSym bool) (bool, error) {
+	layoutA, err := nodeA.GetSparseLayout(relPath, followSym)
+	if errors.Is(err, ErrSparseUnsupported) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	layoutB, err := nodeB.GetSparseLayout(relPath, followSym)
+	if errors.Is(err, ErrSparseUnsupported) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return layoutA == layoutB, nil
+}
+
+// isSameLocalPath reports whether both arguments are local paths referring to the very same directory.
+// Roots are resolved through symlinks, so two symlinks to the same target are identical,
+// while a root pointing into the other root's subtree is not.
+func isSameLocalPath(pathA, pathB string) (string, bool) {
+	if isRemotePath(pathA) || isRemotePath(pathB) {
+		return "", false
+	}
+	infoA, err := os.Stat(pathA)
+	if err != nil {
+		return "", false
+	}
+	infoB, err := os.Stat(pathB)
+	if err != nil || !os.SameFile(infoA, infoB) {
+		return "", false
+	}
+	realPath, err := filepath.EvalSymlinks(pathA)
+	if err != nil {
+		return "", false
+	}
+	absPath, err := filepath.Abs(realPath)
+	if err != nil {
+		return "", false
+	}
+	return absPath, true
 }
 
 // readPassword reads a password from the terminal with echo disabled.
@@ -262,10 +1702,10 @@ func readPassword() string {
 	return string(bytePassword)
 }
 
-func compileGlobs(patterns []string) ([]glob.Glob, error) {
+func compileGlobs(patterns []string, syntax string) ([]glob.Glob, error) {
 	var globs []glob.Glob
 	for _, p := range patterns {
-		g, err := glob.Compile(p)
+		g, err := compilePattern(p, syntax)
 		if err != nil {
 			return nil, err
 		}
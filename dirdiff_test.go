@@ -3,13 +3,58 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/rpc"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/schollz/progressbar/v3"
 )
 
+func TestMain(m *testing.M) {
+	// the test binary doubles as the remote agent spawned by fake remote shells
+	if os.Getenv("DIRDIFF_TEST_AGENT") != "" {
+		runAgent()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Helper to create a fake remote shell script which ignores the host and
+// agent arguments and runs the test binary as a local agent
+func createFakeRsh(t *testing.T) string {
+	testBin, err := os.Executable()
+	if err != nil {
+		t.Fatalf("failed to locate test binary: %v", err)
+	}
+	script := filepath.Join(t.TempDir(), "fake-rsh")
+	content := fmt.Sprintf("#!/bin/sh\nDIRDIFF_TEST_AGENT=1 exec '%s'\n", testBin)
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatalf("failed to create fake rsh: %v", err)
+	}
+	return script
+}
+
 // Helper to create a file with content
 func createFile(t *testing.T, path, content string) {
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
@@ -20,8 +65,31 @@ func createFile(t *testing.T, path, content string) {
 	}
 }
 
+// runApp runs dirdiff with the given arguments, without the program name,
+// and returns what it wrote to stdout and stderr.
+func runApp(t *testing.T, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	return runAppWithInput(t, nil, args...)
+}
+
+// runAppWithInput is runApp reading stdin from input, if not nil.
+func runAppWithInput(t *testing.T, input io.Reader, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	var outBuf, errBuf bytes.Buffer
+	app := newApp()
+	app.Writer = &outBuf
+	app.ErrWriter = &errBuf
+	if input != nil {
+		app.Reader = input
+	}
+	err = app.Run(context.Background(), append([]string{"dirdiff"}, args...))
+	return outBuf.String(), errBuf.String(), err
+}
+
 // Helper to create a large file (approx 1.1MB)
-func createLargeFile(t *testing.T, path string, diffEnd bool) {
+// With diffGap, a single byte is changed in the gap between the first and
+// the middle chunk of the sparse hash, so only a full hash can detect it.
+func createLargeFile(t *testing.T, path string, diffGap bool) {
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		t.Fatalf("failed to create dirs for %s: %v", path, err)
 	}
@@ -31,8 +99,8 @@ func createLargeFile(t *testing.T, path string, diffEnd bool) {
 	for i := range data {
 		data[i] = 'A'
 	}
-	if diffEnd {
-		data[size-1] = 'B' // Change the very last byte
+	if diffGap {
+		data[size/3] = 'B'
 	}
 	if err := os.WriteFile(path, data, 0644); err != nil {
 		t.Fatalf("failed to create large file %s: %v", path, err)
@@ -73,7 +141,7 @@ func setupTestEnv(t *testing.T) string {
 	createFile(t, filepath.Join(subsetDir, "file1"), "content1")
 
 	// 6. test_fast_A and test_fast_B
-	// These files are identical in the first 1MB, but differ at the end.
+	// These files are identical in all regions read by the sparse hash.
 	// Sizes are identical.
 	fastADir := filepath.Join(root, "test_fast_A")
 	createLargeFile(t, filepath.Join(fastADir, "large.dat"), false)
@@ -81,6 +149,14 @@ func setupTestEnv(t *testing.T) string {
 	fastBDir := filepath.Join(root, "test_fast_B")
 	createLargeFile(t, filepath.Join(fastBDir, "large.dat"), true)
 
+	// 7. test_emptydir (base with an extra empty directory)
+	emptyDir := filepath.Join(root, "test_emptydir")
+	createFile(t, filepath.Join(emptyDir, "file1"), "content1")
+	createFile(t, filepath.Join(emptyDir, "file2"), "content2")
+	if err := os.MkdirAll(filepath.Join(emptyDir, "emptydir", "nested"), 0755); err != nil {
+		t.Fatalf("failed to create empty dir: %v", err)
+	}
+
 	return root
 }
 
@@ -95,6 +171,7 @@ func TestDirDiff(t *testing.T) {
 	subsetDir := filepath.Join(root, "test_subset")
 	fastADir := filepath.Join(root, "test_fast_A")
 	fastBDir := filepath.Join(root, "test_fast_B")
+	emptyDir := filepath.Join(root, "test_emptydir")
 
 	tests := []struct {
 		name          string
@@ -105,40 +182,40 @@ func TestDirDiff(t *testing.T) {
 	}{
 		{
 			name:          "Equal Directories (Code 0)",
-			args:          []string{"dirdiff", "--no-color", "--silent", baseDir, equalDir},
+			args:          []string{"--no-color", "--silent", baseDir, equalDir},
 			expectedError: nil,
 			shouldContain: []string{},
 			shouldNotHas:  []string{"+", "-", "~", "file1", "file2"},
 		},
 		{
 			name:          "Same Directory Optimization (Code 0)",
-			args:          []string{"dirdiff", "--no-color", "--silent", "--verbose", baseDir, baseDir},
+			args:          []string{"--no-color", "--silent", "--verbose", baseDir, baseDir},
 			expectedError: nil,
 			shouldContain: []string{"identical (same path: "},
 		},
 		{
 			name:          "Modified Directories (Code 1)",
-			args:          []string{"dirdiff", "--no-color", "--silent", baseDir, modDir},
+			args:          []string{"--no-color", "--silent", baseDir, modDir},
 			expectedError: ErrDiffsFound,
 			shouldContain: []string{"~ file2"},
 			shouldNotHas:  []string{"+", "-"},
 		},
 		{
 			name:          "Mixed Divergence (Code 1)",
-			args:          []string{"dirdiff", "--no-color", "--silent", baseDir, inequalDir},
+			args:          []string{"--no-color", "--silent", baseDir, inequalDir},
 			expectedError: ErrDiffsFound,
 			shouldContain: []string{"- file2", "+ file4", "+ file5"},
 		},
 		{
 			name:          "A is Subset of B (Code 3)",
-			args:          []string{"dirdiff", "--no-color", "--silent", subsetDir, baseDir},
+			args:          []string{"--no-color", "--silent", subsetDir, baseDir},
 			expectedError: ErrASubsetB,
 			shouldContain: []string{"+ file2"},
 			shouldNotHas:  []string{"-", "~"},
 		},
 		{
 			name:          "B is Subset of A (Code 4)",
-			args:          []string{"dirdiff", "--no-color", "--silent", baseDir, subsetDir},
+			args:          []string{"--no-color", "--silent", baseDir, subsetDir},
 			expectedError: ErrBSubsetA,
 			shouldContain: []string{"- file2"},
 			shouldNotHas:  []string{"+", "~"},
@@ -146,29 +223,63 @@ func TestDirDiff(t *testing.T) {
 		{
 			name: "Fast Mode OFF (Should Detect Diff)",
 			// Without --fast, it reads the whole file and sees the last byte diff
-			args:          []string{"dirdiff", "--no-color", "--silent", fastADir, fastBDir},
+			args:          []string{"--no-color", "--silent", fastADir, fastBDir},
 			expectedError: ErrDiffsFound,
 			shouldContain: []string{"~ large.dat"},
 		},
 		{
 			name: "Fast Mode ON (Should Skip Diff)",
-			// With --fast, it only reads 1MB. Since diff is at 1MB+100b, it should see them as equal.
-			args:          []string{"dirdiff", "--no-color", "--silent", "--fast", "*", fastADir, fastBDir},
+			// With --fast, it only reads 1MB in three chunks. Since diff is in a gap, it should see them as equal.
+			args:          []string{"--no-color", "--silent", "--fast", "*", fastADir, fastBDir},
 			expectedError: nil, // Should be Code 0 (Identical)
 			shouldNotHas:  []string{"~ large.dat"},
 		},
+		{
+			name:          "Added Empty Directory (Code 3)",
+			args:          []string{"--no-color", "--silent", baseDir, emptyDir},
+			expectedError: ErrASubsetB,
+			shouldContain: []string{"+ emptydir/"},
+			shouldNotHas:  []string{"-", "~"},
+		},
+		{
+			name:          "Removed Empty Directory (Code 4)",
+			args:          []string{"--no-color", "--silent", emptyDir, baseDir},
+			expectedError: ErrBSubsetA,
+			shouldContain: []string{"- emptydir/"},
+			shouldNotHas:  []string{"+", "~", "nested"},
+		},
+		{
+			name:          "Nested Empty Directory with Show All (Code 3)",
+			args:          []string{"--no-color", "--silent", "--show-all", baseDir, emptyDir},
+			expectedError: ErrASubsetB,
+			shouldContain: []string{"+ emptydir/", "+ emptydir/nested/"},
+		},
+		{
+			name:          "Exclude Only on Side A (Code 3)",
+			args:          []string{"--no-color", "--silent", "--exclude-a", "file2", baseDir, equalDir},
+			expectedError: ErrASubsetB,
+			shouldContain: []string{"+ file2"},
+			shouldNotHas:  []string{"-", "~"},
+		},
+		{
+			name:          "Exclude Only on Side B (Code 4)",
+			args:          []string{"--no-color", "--silent", "--exclude-b", "file2", baseDir, equalDir},
+			expectedError: ErrBSubsetA,
+			shouldContain: []string{"- file2"},
+			shouldNotHas:  []string{"+", "~"},
+		},
+		{
+			name:          "Include Only on Side A (Code 3)",
+			args:          []string{"--no-color", "--silent", "--include-a", "file1", baseDir, equalDir},
+			expectedError: ErrASubsetB,
+			shouldContain: []string{"+ file2"},
+			shouldNotHas:  []string{"-", "~", "file1"},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var outBuf bytes.Buffer
-			var errBuf bytes.Buffer
-
-			app := newApp()
-			app.Writer = &outBuf
-			app.ErrWriter = &errBuf
-
-			err := app.Run(context.Background(), tt.args)
+			output, errOutput, err := runApp(t, tt.args...)
 
 			if tt.expectedError != nil {
 				if err == nil {
@@ -182,10 +293,7 @@ func TestDirDiff(t *testing.T) {
 				}
 			}
 
-			output := outBuf.String()
-			errOutput := errBuf.String() // Check stderr for verbose/status messages
-
-			// Combine output for checking
+			// Combine output for checking, stderr holds verbose/status messages
 			fullOutput := output + errOutput
 
 			for _, want := range tt.shouldContain {
@@ -202,3 +310,3857 @@ func TestDirDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestChecksumFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("names with a backslash can't be created on Windows")
+	}
+	sha256sum, err := exec.LookPath("sha256sum")
+	if err != nil {
+		t.Skip("sha256sum not available")
+	}
+
+	root := t.TempDir()
+	createFile(t, filepath.Join(root, "file1"), "content1")
+	createFile(t, filepath.Join(root, "b file"), "content with space")
+	createFile(t, filepath.Join(root, "subdir", "ts2"), "sub content")
+	// names with a backslash or a line break are escaped, symlinks are hashed by their content
+	createFile(t, filepath.Join(root, "we\\ird"), "weird")
+	createFile(t, filepath.Join(root, "new\nline"), "new line")
+	if err := os.Symlink("file1", filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	outPath := filepath.Join(t.TempDir(), "SHA256SUMS")
+
+	if _, _, err := runApp(t, "--checksum-file", outPath, root); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("failed to read checksum file: %v", err)
+	}
+
+	sumCmd := exec.Command(sha256sum, "b file", "file1", "link", "new\nline", "subdir/ts2", "we\\ird")
+	sumCmd.Dir = root
+	want, err := sumCmd.Output()
+	if err != nil {
+		t.Fatalf("sha256sum failed: %v", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("checksum file mismatch:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	// the written file verifies its own directory
+	if stdout, _, err := runApp(t, "--no-color", "--verify-against", outPath, root); err != nil || stdout != "" {
+		t.Errorf("expected the directory to verify, got %q: %v", stdout, err)
+	}
+}
+
+func TestVerifyAgainst(t *testing.T) {
+	root := t.TempDir()
+	createFile(t, filepath.Join(root, "good"), "good")
+	createFile(t, filepath.Join(root, "sub dir", "bad"), "tampered")
+	createFile(t, filepath.Join(root, "extra"), "extra")
+
+	sha := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	sumsPath := filepath.Join(t.TempDir(), "SHA256SUMS")
+	sums := sha("good") + "  ./good\n" + sha("bad") + " *sub dir/bad\n" + sha("missing") + "  missing\n"
+	if err := os.WriteFile(sumsPath, []byte(sums), 0644); err != nil {
+		t.Fatalf("failed to write sums file: %v", err)
+	}
+
+	stdout, _, err := runApp(t, "--no-color", "--verify-against", sumsPath, root)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	expected := "+ extra\n- missing\n~ sub dir/bad\n"
+	if stdout != expected {
+		t.Errorf("expected output %q, but got %q", expected, stdout)
+	}
+
+	// a matching directory verifies cleanly
+	os.Remove(filepath.Join(root, "extra"))
+	createFile(t, filepath.Join(root, "sub dir", "bad"), "bad")
+	createFile(t, filepath.Join(root, "missing"), "missing")
+	if _, _, err := runApp(t, "--verify-against", sumsPath, root); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	if err := os.WriteFile(sumsPath, []byte("not a checksum line\n"), 0644); err != nil {
+		t.Fatalf("failed to write sums file: %v", err)
+	}
+	if _, _, err := runApp(t, "--verify-against", sumsPath, root); exitCode(err) != 2 {
+		t.Errorf("expected runtime error for a malformed sums file, got: %v", err)
+	}
+
+	// an MD5 sum doesn't fit the default SHA-256
+	md5sum := md5.Sum([]byte("good"))
+	if err := os.WriteFile(sumsPath, []byte(sha("good")+"  good\n"+hex.EncodeToString(md5sum[:])+"  extra\n"), 0644); err != nil {
+		t.Fatalf("failed to write sums file: %v", err)
+	}
+	if _, _, err := runApp(t, "--verify-against", sumsPath, root); exitCode(err) != 2 || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected runtime error naming the line of the short hash, got: %v", err)
+	}
+}
+
+func TestFileVanishesBeforeCompare(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	equalDir := filepath.Join(root, "test_equal")
+
+	beforeCompareHook = func() {
+		os.Remove(filepath.Join(equalDir, "file2"))
+	}
+	defer func() { beforeCompareHook = nil }()
+
+	var stdout, stderr string
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		stdout, stderr, err = runApp(t, "--no-color", baseDir, equalDir)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDiffsFound) {
+			t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not finish after a file vanished")
+	}
+
+	if !strings.Contains(stdout, "! file2") {
+		t.Errorf("expected output to contain %q, but got:\n%s", "! file2", stdout)
+	}
+	if !strings.Contains(stderr, "100%") {
+		t.Errorf("expected progress bar to complete, but got:\n%s", stderr)
+	}
+}
+
+func TestRelativeToHeaders(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	t.Setenv("TEST_FIX_WIDTH", "80")
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--tree", "--relative-to", root, baseDir, modDir)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+
+	header := strings.SplitN(stdout, "\n", 2)[0]
+	if !strings.HasPrefix(header, "test_base") || !strings.HasSuffix(header, SEPARATOR+"test_modified") {
+		t.Errorf("expected shortened headers, but got: %q", header)
+	}
+	if strings.Contains(stdout, root) {
+		t.Errorf("expected output NOT to contain %q, but got:\n%s", root, stdout)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	t.Setenv("TEST_FIX_WIDTH", "80")
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedHeader string
+	}{
+		{"Tree", []string{"--tree", "--label-a", "before", "--label-b", "after"}, "before"},
+		{"Lines", []string{"--header", "--label-a", "before", "--label-b", "after"}, "--- before"},
+		{"Only B", []string{"--header", "--relative-to", root, "--label-b", "after"}, "--- test_base"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, baseDir, modDir)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if !strings.HasPrefix(stdout, tt.expectedHeader) || !strings.Contains(stdout, "after") {
+				t.Errorf("expected the labels in the header, got:\n%s", stdout)
+			}
+			if strings.Contains(stdout, root) {
+				t.Errorf("expected the paths to be replaced, got:\n%s", stdout)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	t.Setenv("TEST_FIX_WIDTH", "80")
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectHeader bool
+	}{
+		{"Tree With Header", []string{"--tree"}, true},
+		{"Tree Without Header", []string{"--tree", "--no-header"}, false},
+		{"Lines Without Header", nil, false},
+		{"Lines With Header", []string{"--header"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent", "--relative-to", root}, tt.args...)
+			out, _, err := runApp(t, append(args, baseDir, modDir)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+
+			hasHeader := strings.Contains(out, "test_base") && strings.Contains(out, "test_modified")
+			if hasHeader != tt.expectHeader {
+				t.Errorf("expected header %v, but got:\n%s", tt.expectHeader, out)
+			}
+			if slices.Contains(tt.args, "--header") && !strings.HasPrefix(out, "--- test_base\n+++ test_modified\n") {
+				t.Errorf("expected a header before the lines, but got:\n%s", out)
+			}
+			if slices.Contains(tt.args, "--no-header") {
+				if strings.Contains(out, HEADER_SEPARATOR) {
+					t.Errorf("expected no separator rule, but got:\n%s", out)
+				}
+				// the columns are still aligned
+				for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+					if !strings.Contains(line, SEPARATOR) {
+						t.Errorf("expected every line to contain the column separator, but got %q", line)
+					}
+				}
+			}
+		})
+	}
+
+	if _, _, err := runApp(t, "--header", "--tree", baseDir, modDir); exitCode(err) != 2 {
+		t.Errorf("expected --header with --tree to be rejected, got: %v", err)
+	}
+}
+
+func TestSince(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, dir := range []string{baseDir, modDir} {
+		if err := os.Chtimes(filepath.Join(dir, "file2"), old, old); err != nil {
+			t.Fatalf("failed to set mtime: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		since         string
+		expectedError error
+	}{
+		{"Old Files Skipped by Duration", "24h", nil},
+		{"Old Files Skipped by Timestamp", time.Now().Add(-time.Hour).Format(time.RFC3339), nil},
+		{"Touched Files Compared", "72h", ErrDiffsFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runApp(t, "--no-color", "--silent", "--since", tt.since, baseDir, modDir)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestTreeDeepNestingNarrow(t *testing.T) {
+	t.Setenv("TEST_FIX_WIDTH", "40")
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	deep := filepath.Join("level1", "level2", "level3", "level4", "level5", "level6", "a_rather_long_file_name.txt")
+	createFile(t, filepath.Join(dirA, deep), "content A")
+	createFile(t, filepath.Join(dirB, deep), "content B")
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--tree", dirA, dirB)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+
+	lines := strings.Split(strings.TrimRight(stdout, "\n"), "\n")[2:] // skip headers
+	if len(lines) != 7 {
+		t.Fatalf("expected 7 tree lines, got %d:\n%s", len(lines), stdout)
+	}
+
+	sepCol := -1
+	for _, line := range lines {
+		left, right, ok := strings.Cut(line, SEPARATOR)
+		if !ok {
+			t.Fatalf("line without separator: %q", line)
+		}
+		// the separator column must be the same on every line
+		col := utf8.RuneCountInString(left)
+		if sepCol == -1 {
+			sepCol = col
+		} else if col != sepCol {
+			t.Errorf("separator misaligned in %q: column %d, expected %d", line, col, sepCol)
+		}
+		// connectors must only ever be dropped or kept as whole groups
+		for _, side := range []string{left, right} {
+			prefix := strings.IndexFunc(side, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) })
+			if prefix == -1 {
+				t.Errorf("no name on side %q", side)
+				continue
+			}
+			if n := utf8.RuneCountInString(side[:prefix]); n%CONNECTOR_WIDTH != 0 {
+				t.Errorf("connector cut mid-group in %q (prefix width %d)", side, n)
+			}
+		}
+	}
+
+	last := lines[len(lines)-1]
+	if !strings.Contains(last, ELLIPSIS_GROUP) || !strings.Contains(last, "a_rat") {
+		t.Errorf("expected deepest line to drop leading groups and keep the name start, got %q", last)
+	}
+}
+
+func TestTreeStatusMarkersWithoutColor(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	t.Setenv("TEST_FIX_WIDTH", "80")
+
+	baseDir := filepath.Join(root, "test_base")
+	inequalDir := filepath.Join(root, "test_inequal")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name          string
+		dirB          string
+		shouldContain []string
+	}{
+		{"Added and Removed", inequalDir, []string{"file2 (-)", "file4 (+)", "file5 (+)", "subdir/ (+)"}},
+		{"Modified", modDir, []string{"file2 (M)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, "--no-color", "--silent", "--tree", baseDir, tt.dirB)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			for _, want := range tt.shouldContain {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("expected output to contain %q, but got:\n%s", want, stdout)
+				}
+			}
+			if strings.Contains(stdout, "file1 (") {
+				t.Errorf("expected unchanged file1 to have no marker, but got:\n%s", stdout)
+			}
+		})
+	}
+}
+
+func TestIgnoreEOL(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "text.txt"), "line1\nline2\nline3")
+	createFile(t, filepath.Join(dirB, "text.txt"), "line1\r\nline2\r\nline3")
+	createFile(t, filepath.Join(dirA, "ws.txt"), "line1\nline2\n")
+	createFile(t, filepath.Join(dirB, "ws.txt"), "line1  \r\nline2\t\n")
+
+	binDirA, binDirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(binDirA, "data.bin"), "\x00\x01line1\nline2\n")
+	createFile(t, filepath.Join(binDirB, "data.bin"), "\x00\x01line1\r\nline2\r\n")
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		shouldContain []string
+		shouldNotHas  []string
+	}{
+		{
+			name:          "CRLF Differs Without Flag",
+			args:          []string{dirA, dirB},
+			expectedError: ErrDiffsFound,
+			shouldContain: []string{"~ text.txt", "~ ws.txt"},
+		},
+		{
+			name:          "CRLF Equal With Flag",
+			args:          []string{"--ignore-eol", dirA, dirB},
+			expectedError: ErrDiffsFound,
+			shouldContain: []string{"~ ws.txt"},
+			shouldNotHas:  []string{"text.txt"},
+		},
+		{
+			name:          "Trailing Whitespace Equal With Flag",
+			args:          []string{"--ignore-trailing-ws", dirA, dirB},
+			expectedError: nil,
+			shouldNotHas:  []string{"text.txt", "ws.txt"},
+		},
+		{
+			name:          "Binary Files Bypass Normalization",
+			args:          []string{"--ignore-eol", binDirA, binDirB},
+			expectedError: ErrDiffsFound,
+			shouldContain: []string{"~ data.bin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			for _, want := range tt.shouldContain {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("expected output to contain %q, but got:\n%s", want, stdout)
+				}
+			}
+			for _, unwanted := range tt.shouldNotHas {
+				if strings.Contains(stdout, unwanted) {
+					t.Errorf("expected output NOT to contain %q, but got:\n%s", unwanted, stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestVerdictErrorAndExplain(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	subsetDir := filepath.Join(root, "test_subset")
+
+	_, stderr, err := runApp(t, "--no-color", "--silent", "--explain", subsetDir, baseDir)
+
+	var verdict *VerdictError
+	if !errors.As(err, &verdict) {
+		t.Fatalf("expected *VerdictError, got: %v", err)
+	}
+	if verdict.Verdict != ErrASubsetB || verdict.PathA != subsetDir || verdict.PathB != baseDir {
+		t.Errorf("unexpected verdict fields: %+v", verdict)
+	}
+	if code := exitCode(err); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+
+	want := "Exit code 3: " + subsetDir + " is a subset of " + baseDir
+	if !strings.Contains(stderr, want) {
+		t.Errorf("expected output to contain %q, but got:\n%s", want, stderr)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	equalDir := filepath.Join(root, "test_equal")
+
+	var outBuf, errBuf syncBuffer
+	app := newApp()
+	app.Writer = &outBuf
+	app.ErrWriter = &errBuf
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run(ctx, []string{"dirdiff", "--no-color", "--silent", "--watch", baseDir, equalDir})
+	}()
+
+	waitFor := func(want string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !strings.Contains(errBuf.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %q, got:\n%s", want, errBuf.String())
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	waitFor("directories are identical")
+	createFile(t, filepath.Join(equalDir, "file2"), "changed content")
+	waitFor("have divergent differences")
+
+	if !strings.Contains(outBuf.String(), "~ file2") {
+		t.Errorf("expected second render to contain %q, but got:\n%s", "~ file2", outBuf.String())
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not stop after cancellation")
+	}
+}
+
+func TestContentClassFilter(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "notes.txt"), "text version A")
+	createFile(t, filepath.Join(dirB, "notes.txt"), "text version B, longer")
+	createFile(t, filepath.Join(dirA, "blob.bin"), "\x00\x01\x02A")
+	createFile(t, filepath.Join(dirB, "blob.bin"), "\x00\x01\x02B")
+	createFile(t, filepath.Join(dirA, "latin1.txt"), "caf\xe9 A")
+	createFile(t, filepath.Join(dirB, "latin1.txt"), "caf\xe9 B")
+
+	tests := []struct {
+		name          string
+		flag          string
+		shouldContain []string
+		shouldNotHas  []string
+	}{
+		{"All Files", "--show-all", []string{"~ notes.txt", "~ blob.bin", "~ latin1.txt"}, nil},
+		{"Only Text", "--only-text", []string{"~ notes.txt"}, []string{"blob.bin", "latin1.txt"}},
+		{"Only Binary", "--only-binary", []string{"~ blob.bin", "~ latin1.txt"}, []string{"notes.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, "--no-color", "--silent", tt.flag, dirA, dirB)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			for _, want := range tt.shouldContain {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("expected output to contain %q, but got:\n%s", want, stdout)
+				}
+			}
+			for _, unwanted := range tt.shouldNotHas {
+				if strings.Contains(stdout, unwanted) {
+					t.Errorf("expected output NOT to contain %q, but got:\n%s", unwanted, stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONLOutput(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	equalDir := filepath.Join(root, "test_equal")
+	inequalDir := filepath.Join(root, "test_inequal")
+
+	tests := []struct {
+		name          string
+		dirB          string
+		expectedItems map[string]string
+		verdict       string
+	}{
+		{"Divergent", inequalDir, map[string]string{"file2": "removed", "file4": "added", "file5": "added", "subdir": "added"}, "divergent"},
+		{"Identical", equalDir, map[string]string{}, "identical"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, _ := runApp(t, "--silent", "--format", "jsonl", baseDir, tt.dirB)
+
+			lines := strings.Split(strings.TrimRight(stdout, "\n"), "\n")
+			if len(lines) != len(tt.expectedItems)+1 {
+				t.Fatalf("expected %d lines, got %d:\n%s", len(tt.expectedItems)+1, len(lines), stdout)
+			}
+
+			for _, line := range lines[:len(lines)-1] {
+				var item jsonItem
+				if err := json.Unmarshal([]byte(line), &item); err != nil {
+					t.Fatalf("invalid item line %q: %v", line, err)
+				}
+				if want, ok := tt.expectedItems[item.Path]; !ok || want != item.Type {
+					t.Errorf("unexpected item %+v", item)
+				}
+			}
+
+			var summary jsonSummary
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+				t.Fatalf("invalid summary line: %v", err)
+			}
+			if summary.Type != "summary" || summary.Verdict != tt.verdict {
+				t.Errorf("unexpected summary %+v", summary)
+			}
+		})
+	}
+}
+
+func TestCheckHardlinks(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "orig"), "shared content")
+	createFile(t, filepath.Join(dirB, "orig"), "shared content")
+	createFile(t, filepath.Join(dirB, "copy"), "shared content")
+	if err := os.Link(filepath.Join(dirA, "orig"), filepath.Join(dirA, "copy")); err != nil {
+		t.Skipf("hardlinks not supported: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		shouldContain []string
+	}{
+		{"Without Flag", []string{dirA, dirB}, nil, nil},
+		{"With Flag", []string{"--check-hardlinks", dirA, dirB}, ErrDiffsFound, []string{"& copy", "& orig"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			for _, want := range tt.shouldContain {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("expected output to contain %q, but got:\n%s", want, stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxDiffs(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for i := range 10 {
+		name := fmt.Sprintf("file%d", i)
+		createFile(t, filepath.Join(dirA, name), "content A")
+		createFile(t, filepath.Join(dirB, name), "content B")
+	}
+	createFile(t, filepath.Join(dirB, "extra1"), "extra")
+	createFile(t, filepath.Join(dirB, "extra2"), "extra")
+
+	tests := []struct {
+		name     string
+		maxDiffs string
+		expected int
+		stopped  bool
+	}{
+		{"Stops While Comparing", "5", 5, true},
+		{"Stops After Set Difference", "1", 1, true},
+		{"Limit Not Reached", "20", 12, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, err := runApp(t, "--no-color", "--silent", "--workers", "2", "--max-diffs", tt.maxDiffs, dirA, dirB)
+			if !errors.Is(err, ErrDiffsFound) && !errors.Is(err, ErrASubsetB) {
+				t.Errorf("expected a diff verdict, got: %v", err)
+			}
+
+			lines := strings.Split(strings.TrimRight(stdout, "\n"), "\n")
+			if len(lines) != tt.expected {
+				t.Errorf("expected %d diffs, got %d:\n%s", tt.expected, len(lines), stdout)
+			}
+			if note := "(stopped after " + tt.maxDiffs + " diffs)"; strings.Contains(stderr, note) != tt.stopped {
+				t.Errorf("unexpected truncation note state, stderr:\n%s", stderr)
+			}
+		})
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"ssh", []string{"ssh"}},
+		{"ssh -J jump  -p 22", []string{"ssh", "-J", "jump", "-p", "22"}},
+		{`ssh -o 'ProxyCommand nc %h %p'`, []string{"ssh", "-o", "ProxyCommand nc %h %p"}},
+		{`my\ shell "a \"b\""`, []string{"my shell", `a "b"`}},
+	}
+	for _, tt := range tests {
+		got, err := splitShellWords(tt.in)
+		if err != nil {
+			t.Errorf("splitShellWords(%q) failed: %v", tt.in, err)
+		} else if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("splitShellWords(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if _, err := splitShellWords(`ssh 'open`); err == nil {
+		t.Errorf("expected error for unterminated quote")
+	}
+}
+
+func TestCustomRsh(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake remote shell requires a POSIX shell")
+	}
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+	rsh := createFakeRsh(t)
+
+	node, err := NewRemoteNode(context.Background(), "fakehost", baseDir, "", false, []string{rsh}, 8, HashOptions{})
+	if err != nil {
+		t.Fatalf("failed to connect through fake rsh: %v", err)
+	}
+	reply := &PingReply{}
+	if err := node.client.Call("RpcAgent.Ping", PingArgs{}, reply); err != nil || reply.Status != "OK" {
+		t.Errorf("ping failed: %v %+v", err, reply)
+	}
+	if node.AttrsSupported() != attrsSupported {
+		t.Errorf("expected the agent to report the attribute support %v of its platform", attrsSupported)
+	}
+	node.Close()
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--rsh", rsh, "fakehost:"+baseDir, modDir)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if !strings.Contains(stdout, "~ file2") {
+		t.Errorf("expected output to contain %q, but got:\n%s", "~ file2", stdout)
+	}
+}
+
+func TestRemoteConnectionExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake remote shell requires a POSIX shell")
+	}
+	dir := t.TempDir()
+
+	// a transport which can't reach any host
+	rsh := filepath.Join(t.TempDir(), "failing-rsh")
+	if err := os.WriteFile(rsh, []byte("#!/bin/sh\nexit 255\n"), 0755); err != nil {
+		t.Fatalf("failed to create failing rsh: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		pathA        string
+		expectedCode int
+	}{
+		{"Unreachable Host", "unreachable:" + dir, 5},
+		{"Missing Local Directory", filepath.Join(dir, "missing"), 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runApp(t, "--silent", "--rsh", rsh, tt.pathA, dir)
+			if code := exitCode(err); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+			}
+			if tt.expectedCode == 5 && !strings.Contains(err.Error(), "unreachable") {
+				t.Errorf("expected the error to name the host, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	defer slog.SetDefault(slog.Default())
+
+	baseDir := filepath.Join(root, "test_base")
+	equalDir := filepath.Join(root, "test_equal")
+
+	tests := []struct {
+		name      string
+		flags     []string
+		wantDebug bool
+	}{
+		{"Default", nil, false},
+		{"Info", []string{"--log-level", "info"}, false},
+		{"Debug", []string{"--log-level", "debug"}, true},
+		{"Verbose Alias", []string{"--verbose"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logFile := filepath.Join(t.TempDir(), "dirdiff.log")
+			args := append([]string{"--no-color", "--silent", "--log-file", logFile}, tt.flags...)
+			if _, _, err := runApp(t, append(args, baseDir, equalDir)...); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			logs, err := os.ReadFile(logFile)
+			if err != nil {
+				t.Fatalf("failed to read log file: %v", err)
+			}
+			if got := strings.Contains(string(logs), `level=DEBUG msg="scan complete"`); got != tt.wantDebug {
+				t.Errorf("expected debug lines: %v, got log:\n%s", tt.wantDebug, logs)
+			}
+		})
+	}
+
+	if _, _, err := runApp(t, "--log-level", "chatty", baseDir, equalDir); err == nil {
+		t.Errorf("expected error for invalid log level")
+	}
+}
+
+func TestSortOrder(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "a_removed"), "12345")
+	createFile(t, filepath.Join(dirA, "b_modified"), "1")
+	createFile(t, filepath.Join(dirB, "b_modified"), "123456789")
+	createFile(t, filepath.Join(dirB, "c_added"), "12")
+	createFile(t, filepath.Join(dirB, "d_dir", "inner"), "1")
+
+	tests := []struct {
+		flags []string
+		want  []string
+	}{
+		{[]string{"--sort", "name"}, []string{"- a_removed", "~ b_modified", "+ c_added", "+ d_dir/"}},
+		{[]string{"--sort", "size"}, []string{"~ b_modified", "- a_removed", "+ c_added", "+ d_dir/"}},
+		{[]string{"--sort", "status"}, []string{"+ c_added", "+ d_dir/", "- a_removed", "~ b_modified"}},
+		{[]string{"--sort", "type"}, []string{"+ d_dir/", "- a_removed", "~ b_modified", "+ c_added"}},
+		{[]string{"--sort", "name", "--reverse"}, []string{"+ d_dir/", "+ c_added", "~ b_modified", "- a_removed"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.flags, " "), func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.flags...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			got := strings.Split(strings.TrimRight(stdout, "\n"), "\n")
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("unexpected order:\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSymlinkedRoots(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+	inequalDir := filepath.Join(root, "test_inequal")
+
+	links := t.TempDir()
+	linkToMod := filepath.Join(links, "to_modified")
+	linkToBase1 := filepath.Join(links, "to_base1")
+	linkToBase2 := filepath.Join(links, "to_base2")
+	linkIntoSub := filepath.Join(links, "into_subdir")
+	for target, link := range map[string]string{
+		modDir:                              linkToMod,
+		baseDir:                             linkToBase1,
+		linkToBase1:                         linkToBase2, // chained symlink
+		filepath.Join(inequalDir, "subdir"): linkIntoSub,
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		shouldContain []string
+		shouldNotHas  []string
+	}{
+		{
+			name:          "Symlinked Root Pointing Elsewhere",
+			args:          []string{baseDir, linkToMod},
+			expectedError: ErrDiffsFound,
+			shouldContain: []string{"~ file2"},
+			shouldNotHas:  []string{"same path"},
+		},
+		{
+			name:          "Two Symlinks to the Same Target",
+			args:          []string{"--verbose", linkToBase1, linkToBase2},
+			expectedError: nil,
+			shouldContain: []string{"identical (same path: "},
+		},
+		{
+			name:          "Symlinked Root Into the Other Root",
+			args:          []string{"--verbose", linkIntoSub, inequalDir},
+			expectedError: ErrDiffsFound,
+			shouldContain: []string{"- ts2", "+ file1", "+ subdir/"},
+			shouldNotHas:  []string{"same path"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			fullOutput := stdout + stderr
+			for _, want := range tt.shouldContain {
+				if !strings.Contains(fullOutput, want) {
+					t.Errorf("expected output to contain %q, but got:\n%s", want, fullOutput)
+				}
+			}
+			for _, unwanted := range tt.shouldNotHas {
+				if strings.Contains(fullOutput, unwanted) {
+					t.Errorf("expected output NOT to contain %q, but got:\n%s", unwanted, fullOutput)
+				}
+			}
+		})
+	}
+}
+
+func TestProgressToStdout(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantStdout bool
+	}{
+		{"Default to Stderr", nil, false},
+		{"Stdout", []string{"--progress-to-stdout"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color"}, tt.flags...)
+			stdout, stderr, err := runApp(t, append(args, baseDir, modDir)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+
+			inStdout := strings.Contains(stdout, "Comparing files")
+			inStderr := strings.Contains(stderr, "Comparing files")
+			if inStdout != tt.wantStdout || inStderr == tt.wantStdout {
+				t.Errorf("progress on wrong stream, stdout:\n%s\nstderr:\n%s", stdout, stderr)
+			}
+			// the diff listing starts on a fresh line after the progress bar
+			if !strings.Contains(stdout, "~ file2\n") || strings.Contains(stdout, "Comparing files ~") {
+				t.Errorf("diff listing interleaved with progress:\n%s", stdout)
+			}
+		})
+	}
+
+	if _, _, err := runApp(t, "--progress-to-stdout", "--format", "jsonl", baseDir, modDir); exitCode(err) != 2 {
+		t.Errorf("expected runtime error for progress on stdout with jsonl, got: %v", err)
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	stdout, _, err := runApp(t, "--selftest", "--selftest-size", "64KB", "--selftest-files", "4")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"Throughput", "workers=1", "sha256"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("expected output to contain %q, but got:\n%s", want, stdout)
+		}
+	}
+}
+
+func TestPathsFrom(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	inequalDir := filepath.Join(root, "test_inequal")
+
+	listFile := filepath.Join(t.TempDir(), "paths.txt")
+	createFile(t, listFile, "file1\n\nfile4\n./file1\nmissing\n")
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--paths-from", listFile, baseDir, inequalDir)
+	if !errors.Is(err, ErrASubsetB) {
+		t.Errorf("expected error %v, got: %v", ErrASubsetB, err)
+	}
+	if stdout != "+ file4\n" {
+		t.Errorf("expected only the listed added file, but got:\n%s", stdout)
+	}
+
+	stdout, _, err = runAppWithInput(t, strings.NewReader("file2\nsubdir/ts2\n"), "--no-color", "--silent", "--paths-from", "-", baseDir, inequalDir)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if stdout != "- file2\n+ subdir/ts2\n" {
+		t.Errorf("expected only the listed paths from stdin, but got:\n%s", stdout)
+	}
+
+	if _, _, err := runAppWithInput(t, strings.NewReader("../escape\n"), "--paths-from", "-", baseDir, inequalDir); exitCode(err) != 2 {
+		t.Errorf("expected runtime error for escaping path, got: %v", err)
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	// the roots don't exist, so any attempt to open the files would fail
+	nodeA := &LocalNode{root: filepath.Join(t.TempDir(), "missing_A")}
+	nodeB := &LocalNode{root: filepath.Join(t.TempDir(), "missing_B")}
+
+	same, err := compareFileContent(nodeA, nodeB, "empty", 0, 0, 0, CompareOptions{SparseAware: true})
+	if err != nil || !same {
+		t.Errorf("expected empty files to be equal without opening them, got same=%v err=%v", same, err)
+	}
+	if _, err := compareFileContent(nodeA, nodeB, "empty", 0, 1, 0, CompareOptions{Norm: TextNorm{EOL: true}}); err == nil {
+		t.Error("expected an error when only one file is empty and must be read")
+	}
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "empty"), "")
+	createFile(t, filepath.Join(dirB, "empty"), "")
+	if _, _, err := runApp(t, "--silent", dirA, dirB); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	equalDir := filepath.Join(root, "test_equal")
+	modDir := filepath.Join(root, "test_modified")
+
+	fingerprints := func(t *testing.T, dirA, dirB string) (string, string, string) {
+		stdout, _, _ := runApp(t, "--no-color", "--silent", "--fingerprint", dirA, dirB)
+
+		var fpA, fpB, verdict string
+		for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+			switch {
+			case strings.HasPrefix(line, "A: "):
+				fpA = strings.TrimPrefix(line, "A: ")
+			case strings.HasPrefix(line, "B: "):
+				fpB = strings.TrimPrefix(line, "B: ")
+			case strings.HasPrefix(line, "Fingerprints "):
+				verdict = line
+			}
+		}
+		if len(fpA) != 64 || len(fpB) != 64 {
+			t.Fatalf("expected two fingerprints, but got:\n%s", stdout)
+		}
+		return fpA, fpB, verdict
+	}
+
+	fpA, fpB, verdict := fingerprints(t, baseDir, equalDir)
+	if fpA != fpB || verdict != "Fingerprints match." {
+		t.Errorf("expected equal fingerprints for identical trees, got %s / %s (%s)", fpA, fpB, verdict)
+	}
+	fpA2, fpB2, verdict := fingerprints(t, baseDir, modDir)
+	if fpA2 != fpA || fpB2 == fpA || verdict != "Fingerprints differ." {
+		t.Errorf("expected a different fingerprint for the modified tree, got %s / %s (%s)", fpA2, fpB2, verdict)
+	}
+
+	stdout, _, _ := runApp(t, "--silent", "--format", "jsonl", "--fingerprint", baseDir, modDir)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	var record jsonFingerprint
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil || record.Type != "fingerprint" {
+		t.Fatalf("expected a fingerprint record, got %q: %v", lines[len(lines)-1], err)
+	}
+	if record.A != fpA2 || record.B != fpB2 || record.Match {
+		t.Errorf("expected the fingerprints %s / %s not to match, got %+v", fpA2, fpB2, record)
+	}
+
+	if stdout, _, _ := runApp(t, "--quiet", "--fingerprint", baseDir, modDir); stdout != "" {
+		t.Errorf("expected no output with --quiet, got %q", stdout)
+	}
+}
+
+func TestFingerprintReusesSums(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "file"), "content")
+	createFile(t, filepath.Join(dirB, "file"), "content")
+	nodeA := &countingNode{DirNode: &LocalNode{root: dirA}}
+	nodeB := &countingNode{DirNode: &LocalNode{root: dirB}}
+	files := map[string]FileMeta{"file": {Size: 7}}
+	noLimit := func(string) int64 { return 0 }
+
+	cache := newSHACache()
+	if same, err := compareSHA(nodeA, nodeB, "file", 0, CompareOptions{Sums: cache}); err != nil || !same {
+		t.Fatalf("expected equal files, got same=%v err=%v", same, err)
+	}
+	fp, err := fingerprint(nodeA, files, nil, noLimit, false, 1, cache)
+	if err != nil {
+		t.Fatalf("fingerprint failed: %v", err)
+	}
+	if nodeA.reads != 1 {
+		t.Errorf("expected the fingerprint to reuse the sum of the comparison, got %d reads", nodeA.reads)
+	}
+	if uncached, _ := fingerprint(nodeB, files, nil, noLimit, false, 1, nil); uncached != fp {
+		t.Errorf("expected the cached fingerprint %s, got %s", fp, uncached)
+	}
+}
+
+func TestQuietIfSubset(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	subsetDir := filepath.Join(root, "test_subset")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		expectedOut   string
+	}{
+		{"A Subset Of B", []string{subsetDir, baseDir}, ErrASubsetB, ""},
+		{"B Subset Of A", []string{baseDir, subsetDir}, ErrBSubsetA, ""},
+		{"Divergent", []string{baseDir, modDir}, ErrDiffsFound, "~ file2\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent", "--quiet-if-subset"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if stdout != tt.expectedOut {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+		})
+	}
+}
+
+func TestCheckPatterns(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		expectError   bool
+		expectedLines []string
+	}{
+		{"All Valid", []string{"-i", "*.go", "-e", "vendor/**", "--fast", "*.{iso,img}"}, false, nil},
+		{"Mixed", []string{"-i", "*.go", "-i", "[abc", "-e", "ok", "--fast", "[z-a]"}, true, []string{
+			`--include[1]: invalid pattern "[abc": unexpected end of input (at position 0: '[')`,
+			`--fast[0]: invalid pattern "[z-a]": hi character 'a' should be greater than lo 'z' (at position 1: 'z')`,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--check-patterns"}, tt.args...)...)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error %v, got: %v", tt.expectError, err)
+			}
+			var lines []string
+			if out := strings.TrimSpace(stdout); out != "" {
+				lines = strings.Split(out, "\n")
+			}
+			if !slices.Equal(lines, tt.expectedLines) {
+				t.Errorf("expected diagnostics %q, but got %q", tt.expectedLines, lines)
+			}
+		})
+	}
+}
+
+func TestMirror(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "same"), "same")
+	createFile(t, filepath.Join(dirA, "changed"), "old")
+	createFile(t, filepath.Join(dirB, "same"), "same")
+	createFile(t, filepath.Join(dirB, "changed"), "new")
+	createFile(t, filepath.Join(dirB, "extra"), "extra")
+	createFile(t, filepath.Join(dirB, "extradir", "file"), "extra")
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		expectedOut   string
+	}{
+		{"Extra And Modified", []string{dirA, dirB}, ErrDiffsFound, "~ changed\n"},
+		{"Extra Only", []string{"--exclude", "changed", dirA, dirB}, nil, ""},
+		{"Missing In B", []string{dirB, dirA}, ErrDiffsFound, "- extra\n- extradir/\n~ changed\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent", "--mirror", "--sort", "status"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if stdout != tt.expectedOut {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+		})
+	}
+}
+
+func TestSharedRemoteConnection(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake remote shell requires a POSIX shell")
+	}
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	// wrap the fake rsh to count its invocations
+	rsh := createFakeRsh(t)
+	countFile := filepath.Join(t.TempDir(), "count")
+	script := filepath.Join(t.TempDir(), "counting-rsh")
+	content := fmt.Sprintf("#!/bin/sh\necho \"$1\" >> '%s'\nexec '%s' \"$@\"\n", countFile, rsh)
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatalf("failed to create counting rsh: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		pathA, pathB  string
+		expectedHosts string
+	}{
+		{"Same Host", "fakehost:" + baseDir, "fakehost:" + modDir, "fakehost\n"},
+		{"Different Hosts", "fakehost:" + baseDir, "otherhost:" + modDir, "fakehost\notherhost\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(countFile)
+			stdout, _, err := runApp(t, "--no-color", "--silent", "--rsh", script, tt.pathA, tt.pathB)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != "~ file2\n" {
+				t.Errorf("expected output %q, but got %q", "~ file2\n", stdout)
+			}
+			hosts, _ := os.ReadFile(countFile)
+			if string(hosts) != tt.expectedHosts {
+				t.Errorf("expected remote shells for %q, but got %q", tt.expectedHosts, hosts)
+			}
+		})
+	}
+}
+
+func TestTwoRemotes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake remote shell requires a POSIX shell")
+	}
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	equalDir := filepath.Join(root, "test_equal")
+	inequalDir := filepath.Join(root, "test_inequal")
+	modDir := filepath.Join(root, "test_modified")
+	rsh := createFakeRsh(t)
+
+	tests := []struct {
+		name           string
+		pathA, pathB   string
+		expectedErr    error
+		expectedOutput string
+	}{
+		{"Equal", "hostA:" + baseDir, "hostB:" + equalDir, nil, ""},
+		{"Modified", "hostA:" + baseDir, "hostB:" + modDir, ErrDiffsFound, "~ file2\n"},
+		{"Added And Removed", "hostA:" + baseDir, "hostB:" + inequalDir, ErrDiffsFound, "- file2\n+ file4\n+ file5\n+ subdir/\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, "--no-color", "--silent", "--rsh", rsh, tt.pathA, tt.pathB)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected error %v, got: %v", tt.expectedErr, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, but got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+
+	// a file vanishing on B after the scan fails on B's agent, which is named in the error
+	beforeCompareHook = func() {
+		os.Remove(filepath.Join(equalDir, "file2"))
+	}
+	defer func() { beforeCompareHook = nil }()
+
+	logFile := filepath.Join(t.TempDir(), "dirdiff.log")
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--log-level", "debug", "--log-file", logFile, "--rsh", rsh, "hostA:"+baseDir, "hostB:"+equalDir)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if stdout != "! file2\n" {
+		t.Errorf("expected output %q, but got %q", "! file2\n", stdout)
+	}
+	logs, _ := os.ReadFile(logFile)
+	if !strings.Contains(string(logs), "error=\"hostB: ") {
+		t.Errorf("expected the compare error to name hostB, got log:\n%s", logs)
+	}
+}
+
+func TestByteWeightedProgress(t *testing.T) {
+	filesA := map[string]FileMeta{"big": {Size: 10000}, "small1": {Size: 10}, "small2": {Size: 10}, "empty": {}}
+	filesB := map[string]FileMeta{"big": {Size: 10000}, "small1": {Size: 20}, "small2": {Size: 10}, "empty": {}}
+
+	weights, total, byBytes := progressWeights([]string{"big", "small1", "small2", "empty"}, filesA, filesB)
+	if !byBytes || total != 10030 {
+		t.Errorf("expected a byte total of 10030, got %d (bytes=%v)", total, byBytes)
+	}
+	if weights["big"] != 10000 || weights["small1"] != 20 || weights["empty"] != 0 {
+		t.Errorf("expected files weighted by their larger size, got %v", weights)
+	}
+
+	weights, total, byBytes = progressWeights([]string{"empty"}, filesA, filesB)
+	if byBytes || total != 1 || weights["empty"] != 1 {
+		t.Errorf("expected a file count fallback without sizes, got %v total %d (bytes=%v)", weights, total, byBytes)
+	}
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "big"), strings.Repeat("x", 10000))
+		createFile(t, filepath.Join(dir, "small"), "small")
+	}
+	_, stderr, err := runApp(t, "--no-color", dirA, dirB)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !strings.Contains(stderr, "B/s)") || strings.Contains(stderr, "it/s") {
+		t.Errorf("expected the progress bar to count bytes, got:\n%s", stderr)
+	}
+}
+
+func TestDereferenceRoot(t *testing.T) {
+	realA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(realA, "data"), "payload")
+	createFile(t, filepath.Join(dirB, "data"), "payload")
+	createFile(t, filepath.Join(dirB, "link"), "payload")
+	linkA := filepath.Join(t.TempDir(), "latest")
+	if err := os.Symlink("data", filepath.Join(realA, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(realA, linkA); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+		expectedOut  string
+	}{
+		{"Deref Root, Interior Unfollowed", []string{linkA, dirB}, 1, "~ link\n"},
+		{"Deref Root, Interior Followed", []string{"--follow-symlinks", linkA, dirB}, 0, ""},
+		{"No Deref, Symlinked Root", []string{"--dereference-root=false", linkA, dirB}, 2, ""},
+		{"No Deref, Symlinked Root, Interior Followed", []string{"--dereference-root=false", "--follow-symlinks", linkA, dirB}, 2, ""},
+		{"No Deref, Real Root, Interior Unfollowed", []string{"--dereference-root=false", realA, dirB}, 1, "~ link\n"},
+		{"No Deref, Real Root, Interior Followed", []string{"--dereference-root=false", "--follow-symlinks", realA, dirB}, 0, ""},
+		{"No Deref, Same Symlinked Root", []string{"--dereference-root=false", linkA, linkA}, 2, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if code := exitCode(err); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+			}
+			if stdout != tt.expectedOut {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+		})
+	}
+}
+
+func TestExcludeVCS(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "main.go"), "package main")
+	createFile(t, filepath.Join(dirB, "main.go"), "package main")
+	createFile(t, filepath.Join(dirB, ".git", "HEAD"), "ref: refs/heads/main")
+	createFile(t, filepath.Join(dirB, "vendor", "lib", ".hg", "store"), "data")
+	createFile(t, filepath.Join(dirB, "repo.git"), "not a vcs dir")
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		expectedOut   string
+	}{
+		{"Without Flag", []string{dirA, dirB}, ErrASubsetB, "+ .git/\n+ .git/HEAD\n+ repo.git\n+ vendor/\n+ vendor/lib/\n+ vendor/lib/.hg/\n+ vendor/lib/.hg/store\n"},
+		{"With Flag", []string{"--exclude-vcs", dirA, dirB}, ErrASubsetB, "+ repo.git\n+ vendor/\n+ vendor/lib/\n"},
+		{"With Flag And Excludes", []string{"--exclude-vcs", "--exclude", "repo.git", "--exclude", "vendor", dirA, dirB}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent", "--show-all"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if stdout != tt.expectedOut {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+		})
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name         string
+		workers      string
+		expectedCode int
+		expectedOut  string
+	}{
+		{"Zero", "0", 2, ""},
+		{"Negative", "-4", 2, ""},
+		{"One", "1", 1, "~ file2\n"},
+		{"Huge", "100000", 1, "~ file2\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout string
+			done := make(chan error, 1)
+			go func() {
+				var err error
+				stdout, _, err = runApp(t, "--no-color", "--silent", "--workers", tt.workers, baseDir, modDir)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if code := exitCode(err); code != tt.expectedCode {
+					t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("comparison hung")
+			}
+			if stdout != tt.expectedOut {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+		})
+	}
+
+	for _, tc := range []struct{ requested, jobs, expected int }{{8, 2, 2}, {2, 100, 2}, {8, 0, 1}} {
+		if got := effectiveWorkers(tc.requested, tc.jobs); got != tc.expected {
+			t.Errorf("effectiveWorkers(%d, %d) = %d, want %d", tc.requested, tc.jobs, got, tc.expected)
+		}
+	}
+}
+
+func TestNullOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names with newlines are not supported")
+	}
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "same"), "same")
+	createFile(t, filepath.Join(dirB, "same"), "same")
+	createFile(t, filepath.Join(dirA, "two\nlines"), "old")
+	createFile(t, filepath.Join(dirB, "two\nlines"), "new")
+	createFile(t, filepath.Join(dirB, "with space"), "added")
+	createFile(t, filepath.Join(dirB, "newdir", "file"), "added")
+
+	stdout, _, err := runApp(t, expandNullFlag([]string{"--silent", "-0", dirA, dirB})...)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	expected := "+ newdir/\x00~ two\nlines\x00+ with space\x00"
+	if stdout != expected {
+		t.Errorf("expected NUL-terminated output %q, but got %q", expected, stdout)
+	}
+
+	if _, _, err := runApp(t, "--null", "--tree", dirA, dirB); exitCode(err) != 2 {
+		t.Errorf("expected runtime error for --null with --tree, got: %v", err)
+	}
+
+	if got := expandNullFlag([]string{"dirdiff", "-0", "--", "-0"}); !slices.Equal(got, []string{"dirdiff", "--null", "--", "-0"}) {
+		t.Errorf("expected -0 to be expanded only before --, got %q", got)
+	}
+}
+
+func TestGitRefs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	t.Chdir(repo)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	git("init", "-q")
+	createFile(t, filepath.Join(repo, "changed.txt"), "one\n")
+	createFile(t, filepath.Join(repo, "sub", "same.txt"), "same\n")
+	if err := os.Symlink("changed.txt", filepath.Join(repo, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	git("add", "-A")
+	git("commit", "-q", "-m", "first")
+	createFile(t, filepath.Join(repo, "changed.txt"), "two\n")
+	git("commit", "-q", "-am", "second")
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+		expectedOut  string
+	}{
+		{"Two Commits", []string{"git:HEAD~1", "git:HEAD"}, 1, "~ changed.txt\n"},
+		{"Same Commit", []string{"git:HEAD", "git:HEAD"}, 0, ""},
+		{"Commit Against Worktree", []string{"--exclude-vcs", "git:HEAD", "."}, 0, ""},
+		{"Old Commit Against Worktree", []string{"--exclude-vcs", "git:HEAD~1", "."}, 1, "~ changed.txt\n"},
+		{"Excluded Dir", []string{"--exclude", "sub", "--exclude-vcs", "git:HEAD", "."}, 0, ""},
+		{"Included Dir", []string{"--include-dir", "sub", "git:HEAD~1", "git:HEAD"}, 0, ""},
+		{"Excluded Dir Only", []string{"--exclude-dir", "sub", "--exclude-vcs", "git:HEAD~1", "."}, 1, "~ changed.txt\n"},
+		{"Case Folded Commits", []string{"--ignore-case-in-names", "git:HEAD~1", "git:HEAD"}, 1, "~ changed.txt\n"},
+		{"Invalid Ref", []string{"git:no-such-ref", "git:HEAD"}, 2, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if code := exitCode(err); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+			}
+			if stdout != tt.expectedOut {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+		})
+	}
+}
+
+func TestGitSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	t.Chdir(repo)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	// submodules are recorded as gitlinks without cloning anything
+	git("init", "-q")
+	git("update-index", "--add", "--cacheinfo", "160000,"+strings.Repeat("1", 40)+",lib")
+	git("update-index", "--add", "--cacheinfo", "160000,"+strings.Repeat("2", 40)+",vendor")
+	git("commit", "-q", "-m", "first")
+	git("update-index", "--cacheinfo", "160000,"+strings.Repeat("3", 40)+",lib")
+	git("commit", "-q", "-m", "second")
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "git:HEAD~1", "git:HEAD")
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if stdout != "~ lib\n" {
+		t.Errorf("expected the moved submodule to be modified without --special-files, got %q", stdout)
+	}
+	if _, _, err := runApp(t, "--silent", "git:HEAD", "git:HEAD"); err != nil {
+		t.Errorf("expected the same submodule commits to be identical, got: %v", err)
+	}
+}
+
+func TestFailOn(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	inequalDir := filepath.Join(root, "test_inequal")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name         string
+		failOn       []string
+		pathB        string
+		expectedCode int
+	}{
+		{"Default", nil, inequalDir, 1},
+		{"Modified Only Without Modifications", []string{"modified"}, inequalDir, 0},
+		{"Modified Only With Modifications", []string{"modified"}, modDir, 1},
+		{"Added Only", []string{"added"}, inequalDir, 3},
+		{"Removed Only", []string{"removed"}, inequalDir, 4},
+		{"Comma List", []string{"added,removed"}, inequalDir, 1},
+		{"Repeated Flag", []string{"modified", "removed"}, inequalDir, 4},
+		{"Invalid", []string{"renamed"}, inequalDir, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"--no-color", "--silent"}
+			for _, f := range tt.failOn {
+				args = append(args, "--fail-on", f)
+			}
+			stdout, _, err := runApp(t, append(args, baseDir, tt.pathB)...)
+			if code := exitCode(err); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+			}
+			// the listing is independent of --fail-on
+			if tt.expectedCode != 2 && stdout == "" {
+				t.Error("expected the differences to be reported")
+			}
+		})
+	}
+}
+
+// countingNode counts the content reads of a DirNode.
+type countingNode struct {
+	DirNode
+	mu    sync.Mutex
+	reads int
+}
+
+func (n *countingNode) GetMD5(relPath string, followSym bool) (string, bool, error) {
+	n.mu.Lock()
+	n.reads++
+	n.mu.Unlock()
+	return n.DirNode.GetMD5(relPath, followSym)
+}
+
+func (n *countingNode) GetSHA(relPath string, limit int64, followSym bool, norm TextNorm) (string, error) {
+	n.mu.Lock()
+	n.reads++
+	n.mu.Unlock()
+	return n.DirNode.GetSHA(relPath, limit, followSym, norm)
+}
+
+func TestCompareUsesScannedSizes(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "file"), "short")
+	createFile(t, filepath.Join(dirB, "file"), "longer content")
+
+	nodeA := &countingNode{DirNode: &LocalNode{root: dirA}}
+	nodeB := &countingNode{DirNode: &LocalNode{root: dirB}}
+
+	// the scanned sizes differ, so the files are never opened
+	same, err := compareFileContent(nodeA, nodeB, "file", 5, 14, 0, CompareOptions{})
+	if err != nil || same {
+		t.Errorf("expected different sizes to be unequal, got same=%v err=%v", same, err)
+	}
+	if nodeA.reads != 0 || nodeB.reads != 0 {
+		t.Errorf("expected no reads for different sizes, got %d and %d", nodeA.reads, nodeB.reads)
+	}
+
+	// equal scanned sizes fall through to hashing
+	createFile(t, filepath.Join(dirB, "file"), "SHORT")
+	same, err = compareFileContent(nodeA, nodeB, "file", 5, 5, 0, CompareOptions{})
+	if err != nil || same {
+		t.Errorf("expected different content to be unequal, got same=%v err=%v", same, err)
+	}
+	if nodeA.reads == 0 || nodeB.reads == 0 {
+		t.Errorf("expected both files to be read for equal sizes, got %d and %d", nodeA.reads, nodeB.reads)
+	}
+}
+
+func TestColorMode(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name     string
+		flags    []string
+		wantANSI bool
+	}{
+		{"Always", []string{"--color", "always"}, true},
+		{"Auto With Buffer", []string{"--color", "auto"}, false},
+		{"Default Is Auto", nil, false},
+		{"Never", []string{"--color", "never"}, false},
+		{"No Color Overrides Always", []string{"--color", "always", "--no-color"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--silent"}, tt.flags...)
+			stdout, _, err := runApp(t, append(args, baseDir, modDir)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Fatalf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if hasANSI := strings.Contains(stdout, "\x1b["); hasANSI != tt.wantANSI {
+				t.Errorf("expected ANSI codes %v, got output %q", tt.wantANSI, stdout)
+			}
+		})
+	}
+
+	if _, _, err := runApp(t, "--color", "sometimes", baseDir, modDir); exitCode(err) != 2 {
+		t.Errorf("expected runtime error for an invalid --color, got: %v", err)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "top"), "same")
+	createFile(t, filepath.Join(dirB, "top"), "same")
+	createFile(t, filepath.Join(dirA, "docs", "readme"), "old")
+	createFile(t, filepath.Join(dirB, "docs", "readme"), "new")
+	createFile(t, filepath.Join(dirA, "docs", "same"), "same")
+	createFile(t, filepath.Join(dirB, "docs", "same"), "same")
+	createFile(t, filepath.Join(dirB, "assets", "logo"), "added")
+	createFile(t, filepath.Join(dirA, "old", "file"), "removed")
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--rollup", dirA, dirB)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	expected := "+ assets/\n~ docs/readme\n- old/\n" +
+		"modified\t./\tadded=1 removed=1 modified=1\n" +
+		"added\tassets/\tadded=0 removed=0 modified=0\n" +
+		"modified\tdocs/\tadded=0 removed=0 modified=1\n" +
+		"removed\told/\tadded=0 removed=0 modified=0\n"
+	if stdout != expected {
+		t.Errorf("expected output %q, but got %q", expected, stdout)
+	}
+
+	rollups := buildRollups([]DiffItem{{Path: "a/b/c", Type: Modified}}, strings.Compare)
+	if len(rollups) != 3 || rollups[1].Path != "a" || rollups[1].Status != "modified" || rollups[2].Path != "a/b" || rollups[2].Modified != 1 {
+		t.Errorf("expected nested directories to roll up to modified, got %+v", rollups)
+	}
+	if rollups := buildRollups(nil, strings.Compare); len(rollups) != 1 || rollups[0].Status != "identical" {
+		t.Errorf("expected an identical root without diffs, got %+v", rollups)
+	}
+}
+
+// blockingNode blocks every content read of a file until unblocked.
+type blockingNode struct {
+	DirNode
+	path    string
+	unblock chan struct{}
+}
+
+func (n *blockingNode) GetMD5(relPath string, followSym bool) (string, bool, error) {
+	if relPath == n.path {
+		<-n.unblock
+	}
+	return n.DirNode.GetMD5(relPath, followSym)
+}
+
+func TestFileTimeout(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "stuck"), "content")
+		createFile(t, filepath.Join(dir, "fine"), "content")
+	}
+	nodeA := &blockingNode{DirNode: &LocalNode{root: dirA}, path: "stuck", unblock: make(chan struct{})}
+	defer close(nodeA.unblock)
+	nodeB := &LocalNode{root: dirB}
+
+	compare := func(relPath string) (bool, error) {
+		return compareWithTimeout(context.Background(), 50*time.Millisecond, func() (bool, error) {
+			return compareFileContent(nodeA, nodeB, relPath, 7, 7, 0, CompareOptions{})
+		})
+	}
+
+	start := time.Now()
+	if _, err := compare("stuck"); !errors.Is(err, ErrFileTimeout) {
+		t.Errorf("expected %v for the stuck file, got: %v", ErrFileTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the timeout to return promptly, took %v", elapsed)
+	}
+	// the run proceeds with the next file
+	if same, err := compare("fine"); err != nil || !same {
+		t.Errorf("expected the next file to compare equal, got same=%v err=%v", same, err)
+	}
+
+	if _, _, err := runApp(t, "--silent", "--file-timeout", "10s", dirA, dirB); err != nil {
+		t.Errorf("expected no error with a generous timeout, got: %v", err)
+	}
+	if _, _, err := runApp(t, "--file-timeout", "-1s", dirA, dirB); exitCode(err) != 2 {
+		t.Errorf("expected runtime error for a negative timeout, got: %v", err)
+	}
+}
+
+func TestDirPatterns(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "cache", "data"), "old")
+	createFile(t, filepath.Join(dirB, "cache", "data"), "new")
+	createFile(t, filepath.Join(dirA, "sub", "cache"), "old")
+	createFile(t, filepath.Join(dirB, "sub", "cache"), "new")
+	createFile(t, filepath.Join(dirA, "top"), "old")
+	createFile(t, filepath.Join(dirB, "top"), "new")
+
+	tests := []struct {
+		name        string
+		args        []string
+		expectedOut string
+	}{
+		{"No Patterns", nil, "~ cache/data\n~ sub/cache\n~ top\n"},
+		{"Exclude Matches Files And Dirs", []string{"--exclude", "*cache"}, "~ top\n"},
+		{"Exclude Dir Keeps Files", []string{"--exclude-dir", "*cache"}, "~ sub/cache\n~ top\n"},
+		{"Include Dir", []string{"--include-dir", "sub"}, "~ sub/cache\n"},
+		{"Include Dir Ignores Files", []string{"--include-dir", "*cache"}, "~ cache/data\n"},
+		{"Include And Exclude Dir", []string{"--include-dir", "*", "--exclude-dir", "cache"}, "~ sub/cache\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append(append([]string{"--no-color", "--silent"}, tt.args...), dirA, dirB)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != tt.expectedOut {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+		})
+	}
+}
+
+func TestResumeFromState(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+	statePath := filepath.Join(t.TempDir(), "dirdiff.state")
+
+	scan := func(dir string) map[string]FileMeta {
+		files, _, _, err := coreScan(context.Background(), dir, ScanOptions{})
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		return files
+	}
+	filesA, filesB := scan(baseDir), scan(modDir)
+
+	// an interrupted run which compared file1, recorded with a fake change to prove it's reused,
+	// and file2 with outdated metadata, which must be compared again
+	state, err := openState(statePath, baseDir, modDir, nil)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	state.Record("file1", filesA["file1"], filesB["file1"], []ChangeType{XattrChanged})
+	stale := filesB["file2"]
+	stale.ModTime--
+	state.Record("file2", filesA["file2"], stale, nil)
+	if err := state.Close(false); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--state", statePath, baseDir, modDir)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if stdout != "@ file1\n~ file2\n" {
+		t.Errorf("expected the recorded file1 and the recompared file2, but got %q", stdout)
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the state file to be removed after completion, got: %v", err)
+	}
+
+	// a state of other directories is ignored
+	if state, err = openState(statePath, baseDir, "elsewhere", nil); err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	state.Record("file2", filesA["file2"], filesB["file2"], nil)
+	state.Close(false)
+	stdout, _, _ = runApp(t, "--no-color", "--silent", "--state", statePath, baseDir, modDir)
+	if stdout != "~ file2\n" {
+		t.Errorf("expected a state of other directories to be ignored, but got %q", stdout)
+	}
+
+	// a state of the same directories compared with other options is refused
+	if state, err = openState(statePath, baseDir, modDir, map[string]string{"ignore-eol": "true"}); err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	state.Close(false)
+	_, _, err = runApp(t, "--silent", "--state", statePath, "--strong", baseDir, modDir)
+	if exitCode(err) != 2 || !strings.Contains(fmt.Sprint(err), "--strong, --ignore-eol") {
+		t.Errorf("expected a runtime error naming the changed options, got: %v", err)
+	}
+	if _, _, err = runApp(t, "--silent", "--state", statePath, "--ignore-eol", baseDir, modDir); !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected the state to be resumed with the same options, got: %v", err)
+	}
+
+	// a failed write is reported when closing
+	if state, err = openState(statePath, baseDir, modDir, nil); err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	state.f.Close()
+	state.Record("file2", filesA["file2"], filesB["file2"], nil)
+	if err := state.Close(false); err == nil || !strings.Contains(err.Error(), "failed to write state file") {
+		t.Errorf("expected the failed write to be reported, got: %v", err)
+	}
+
+	// several recorded changes of a single file are all reported again
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "file"), "old")
+	createFile(t, filepath.Join(dirB, "file"), "new")
+	if state, err = openState(statePath, dirA, dirB, nil); err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	state.Record("file", scan(dirA)["file"], scan(dirB)["file"], []ChangeType{Modified, XattrChanged})
+	state.Close(false)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stdout, _, err = runApp(t, "--no-color", "--silent", "--state", statePath, dirA, dirB)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the resumed run to finish")
+	}
+	if !errors.Is(err, ErrDiffsFound) || stdout != "~ file\n@ file\n" {
+		t.Errorf("expected both recorded changes, got %q: %v", stdout, err)
+	}
+}
+
+func TestInaccessiblePaths(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "file"), "content")
+	}
+	// a dangling symlink can't be followed, even by root
+	if err := os.Symlink("missing", filepath.Join(dirA, "dangling")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	run := func(args ...string) (string, error) {
+		_, stderr, err := runApp(t, append([]string{"--no-color", "--silent", "-L"}, args...)...)
+		return stderr, err
+	}
+
+	stderr, err := run(dirA, dirB)
+	if err != nil {
+		t.Errorf("expected identical directories, got: %v", err)
+	}
+	if stderr != "1 paths were inaccessible\n" {
+		t.Errorf("expected the inaccessible path to be counted, got %q", stderr)
+	}
+
+	stderr, _ = run("--verbose", dirA, dirB)
+	if !strings.Contains(stderr, "  A: dangling (") {
+		t.Errorf("expected the inaccessible path to be listed under --verbose, got %q", stderr)
+	}
+
+	_, err = run("--strict", dirA, dirB)
+	if !errors.Is(err, ErrInaccessible) || exitCode(err) != 2 {
+		t.Errorf("expected %v with exit code 2 under --strict, got: %v", ErrInaccessible, err)
+	}
+
+	// the verdict is kept alongside the inaccessible paths
+	createFile(t, filepath.Join(dirB, "added"), "content")
+	_, err = run("--strict", dirA, dirB)
+	if !errors.Is(err, ErrInaccessible) || !errors.Is(err, ErrASubsetB) || exitCode(err) != 2 {
+		t.Errorf("expected %v and %v with exit code 2 under --strict, got: %v", ErrInaccessible, ErrASubsetB, err)
+	}
+	os.Remove(filepath.Join(dirB, "added"))
+
+	// an unreadable subdirectory, unless the user may read it anyway (e.g. root)
+	locked := filepath.Join(dirB, "locked")
+	createFile(t, filepath.Join(locked, "secret"), "content")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatalf("chmod failed: %v", err)
+	}
+	defer os.Chmod(locked, 0755)
+	if _, err := os.ReadDir(locked); err == nil {
+		t.Skip("unreadable directories can still be read")
+	}
+	_, _, issues, _ := coreScan(context.Background(), dirB, ScanOptions{})
+	if len(issues) != 1 || issues[0].Path != "locked" || !issues[0].Dir {
+		t.Errorf("expected the locked directory as only issue, got %v", issues)
+	}
+}
+
+func TestInaccessibleDirectory(t *testing.T) {
+	files := func(paths ...string) map[string]FileMeta {
+		m := make(map[string]FileMeta)
+		for _, p := range paths {
+			m[p] = FileMeta{}
+		}
+		return m
+	}
+	filesA, dirsA := files("file"), files("locked")
+	filesB, dirsB := files("file", "locked/secret", "locked/sub/deep", "lockedness"), files("locked", "locked/sub")
+	excludeInaccessible(filesA, dirsA, filesB, dirsB, []ScanIssue{{Path: "locked", Dir: true}, {Path: "file", Err: "unreadable"}})
+	if !maps.Equal(filesB, files("file", "lockedness")) || !maps.Equal(dirsB, files("locked")) {
+		t.Errorf("expected the contents of the locked directory to be excluded, got %v and %v", filesB, dirsB)
+	}
+
+	// an unreadable directory on one side, unless the user may read it anyway (e.g. root)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "file"), "content")
+		createFile(t, filepath.Join(dir, "locked", "secret"), "content")
+	}
+	createFile(t, filepath.Join(dirB, "locked", "other"), "content")
+	locked := filepath.Join(dirA, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatalf("chmod failed: %v", err)
+	}
+	defer os.Chmod(locked, 0755)
+	if _, err := os.ReadDir(locked); err == nil {
+		t.Skip("unreadable directories can still be read")
+	}
+
+	stdout, stderr, err := runApp(t, "--no-color", "--silent", "--verbose", dirA, dirB)
+	if err != nil {
+		t.Errorf("expected no differences outside the locked directory, got: %v", err)
+	}
+	if strings.Contains(stdout, "locked/") {
+		t.Errorf("expected the contents of the locked directory not to be listed, got %q", stdout)
+	}
+	if !strings.Contains(stderr, "  A: locked (") {
+		t.Errorf("expected the locked directory to be reported as inaccessible, got %q", stderr)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	dirA, dirB, dirC := t.TempDir(), t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "src", "app", "main.go"), "package main")
+	createFile(t, filepath.Join(dirA, "src", "app", "sub", "util.go"), "package sub")
+	createFile(t, filepath.Join(dirB, "app", "main.go"), "package main")
+	createFile(t, filepath.Join(dirB, "app", "sub", "util.go"), "package sub")
+	createFile(t, filepath.Join(dirC, "app", "main.go"), "package other")
+	createFile(t, filepath.Join(dirC, "app", "sub", "util.go"), "package sub")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedCode   int
+	}{
+		{"Shifted Trees Differ", []string{dirA, dirB}, "+ app/\n- src/\n", 1},
+		{"Stripped Prefix Aligns", []string{"--strip-prefix-a", "src", dirA, dirB}, "", 0},
+		{"Trailing Slash", []string{"--strip-prefix-b", "src/", dirB, dirA}, "", 0},
+		{"Content Read by Original Path", []string{"--strip-prefix-a", "src", dirA, dirC}, "~ app/main.go\n", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if exitCode(err) != tt.expectedCode {
+				t.Errorf("expected exit code %d, got: %v", tt.expectedCode, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+
+	t.Run("Collision", func(t *testing.T) {
+		createFile(t, filepath.Join(dirA, "app", "main.go"), "package main")
+		_, _, err := runApp(t, "--silent", "--strip-prefix-a", "src", dirA, dirB)
+		if exitCode(err) != 2 || !strings.Contains(err.Error(), "collides") {
+			t.Errorf("expected a collision error, got: %v", err)
+		}
+	})
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestBytewise(t *testing.T) {
+	const size = 16 << 20
+	dataA := make([]byte, size)
+	dataB := make([]byte, size)
+	dataB[512] = 1
+
+	rA := &countingReader{r: bytes.NewReader(dataA)}
+	rB := &countingReader{r: bytes.NewReader(dataB)}
+	same, err := compareReaders(rA, rB)
+	if err != nil || same {
+		t.Fatalf("expected a difference, got same=%v err=%v", same, err)
+	}
+	if rA.n > BYTEWISE_BLOCK || rB.n > BYTEWISE_BLOCK {
+		t.Errorf("expected to stop after the first block, but read %d and %d bytes", rA.n, rB.n)
+	}
+	if same, err := compareReaders(bytes.NewReader(dataA), bytes.NewReader(dataA)); err != nil || !same {
+		t.Errorf("expected equal content, got same=%v err=%v", same, err)
+	}
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for name, content := range map[string][]byte{"equal": dataA, "early": dataA, "tail": dataA} {
+		createFile(t, filepath.Join(dirA, name), string(content))
+	}
+	tail := bytes.Clone(dataA)
+	tail[size-1] = 1
+	createFile(t, filepath.Join(dirB, "equal"), string(dataA))
+	createFile(t, filepath.Join(dirB, "early"), string(dataB))
+	createFile(t, filepath.Join(dirB, "tail"), string(tail))
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--bytewise", dirA, dirB)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if stdout != "~ early\n~ tail\n" {
+		t.Errorf("expected both differing files, got %q", stdout)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+	subsetDir := filepath.Join(root, "test_subset")
+	statsPath := filepath.Join(t.TempDir(), "stats.json")
+
+	tests := []struct {
+		name            string
+		pathA, pathB    string
+		expectedVerdict string
+		expectedError   error
+	}{
+		{"Identical", baseDir, baseDir + string(os.PathSeparator), "identical", nil},
+		{"Divergent", baseDir, modDir, "divergent", ErrDiffsFound},
+		{"Subset", subsetDir, baseDir, "a_subset_b", ErrASubsetB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(statsPath)
+			_, _, err := runApp(t, "--silent", "--workers", "2", "--stats-json", statsPath, tt.pathA, tt.pathB)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+
+			data, err := os.ReadFile(statsPath)
+			if err != nil {
+				t.Fatalf("expected the sidecar to be written: %v", err)
+			}
+			var summary runSummary
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatalf("invalid sidecar %s: %v", data, err)
+			}
+			if summary.Verdict != tt.expectedVerdict {
+				t.Errorf("expected verdict %q, got %q", tt.expectedVerdict, summary.Verdict)
+			}
+			if summary.Elapsed <= 0 || summary.Workers > 2 {
+				t.Errorf("expected elapsed time and workers, got %+v", summary)
+			}
+			if tt.expectedError == ErrDiffsFound && (summary.ModifiedFiles != 1 || summary.BytesHashed == 0 || summary.Workers < 1) {
+				t.Errorf("expected one modified file, hashed bytes and workers, got %+v", summary)
+			}
+		})
+	}
+}
+
+func TestCheckDirMTime(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "same", "file"), "content")
+		createFile(t, filepath.Join(dir, "touched", "file"), "content")
+		for _, sub := range []string{"same", "touched"} {
+			if err := os.Chtimes(filepath.Join(dir, sub), past, past); err != nil {
+				t.Fatalf("failed to set mtime: %v", err)
+			}
+		}
+	}
+	touched := past.Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dirB, "touched"), touched, touched); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+	// the roots differ too, but are never compared
+	if err := os.Chtimes(dirA, past, past); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedError  error
+	}{
+		{"Ignored By Default", nil, "", nil},
+		{"Reported With Flag", []string{"--check-dir-mtime"}, "~ touched/\n", ErrDiffsFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestGlobSyntax(t *testing.T) {
+	tests := []struct {
+		pattern, path       string
+		classic, doublestar bool
+	}{
+		{"**/*.go", "main.go", false, true},
+		{"**/*.go", "cmd/main.go", true, true},
+		{"**/*.go", "cmd/app/main.go", true, true},
+		{"**/*.go", "cmd/main.go.txt", false, false},
+		{"*.go", "main.go", true, true},
+		{"*.go", "cmd/main.go", true, false},
+		{"cmd/*", "cmd/app/main.go", true, false},
+		{"cmd/**", "cmd/app/main.go", true, true},
+		{"cmd/**/main.go", "cmd/app/x/main.go", true, true},
+		{"{cmd,pkg}/*.go", "pkg/util.go", true, true},
+	}
+
+	for _, tt := range tests {
+		for syntax, expected := range map[string]bool{"classic": tt.classic, "doublestar": tt.doublestar} {
+			g, err := compilePattern(tt.pattern, syntax)
+			if err != nil {
+				t.Fatalf("%s: failed to compile %q: %v", syntax, tt.pattern, err)
+			}
+			if g.Match(tt.path) != expected {
+				t.Errorf("%s: expected %q matching %q to be %v", syntax, tt.pattern, tt.path, expected)
+			}
+		}
+	}
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, name := range []string{"main.go", "cmd/main.go", "cmd/app/main.go"} {
+		createFile(t, filepath.Join(dirA, name), "package main")
+		createFile(t, filepath.Join(dirB, name), "package changed")
+	}
+	for syntax, expectedOutput := range map[string]string{
+		"classic":    "~ cmd/app/main.go\n~ cmd/main.go\n~ main.go\n",
+		"doublestar": "~ main.go\n",
+	} {
+		stdout, _, _ := runApp(t, "--no-color", "--silent", "--glob", syntax, "--include", "*.go", dirA, dirB)
+		if stdout != expectedOutput {
+			t.Errorf("%s: expected output %q, got %q", syntax, expectedOutput, stdout)
+		}
+	}
+
+	if _, _, err := runApp(t, "--glob", "regex", dirA, dirB); exitCode(err) != 2 {
+		t.Errorf("expected an invalid --glob to be rejected, got: %v", err)
+	}
+}
+
+func TestColumns(t *testing.T) {
+	t.Setenv("TEST_FIX_WIDTH", "80")
+	root := t.TempDir()
+	dirA, dirB := filepath.Join(root, "a"), filepath.Join(root, "b")
+	createFile(t, filepath.Join(dirA, "changed"), "old")
+	createFile(t, filepath.Join(dirB, "changed"), "new")
+	createFile(t, filepath.Join(dirA, "only-in-a.txt"), "content")
+	createFile(t, filepath.Join(dirB, "sub", "only-in-b"), "content")
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--columns", "--relative-to", root, dirA, dirB)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+
+	// the A column is as wide as its longest entry plus two spaces
+	sep := SEPARATOR
+	expected := "a              " + sep + "b\n" +
+		strings.Repeat(HEADER_SEPARATOR, 19) + "\n" +
+		"changed (M)    " + sep + "changed (M)\n" +
+		"only-in-a.txt  " + sep + "\n" +
+		"               " + sep + "sub/\n"
+	if stdout != expected {
+		t.Errorf("expected aligned columns:\n%s\ngot:\n%s", expected, stdout)
+	}
+
+	stdout, _, _ = runApp(t, "--no-color", "--silent", "--columns", "--no-header", dirA, dirB)
+	if !strings.HasPrefix(stdout, "changed (M)    "+sep) {
+		t.Errorf("expected the columns without header, got:\n%s", stdout)
+	}
+}
+
+func TestBatchHash(t *testing.T) {
+	dir := t.TempDir()
+	var relPaths []string
+	for i := range 8 {
+		relPath := fmt.Sprintf("dir/file%d", i)
+		createFile(t, filepath.Join(dir, relPath), strings.Repeat("x", i))
+		relPaths = append(relPaths, relPath)
+	}
+	relPaths = append(relPaths, "missing")
+
+	defer func(workers int) { batchHashWorkers, batchHashHook = workers, nil }(batchHashWorkers)
+	batchHashWorkers = 4
+	var active, maxActive atomic.Int32
+	batchHashHook = func(string) {
+		n := active.Add(1)
+		for m := maxActive.Load(); n > m && !maxActive.CompareAndSwap(m, n); m = maxActive.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		active.Add(-1)
+	}
+
+	reply := &BatchHashReply{}
+	if err := (&RpcAgent{}).GetSHABatch(BatchHashArgs{Root: dir, RelPaths: relPaths}, reply); err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	if maxActive.Load() < 2 {
+		t.Errorf("expected the batch to be hashed by multiple goroutines, got at most %d at once", maxActive.Load())
+	}
+	if len(reply.Hashes) != len(relPaths) {
+		t.Fatalf("expected %d hashes, got %d", len(relPaths), len(reply.Hashes))
+	}
+	for i, relPath := range relPaths[:len(relPaths)-1] {
+		expected, err := coreSHA(dir, relPath, 0, false, TextNorm{}, HashOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Hashes[i].Hash != expected || reply.Hashes[i].Error != "" {
+			t.Errorf("%s: expected hash %s, got %+v", relPath, expected, reply.Hashes[i])
+		}
+	}
+	if reply.Hashes[len(relPaths)-1].Error == "" {
+		t.Errorf("expected an error for the missing file")
+	}
+}
+
+func TestRemoteFingerprintBatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake remote shell requires a POSIX shell")
+	}
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	baseDir := filepath.Join(root, "test_base")
+
+	// the remote side is hashed in a single batch and must match the local side
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--fingerprint", "--rsh", createFakeRsh(t), "fakehost:"+baseDir, baseDir)
+	if err != nil {
+		t.Errorf("expected identical directories, got: %v", err)
+	}
+	if !strings.HasSuffix(stdout, "Fingerprints match.\n") {
+		t.Errorf("expected matching fingerprints, got:\n%s", stdout)
+	}
+}
+
+func TestPrintIdentical(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+	equalDir := filepath.Join(root, "test_equal")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedError  error
+	}{
+		{"Absent By Default", []string{baseDir, modDir}, "~ file2\n", ErrDiffsFound},
+		{"Listed With Flag", []string{"--print-identical", baseDir, modDir}, "= file1\n~ file2\n", ErrDiffsFound},
+		{"Not a Difference", []string{"--print-identical", baseDir, equalDir}, "= file1\n= file2\n", nil},
+		{"Not Counted By Max Diffs", []string{"--print-identical", "--max-diffs", "1", baseDir, equalDir}, "= file1\n= file2\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestEnvOptions(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+
+	tests := []struct {
+		name           string
+		env            string
+		args           []string
+		expectedOutput string
+		expectedError  error
+	}{
+		{"Defaults Apply", `--exclude "file2" --no-color`, nil, "", nil},
+		{"Positional Args Kept", "--format jsonl", nil, `{"type":"modified","path":"file2","is_dir":false}` + "\n", ErrDiffsFound},
+		{"Command Line Overrides", "--format jsonl", []string{"--format", "text"}, "~ file2\n", ErrDiffsFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(ENV_OPTIONS, tt.env)
+			args, err := withEnvOptions(append(append([]string{"dirdiff", "--no-color", "--silent"}, tt.args...), baseDir, modDir))
+			if err != nil {
+				t.Fatalf("failed to apply %s: %v", ENV_OPTIONS, err)
+			}
+			if args[len(args)-2] != baseDir || args[len(args)-1] != modDir {
+				t.Errorf("expected the directories to stay last, got %q", args)
+			}
+
+			stdout, _, err := runApp(t, args[1:]...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if got := strings.SplitAfter(stdout, "\n")[0]; got != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+
+	t.Setenv(ENV_OPTIONS, `--exclude "unterminated`)
+	if _, err := withEnvOptions([]string{"dirdiff", baseDir, modDir}); err == nil {
+		t.Errorf("expected an error for invalid quoting")
+	}
+}
+
+func TestFollowSymlinkDuplicates(t *testing.T) {
+	ext := t.TempDir()
+	root := t.TempDir()
+	createFile(t, filepath.Join(ext, "shared", "f1"), "one")
+	createFile(t, filepath.Join(ext, "shared", "sub", "f2"), "two")
+	createFile(t, filepath.Join(root, "d", "f3"), "three")
+	links := map[string]string{
+		"a-sub":    filepath.Join(ext, "shared", "sub"),
+		"b-shared": filepath.Join(ext, "shared"),
+		"c-shared": filepath.Join(ext, "shared"), // same target as b-shared
+		"e-d":      filepath.Join(root, "d"),     // already walked directly
+		"loop":     root,
+		"f-link":   filepath.Join(ext, "shared", "f1"),
+		"g-link":   filepath.Join(ext, "shared", "f1"), // files are never skipped
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	expected := []string{"a-sub/f2", "b-shared/f1", "b-shared/sub/f2", "d/f3", "f-link", "g-link"}
+	for range 5 {
+		files, _, issues, err := coreScan(context.Background(), root, ScanOptions{FollowSym: true})
+		if err != nil || len(issues) > 0 {
+			t.Fatalf("scan failed: %v %v", err, issues)
+		}
+		if got := slices.Sorted(maps.Keys(files)); !slices.Equal(got, expected) {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestMetadataOnly(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "same-size"), "aaaa")
+	createFile(t, filepath.Join(dirB, "same-size"), "bbbb")
+	createFile(t, filepath.Join(dirA, "resized"), "short")
+	createFile(t, filepath.Join(dirB, "resized"), "much longer")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedCode   int
+	}{
+		{"Content Compared", nil, "~ resized\n~ same-size\n", 1},
+		{"Sizes Only", []string{"--metadata-only"}, "~ resized\n", 1},
+		{"Content Option Rejected", []string{"--metadata-only", "--bytewise"}, "", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if exitCode(err) != tt.expectedCode {
+				t.Errorf("expected exit code %d, got: %v", tt.expectedCode, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	got := lineDiff([]string{"a", "b", "c", "d"}, []string{"a", "x", "c", "d", "e"})
+	if expected := []string{" a", "-b", "+x", " c", " d", "+e"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// the largest previews don't need a table of all line pairs
+	a := make([]string, MAX_PREVIEW_LINES)
+	b := make([]string, MAX_PREVIEW_LINES)
+	for i := range a {
+		a[i], b[i] = fmt.Sprint(i), fmt.Sprint(i*2)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	lines := lineDiff(a, b)
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 20<<20 {
+		t.Errorf("expected the diff to allocate less than 20MiB, got %d bytes", allocated)
+	}
+	// the even numbers below MAX_PREVIEW_LINES are common
+	if common := len(slices.DeleteFunc(lines, func(l string) bool { return l[0] != ' ' })); common != MAX_PREVIEW_LINES/2 {
+		t.Errorf("expected %d common lines, got %d", MAX_PREVIEW_LINES/2, common)
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "one"), "a\nb\nc\n")
+	createFile(t, filepath.Join(dirB, "one"), "a\nB\nc\n")
+	createFile(t, filepath.Join(dirA, "two"), "x\n")
+	createFile(t, filepath.Join(dirB, "two"), "yy\n")
+	createFile(t, filepath.Join(dirA, "same"), "same\n")
+	createFile(t, filepath.Join(dirB, "same"), "same\n")
+
+	const listing = "~ one\n~ two\n"
+	const promptOne = "[1/2] ~ one (v)iew diff, (s)kip, (q)uit? "
+	const promptTwo = "[2/2] ~ two (v)iew diff, (s)kip, (q)uit? "
+
+	tests := []struct {
+		name           string
+		terminal       bool
+		input          string
+		expectedOutput string
+	}{
+		{"Not A Terminal", false, "v\n", listing},
+		{"View Then Quit", true, "v\nq\n", listing + promptOne + "v\n a\n-b\n+B\n c\n" + promptTwo + "q\n"},
+		{"Skip All", true, "ss", listing + promptOne + "s\n" + promptTwo + "s\n"},
+		{"Quit First", true, "q", listing + promptOne + "q\n"},
+		{"Unknown Key Prompts Again", true, "xS v", listing + promptOne + "x\n" + promptOne + "S\n" + promptTwo + "v\n-x\n+yy\n"},
+		{"End Of Input", true, "s", listing + promptOne + "s\n" + promptTwo + "\n"},
+	}
+
+	defer func(orig func(io.Reader) bool) { isInteractiveInput = orig }(isInteractiveInput)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isInteractiveInput = func(io.Reader) bool { return tt.terminal }
+
+			stdout, _, err := runAppWithInput(t, strings.NewReader(tt.input), "--no-color", "--silent", "--interactive", dirA, dirB)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, but got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestDeepTree(t *testing.T) {
+	root := t.TempDir()
+	// the tree is built relative to the working directory, so it can grow beyond PATH_MAX
+	t.Chdir(root)
+	const depth = 3000
+	for range depth {
+		if err := os.Mkdir("d", 0755); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+		if err := os.Chdir("d"); err != nil {
+			t.Fatalf("chdir failed: %v", err)
+		}
+	}
+	createFile(t, "leaf", "content")
+
+	files, dirs, issues, err := coreScan(context.Background(), root, ScanOptions{})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	for _, issue := range issues {
+		if !strings.Contains(issue.Err, "exceeds the length limit of the OS") {
+			t.Errorf("expected overly long paths to be reported clearly, got %q", issue.Err)
+		}
+	}
+	if len(issues) == 0 {
+		// the OS accepts arbitrarily long paths, so the whole tree was listed
+		if len(dirs) != depth || len(files) != 1 {
+			t.Errorf("expected %d directories and 1 file, got %d and %d", depth, len(dirs), len(files))
+		}
+	} else if len(dirs) == 0 || len(dirs) >= depth {
+		t.Errorf("expected the tree to be listed up to the length limit, got %d directories", len(dirs))
+	}
+}
+
+func TestProgressDescription(t *testing.T) {
+	if got := progressDescription("short"); got != "Comparing files: short" {
+		t.Errorf("expected the short name unchanged, got %q", got)
+	}
+	long := strings.Repeat("dir/", 20) + "file.txt"
+	got := progressDescription(long)
+	if want := "Comparing files: ..." + long[len(long)-PROGRESS_NAME_WIDTH+3:]; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "sub", "alpha"), "content")
+	}
+	_, stderr, err := runApp(t, "--no-color", dirA, dirB)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !strings.Contains(stderr, "Comparing files: sub/alpha") {
+		t.Errorf("expected a frame naming the compared file, got:\n%s", stderr)
+	}
+}
+
+func TestDirsOnly(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "sub", "file"), "a")
+	createFile(t, filepath.Join(dirB, "sub", "file"), "b")
+	createFile(t, filepath.Join(dirA, "sub", "only-a"), "a")
+	createFile(t, filepath.Join(dirB, "other", "only-b"), "b")
+	if err := os.Mkdir(filepath.Join(dirA, "other"), 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+
+	run := func(args ...string) (string, error) {
+		stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, args...)...)
+		return stdout, err
+	}
+
+	if out, err := run("--dirs-only", dirA, dirB); err != nil || out != "" {
+		t.Errorf("expected identical directory structures, got %q: %v", out, err)
+	}
+	if _, err := run(dirA, dirB); !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected the files to differ without --dirs-only, got: %v", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dirB, "extra"), 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	out, err := run("--dirs-only", dirA, dirB)
+	if !errors.Is(err, ErrASubsetB) || out != "+ extra/\n" {
+		t.Errorf("expected the added directory to be reported, got %q: %v", out, err)
+	}
+}
+
+func TestNaturalSort(t *testing.T) {
+	paths := []string{"file2", "img010b", "file10", "img10a", "file1", "dir2/x", "dir10/x", "file01"}
+	slices.SortStableFunc(paths, naturalCompare)
+	expected := []string{"dir2/x", "dir10/x", "file01", "file1", "file2", "file10", "img10a", "img010b"}
+	if !slices.Equal(paths, expected) {
+		t.Errorf("expected natural order %q, got %q", expected, paths)
+	}
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, name := range []string{"file2", "file10", "file1"} {
+		createFile(t, filepath.Join(dirB, name), "content")
+	}
+	tests := []struct {
+		flags          []string
+		expectedOutput string
+	}{
+		{nil, "+ file1\n+ file10\n+ file2\n"},
+		{[]string{"--natural-sort"}, "+ file1\n+ file2\n+ file10\n"},
+		{[]string{"--natural-sort", "--tree", "--no-header"}, "├×     ║ ├── file1 (+)\n├×     ║ ├── file2 (+)\n└×     ║ └── file10 (+)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.flags, " "), func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.flags...)
+			stdout, _, _ := runApp(t, append(args, dirA, dirB)...)
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestSymlinkRetargeted(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "old"), "content")
+		createFile(t, filepath.Join(dir, "new"), "content")
+	}
+	if err := os.Symlink("old", filepath.Join(dirA, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink("new", filepath.Join(dirB, "link")); err != nil {
+		t.Fatalf("symlink failed: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+	}{
+		{"Targets Named", nil, "~ link (old -> new)\n"},
+		{"Jsonl", []string{"--format", "jsonl"}, `{"type":"modified","path":"link","is_dir":false,"target_a":"old","target_b":"new"}` + "\n"},
+		{"Followed", []string{"-L"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, _ := runApp(t, append(args, dirA, dirB)...)
+			if got := strings.SplitAfter(stdout, "\n")[0]; got != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "small")
+	createFile(t, path, "small content\n")
+
+	// full and sparse hashes with the default buffer
+	limits := []int64{0, 6}
+	expected := make([]string, len(limits))
+	for i, limit := range limits {
+		var err error
+		if expected[i], err = computeSparseHash(path, sha256.New(), limit, false, HashOptions{}); err != nil {
+			t.Fatalf("hashing failed: %v", err)
+		}
+	}
+
+	// the same size twice reuses a pooled buffer
+	for _, size := range []string{"1", "7", "4KB", "1MB", "1MB"} {
+		bufferSize, err := parseBufferSize(size)
+		if err != nil {
+			t.Fatalf("expected --buffer-size %s to be valid, got: %v", size, err)
+		}
+		for i, limit := range limits {
+			sum, err := computeSparseHash(path, sha256.New(), limit, false, HashOptions{BufferSize: bufferSize})
+			if err != nil || sum != expected[i] {
+				t.Errorf("expected a buffer of %s not to change the hash with limit %d, got %s: %v", size, limit, sum, err)
+			}
+		}
+	}
+
+	for _, size := range []string{"0", "-1KB", "big"} {
+		if _, err := parseBufferSize(size); err == nil {
+			t.Errorf("expected --buffer-size %q to be rejected", size)
+		}
+	}
+}
+
+func BenchmarkBufferSize(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "big")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("0123456789abcdef"), 4<<20), 0644); err != nil {
+		b.Fatalf("write failed: %v", err)
+	}
+	for _, size := range []string{"", "1MB", "4MB"} {
+		b.Run("buffer="+size, func(b *testing.B) {
+			bufferSize, err := parseBufferSize(size)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(64 << 20)
+			for b.Loop() {
+				if _, err := computeSparseHash(path, sha256.New(), 0, false, HashOptions{BufferSize: bufferSize}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyBaseline(t *testing.T) {
+	dir := t.TempDir()
+	createFile(t, filepath.Join(dir, "file"), "content")
+	createFile(t, filepath.Join(dir, "sub", "inner"), "content")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedErr    error
+	}{
+		{"Empty A", []string{EMPTY_PATH, dir}, "+ file\n+ sub/\n", ErrASubsetB},
+		{"Dev Null B", []string{dir, os.DevNull}, "- file\n- sub/\n", ErrBSubsetA},
+		{"Show All", []string{"--show-all", EMPTY_PATH, dir}, "+ file\n+ sub/\n+ sub/inner\n", ErrASubsetB},
+		{"Both Empty", []string{EMPTY_PATH, os.DevNull}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedErr) || (tt.expectedErr == nil && err != nil) {
+				t.Errorf("expected error %v, got: %v", tt.expectedErr, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestStrong(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	content := bytes.Repeat([]byte("x"), 30000)
+	createFile(t, filepath.Join(dirA, "big"), string(content))
+	// the change lies outside of the sampled beginning, middle and end of the file
+	content[5000] = 'y'
+	createFile(t, filepath.Join(dirB, "big"), string(content))
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedCode   int
+	}{
+		{"Sparse Hash Misses", []string{"--global-limit", "3000"}, "", 0},
+		{"Fast Hash Misses", []string{"--fast", "big", "--fast-limit", "3000"}, "", 0},
+		{"Strong Global", []string{"--strong", "--global-limit", "3000"}, "~ big\n", 1},
+		{"Strong Fast", []string{"--strong", "--fast", "big", "--fast-limit", "3000"}, "~ big\n", 1},
+		{"Metadata Only Rejected", []string{"--strong", "--metadata-only"}, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if exitCode(err) != tt.expectedCode {
+				t.Errorf("expected exit code %d, got: %v", tt.expectedCode, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestEmptyDirsOnlyDiffer(t *testing.T) {
+	mkdirs := func(t *testing.T, root string, dirs ...string) {
+		for _, d := range dirs {
+			if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+				t.Fatalf("mkdir failed: %v", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name            string
+		dirsA, dirsB    []string
+		args            []string
+		expectedOutput  string
+		expectedSummary string
+		expectedCode    int
+	}{
+		{"Dir Only Added", []string{"common"}, []string{"common", "new/inner"}, nil,
+			"+ new/\n", "Summary: 1 added dirs (subdirectories/files inside them not listed)\n", 3},
+		{"Dir Only Added Show All", []string{"common"}, []string{"common", "new/inner"}, []string{"--show-all"},
+			"+ new/\n+ new/inner/\n", "Summary: 2 added dirs\n", 3},
+		{"Dir Only Removed", []string{"common", "old"}, []string{"common"}, nil,
+			"- old/\n", "Summary: 1 removed dirs (subdirectories/files inside them not listed)\n", 4},
+		{"Mixed", []string{"old/inner"}, []string{"new"}, []string{"--show-all"},
+			"+ new/\n- old/\n- old/inner/\n", "Summary: 1 added dirs, 2 removed dirs\n", 1},
+		{"Identical", []string{"common/inner"}, []string{"common/inner"}, nil, "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirA, dirB := t.TempDir(), t.TempDir()
+			mkdirs(t, dirA, tt.dirsA...)
+			mkdirs(t, dirB, tt.dirsB...)
+
+			logFile := filepath.Join(t.TempDir(), "log")
+			args := append([]string{"--no-color", "--verbose", "--log-file", logFile}, tt.args...)
+			stdout, stderr, err := runApp(t, append(args, dirA, dirB)...)
+			if exitCode(err) != tt.expectedCode {
+				t.Errorf("expected exit code %d, got: %v", tt.expectedCode, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+			if !strings.Contains(stderr, tt.expectedSummary) {
+				t.Errorf("expected summary %q, got %q", tt.expectedSummary, stderr)
+			}
+		})
+	}
+}
+
+func TestIgnoreEmptyDirs(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "file"), "content")
+	}
+	for _, d := range []string{filepath.Join(dirA, "scaffold", "empty"), filepath.Join(dirB, "other")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+	}
+
+	run := func(args ...string) (string, error) {
+		stdout, _, err := runApp(t, append(append([]string{"--no-color", "--silent"}, args...), dirA, dirB)...)
+		return stdout, err
+	}
+
+	if out, err := run(); !errors.Is(err, ErrDiffsFound) || out != "+ other/\n- scaffold/\n" {
+		t.Errorf("expected the empty directories to differ, got %q: %v", out, err)
+	}
+	for _, args := range [][]string{{"--ignore-empty-dirs"}, {"--ignore-empty-dirs", "--show-all"}} {
+		if out, err := run(args...); err != nil || out != "" {
+			t.Errorf("expected identical directories with %v, got %q: %v", args, out, err)
+		}
+	}
+
+	// a directory holding files still counts, but not its empty subdirectories
+	createFile(t, filepath.Join(dirB, "other", "data"), "content")
+	if err := os.Mkdir(filepath.Join(dirB, "other", "empty"), 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	out, err := run("--ignore-empty-dirs", "--show-all")
+	if !errors.Is(err, ErrASubsetB) || out != "+ other/\n+ other/data\n" {
+		t.Errorf("expected only the directory with files to be added, got %q: %v", out, err)
+	}
+}
+
+func TestVerboseMismatch(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	content := bytes.Repeat([]byte("a"), 100000)
+	createFile(t, filepath.Join(dirA, "early"), string(content[:100]))
+	createFile(t, filepath.Join(dirB, "early"), string(content[:1234])+"b"+string(content[:20]))
+	createFile(t, filepath.Join(dirA, "late"), string(content))
+	content[70000] = 'b' // beyond the first block
+	createFile(t, filepath.Join(dirB, "late"), string(content))
+
+	logFile := filepath.Join(t.TempDir(), "log")
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--verbose", "--log-file", logFile, dirA, dirB)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	// the shorter file ends before the files differ
+	expected := "~ early (differ at offset 100, sizes 100B vs 1.255kB)\n~ late (differ at offset 70000, sizes 100kB vs 100kB)\n"
+	if stdout != expected {
+		t.Errorf("expected output %q, got %q", expected, stdout)
+	}
+
+	stdout, _, _ = runApp(t, "--no-color", "--silent", "--verbose", "--bytes", "--log-file", logFile, dirA, dirB)
+	expected = "~ early (differ at offset 100, sizes 100 vs 1255)\n~ late (differ at offset 70000, sizes 100000 vs 100000)\n"
+	if stdout != expected {
+		t.Errorf("expected raw sizes with --bytes %q, got %q", expected, stdout)
+	}
+
+	createFile(t, filepath.Join(dirA, "early"), string(content[:1300]))
+	if m := locateMismatch(&LocalNode{root: dirA}, &LocalNode{root: dirB}, "early", 1300, 1255, false); m.Offset != 1234 {
+		t.Errorf("expected the files to differ at offset 1234, got %d", m.Offset)
+	}
+	if m := locateMismatch(&LocalNode{root: dirA}, &EmptyNode{}, "early", 1300, 1255, false); m.Offset != -1 || m.SizeA != 1300 || m.SizeB != 1255 {
+		t.Errorf("expected only the sizes without a second local file, got %+v", m)
+	}
+}
+
+// concurrencyAgent is a fake agent recording the maximum number of concurrent batch calls.
+type concurrencyAgent struct {
+	inFlight, maxInFlight, calls atomic.Int32
+}
+
+func (a *concurrencyAgent) GetSHABatch(args BatchHashArgs, reply *BatchHashReply) error {
+	a.calls.Add(1)
+	n := a.inFlight.Add(1)
+	defer a.inFlight.Add(-1)
+	for {
+		if m := a.maxInFlight.Load(); n <= m || a.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, relPath := range args.RelPaths {
+		reply.Hashes = append(reply.Hashes, HashReply{Hash: relPath})
+	}
+	return nil
+}
+
+func TestRemoteConcurrency(t *testing.T) {
+	for _, limit := range []int{1, 3} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			agent := &concurrencyAgent{}
+			server := rpc.NewServer()
+			if err := server.RegisterName("RpcAgent", agent); err != nil {
+				t.Fatalf("register failed: %v", err)
+			}
+			serverConn, clientConn := net.Pipe()
+			go server.ServeConn(serverConn)
+			client := rpc.NewClient(clientConn)
+			defer client.Close()
+
+			node := &RemoteNode{client: client, host: "fakehost", calls: make(chan struct{}, limit)}
+			var wg sync.WaitGroup
+			for i := range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if hash, err := node.GetSHA(fmt.Sprint(i), 0, false, TextNorm{}); err != nil || hash != fmt.Sprint(i) {
+						t.Errorf("expected hash %d, got %q: %v", i, hash, err)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := agent.maxInFlight.Load(); got != int32(limit) {
+				t.Errorf("expected at most %d calls in flight, got %d", limit, got)
+			}
+			// the calls queued while all slots are taken share a batch
+			if got := agent.calls.Load(); got >= 20 {
+				t.Errorf("expected the 20 calls to be batched, got %d batches", got)
+			}
+		})
+	}
+}
+
+func TestRenameMap(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "foo-1.0.txt"), "same")
+	createFile(t, filepath.Join(dirB, "foo-2.0.txt"), "same")
+	createFile(t, filepath.Join(dirA, "sub", "bar-1.0.txt"), "old")
+	createFile(t, filepath.Join(dirB, "sub", "bar-2.0.txt"), "new")
+	createFile(t, filepath.Join(dirB, "unmapped"), "new")
+
+	mapFile := filepath.Join(t.TempDir(), "renames")
+	createFile(t, mapFile, "foo-1.0.txt\tfoo-2.0.txt\n\nsub/bar-1.0.txt\tsub/bar-2.0.txt\nmissing\tgone\n")
+
+	run := func(args ...string) (string, error) {
+		stdout, _, err := runApp(t, append(append([]string{"--no-color", "--silent"}, args...), dirA, dirB)...)
+		return stdout, err
+	}
+
+	out, err := run()
+	if !errors.Is(err, ErrDiffsFound) || out != "- foo-1.0.txt\n+ foo-2.0.txt\n- sub/bar-1.0.txt\n+ sub/bar-2.0.txt\n+ unmapped\n" {
+		t.Errorf("expected added and removed files without a map, got %q: %v", out, err)
+	}
+	out, err = run("--rename-map", mapFile)
+	if !errors.Is(err, ErrDiffsFound) || out != "~ sub/bar-1.0.txt\n+ unmapped\n" {
+		t.Errorf("expected the mapped files to be compared by content, got %q: %v", out, err)
+	}
+
+	// a renamed file can't replace another file of B
+	createFile(t, filepath.Join(dirB, "foo-1.0.txt"), "same")
+	if _, err := run("--rename-map", mapFile); exitCode(err) != 2 {
+		t.Errorf("expected a collision to be a runtime error, got: %v", err)
+	}
+
+	createFile(t, mapFile, "foo-1.0.txt foo-2.0.txt\n")
+	if _, err := run("--rename-map", mapFile); exitCode(err) != 2 {
+		t.Errorf("expected a malformed map to be a runtime error, got: %v", err)
+	}
+}
+
+func TestSummaryFlag(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+	emptyA, emptyB := t.TempDir(), t.TempDir()
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedStderr string
+		expectedCode   int
+	}{
+		{"Quiet Summary", []string{"--quiet", "--summary", baseDir, modDir}, "Summary: 1 modified files\n", 1},
+		{"Quiet", []string{"--quiet", baseDir, modDir}, "", 1},
+		{"Identical", []string{"--quiet", "--summary", emptyA, emptyB}, "Summary: no differences\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, err := runApp(t, append([]string{"--no-color"}, tt.args...)...)
+			if exitCode(err) != tt.expectedCode {
+				t.Errorf("expected exit code %d, got: %v", tt.expectedCode, err)
+			}
+			if stdout != "" {
+				t.Errorf("expected no per-file output, got %q", stdout)
+			}
+			if stderr != tt.expectedStderr {
+				t.Errorf("expected stderr %q, got %q", tt.expectedStderr, stderr)
+			}
+		})
+	}
+}
+
+func TestSparseChunks(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	content := bytes.Repeat([]byte("x"), 40000)
+	createFile(t, filepath.Join(dirA, "big"), string(content))
+	content[13000] = 'y' // in the second quarter, between the beginning and the middle
+	createFile(t, filepath.Join(dirB, "big"), string(content))
+
+	tests := []struct {
+		chunks       string
+		expectedCode int
+	}{
+		{"3", 0},
+		{"4", 1},
+		{"1", 0},
+		{"0", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chunks, func(t *testing.T) {
+			_, _, err := runApp(t, "--silent", "--global-limit", "4000", "--sparse-chunks", tt.chunks, dirA, dirB)
+			if exitCode(err) != tt.expectedCode {
+				t.Errorf("expected exit code %d, got: %v", tt.expectedCode, err)
+			}
+		})
+	}
+
+	// a single chunk is the beginning of the file, limited to the limit
+	path := filepath.Join(dirB, "big")
+	sum, err := computeSparseHash(path, sha256.New(), 4000, false, HashOptions{SparseChunks: 1})
+	if expected := sha256.Sum256(content[:4000]); err != nil || sum != hex.EncodeToString(expected[:]) {
+		t.Errorf("expected the hash of the first 4000 bytes, got %s: %v", sum, err)
+	}
+}
+
+func TestIgnoreBOM(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "text.txt"), "line1\nline2\n")
+	createFile(t, filepath.Join(dirB, "text.txt"), "\ufeffline1\nline2\n")
+	createFile(t, filepath.Join(dirA, "inner.txt"), "line1\nline2\n")
+	createFile(t, filepath.Join(dirB, "inner.txt"), "line1\n\ufeffline2\n")
+	createFile(t, filepath.Join(dirA, "crlf.txt"), "line1\nline2\n")
+	createFile(t, filepath.Join(dirB, "crlf.txt"), "\ufeffline1\r\nline2\r\n")
+	createFile(t, filepath.Join(dirA, "data.bin"), "\x00line1\n")
+	createFile(t, filepath.Join(dirB, "data.bin"), "\ufeff\x00line1\n")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+	}{
+		{"BOM Differs Without Flag", nil, "~ crlf.txt\n~ data.bin\n~ inner.txt\n~ text.txt\n"},
+		{"Only Leading BOM Ignored", []string{"--ignore-bom"}, "~ crlf.txt\n~ data.bin\n~ inner.txt\n"},
+		{"Combined With EOL", []string{"--ignore-bom", "--ignore-eol"}, "~ data.bin\n~ inner.txt\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestNoRecurse(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "top"), "same")
+	createFile(t, filepath.Join(dirB, "top"), "same")
+	createFile(t, filepath.Join(dirA, "sub", "file"), "old")
+	createFile(t, filepath.Join(dirB, "sub", "file"), "new")
+	createFile(t, filepath.Join(dirB, "sub", "added"), "new")
+	createFile(t, filepath.Join(dirA, "removed", "file"), "old")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+	}{
+		{"Recursive", nil, "+ sub/added\n- removed/\n~ sub/file\n"},
+		{"Top Level Only", []string{"--no-recurse"}, "- removed/\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent", "--sort", "status"}, tt.args...)
+			stdout, _, _ := runApp(t, append(args, dirA, dirB)...)
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+
+	// the top level file is still compared by content
+	createFile(t, filepath.Join(dirB, "top"), "changed")
+	stdout, _, _ := runApp(t, "--no-color", "--silent", "--no-recurse", dirA, dirB)
+	if stdout != "- removed/\n~ top\n" {
+		t.Errorf("expected the top level file to be modified, got %q", stdout)
+	}
+}
+
+func TestExitMap(t *testing.T) {
+	root := setupTestEnv(t)
+	defer os.RemoveAll(root)
+	baseDir := filepath.Join(root, "test_base")
+	modDir := filepath.Join(root, "test_modified")
+	emptyA, emptyB := t.TempDir(), t.TempDir()
+	// added and removed files only, divergent without modifications
+	onlyA, onlyB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(onlyA, "a.txt"), "a")
+	createFile(t, filepath.Join(onlyB, "b.txt"), "b")
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+	}{
+		{"Divergent Mapped", []string{"--exit-map", "identical=0,a_subset_b=0,b_subset_a=0,divergent=7", baseDir, modDir}, 7},
+		{"Identical Mapped", []string{"--exit-map", "identical=9", emptyA, emptyB}, 9},
+		{"Unspecified Verdict", []string{"--exit-map", "identical=9", baseDir, modDir}, 1},
+		{"Modified Mapped", []string{"--exit-map", "divergent=7,modified=8", baseDir, modDir}, 8},
+		{"Modified Falls Back To Divergent", []string{"--exit-map", "divergent=7", baseDir, modDir}, 7},
+		{"Divergent Without Modifications", []string{"--exit-map", "divergent=7,modified=8", onlyA, onlyB}, 7},
+		{"Unknown Verdict", []string{"--exit-map", "changed=7", baseDir, modDir}, 2},
+		{"Code Out Of Range", []string{"--exit-map", "divergent=126", baseDir, modDir}, 2},
+		{"Missing Code", []string{"--exit-map", "divergent", baseDir, modDir}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp()
+			app.Writer = &bytes.Buffer{}
+			app.ErrWriter = &bytes.Buffer{}
+			err := app.Run(context.Background(), append([]string{"dirdiff", "--silent"}, tt.args...))
+			if code := mappedExitCode(err, app); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+			}
+		})
+	}
+}
+
+func TestConfirmOver(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "one"), "a\n")
+	createFile(t, filepath.Join(dirB, "one"), "b\n")
+	createFile(t, filepath.Join(dirA, "two"), "same\n")
+	createFile(t, filepath.Join(dirB, "two"), "same\n")
+
+	const estimate = "About to compare 2 files, hashing 14B.\n"
+
+	tests := []struct {
+		name           string
+		terminal       bool
+		args           []string
+		input          string
+		expectedErr    error
+		expectedStderr string
+	}{
+		{"Declined", true, []string{"--confirm-over", "1"}, "n\n", ErrAborted, estimate + "Continue? [y/N] "},
+		{"End Of Input", true, []string{"--confirm-over", "1"}, "", ErrAborted, estimate + "Continue? [y/N] "},
+		{"Confirmed", true, []string{"--confirm-over", "1"}, "y\n", ErrDiffsFound, estimate + "Continue? [y/N] "},
+		{"Yes Flag", true, []string{"--confirm-over", "10B", "--yes"}, "n\n", ErrDiffsFound, estimate},
+		{"Not A Terminal", false, []string{"--confirm-over", "1"}, "n\n", ErrDiffsFound, estimate},
+		{"Below Limit", true, []string{"--confirm-over", "1GB"}, "n\n", ErrDiffsFound, ""},
+	}
+
+	defer func(orig func(io.Reader) bool) { isInteractiveInput = orig }(isInteractiveInput)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isInteractiveInput = func(io.Reader) bool { return tt.terminal }
+
+			stdout, stderr, err := runAppWithInput(t, strings.NewReader(tt.input), append([]string{"--no-color", "--silent"}, append(tt.args, dirA, dirB)...)...)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected error %v, got: %v", tt.expectedErr, err)
+			}
+			if stderr != tt.expectedStderr {
+				t.Errorf("expected stderr %q, got %q", tt.expectedStderr, stderr)
+			}
+			if tt.expectedErr == ErrAborted && stdout != "" {
+				t.Errorf("expected no output after aborting, got %q", stdout)
+			}
+		})
+	}
+}
+
+func TestIgnoreCaseInNames(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "README.md"), "same\n")
+	createFile(t, filepath.Join(dirB, "readme.md"), "same\n")
+	createFile(t, filepath.Join(dirA, "Docs", "Guide.txt"), "old\n")
+	createFile(t, filepath.Join(dirB, "docs", "guide.txt"), "new\n")
+	createFile(t, filepath.Join(dirA, "notes.txt"), "same\n")
+	createFile(t, filepath.Join(dirB, "notes.txt"), "same\n")
+	createFile(t, filepath.Join(dirB, "Notes.txt"), "same\n")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+	}{
+		{"Case Sensitive", nil, "- Docs/\n+ Notes.txt\n- README.md\n+ docs/\n+ readme.md\n"},
+		{"Case Insensitive", []string{"--ignore-case-in-names"}, "~ Docs/Guide.txt\n+ Notes.txt\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, stderr, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+			if tt.args != nil && !strings.Contains(stderr, "Notes.txt") {
+				t.Errorf("expected a warning about the ambiguous names, got %q", stderr)
+			}
+		})
+	}
+}
+
+func TestFilesOnly(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "same.txt"), "same\n")
+	createFile(t, filepath.Join(dirB, "same.txt"), "same\n")
+	if err := os.MkdirAll(filepath.Join(dirB, "extra", "nested"), 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	withFiles := t.TempDir()
+	createFile(t, filepath.Join(withFiles, "same.txt"), "same\n")
+	createFile(t, filepath.Join(withFiles, "new", "file.txt"), "new\n")
+
+	tests := []struct {
+		name           string
+		args           []string
+		dirB           string
+		expectedOutput string
+		expectedCode   int
+	}{
+		{"Empty Directory Reported", nil, dirB, "+ extra/\n", 3},
+		{"Empty Directory Ignored", []string{"--files-only"}, dirB, "", 0},
+		{"Files Within Reported", []string{"--files-only"}, withFiles, "+ new/file.txt\n", 3},
+		{"Dirs Only Conflict", []string{"--files-only", "--dirs-only"}, dirB, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, tt.dirB)...)
+			if code := exitCode(err); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+// flakyReader fails with err, if set, on its first read.
+type flakyReader struct {
+	io.Reader
+	err error
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		err := r.err
+		r.err = nil
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+func TestReadRetries(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	createFile(t, path, "content\n")
+	want := sha256.Sum256([]byte("content\n"))
+
+	defer func(backoff time.Duration) {
+		hashReaderHook, readRetryBackoff = nil, backoff
+	}(readRetryBackoff)
+	readRetryBackoff = 0
+
+	transient := &os.PathError{Op: "read", Path: path, Err: syscall.EIO}
+	permanent := &os.PathError{Op: "read", Path: path, Err: syscall.ENOENT}
+	tests := []struct {
+		name             string
+		retries          int
+		failures         []error
+		expectedAttempts int
+		expectedErr      error
+	}{
+		{"Transient Error Retried", 1, []error{transient}, 2, nil},
+		{"No Retries", 0, []error{transient}, 1, syscall.EIO},
+		{"Retries Exhausted", 2, []error{transient, transient, transient}, 3, syscall.EIO},
+		{"Permanent Error Not Retried", 3, []error{permanent}, 1, syscall.ENOENT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every attempt of the full hash reads the file once, the first ones fail
+			attempts := 0
+			hashReaderHook = func(r io.Reader) io.Reader {
+				attempts++
+				if attempts <= len(tt.failures) {
+					return &flakyReader{Reader: r, err: tt.failures[attempts-1]}
+				}
+				return r
+			}
+			sum, err := coreSHA(dir, "file", 0, false, TextNorm{}, HashOptions{ReadRetries: tt.retries})
+			if attempts != tt.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", tt.expectedAttempts, attempts)
+			}
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Errorf("expected error %v, got: %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if sum != hex.EncodeToString(want[:]) {
+				t.Errorf("expected the hash of the content, got %s", sum)
+			}
+		})
+	}
+}
+
+func TestProgressInterval(t *testing.T) {
+	const updates = 10000
+	tests := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"Every Update", 0},
+		{"Throttled", time.Hour},
+		{"Short Interval", time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bar := progressbar.NewOptions64(3*updates, progressbar.OptionSetWriter(io.Discard))
+			progressCh := make(chan int64)
+			go func() {
+				for range updates {
+					progressCh <- 3
+				}
+				close(progressCh)
+			}()
+			runProgress(bar, progressCh, tt.interval, func() {})
+			if got := bar.State().CurrentNum; got != 3*updates {
+				t.Errorf("expected a final count of %d, got %d", 3*updates, got)
+			}
+		})
+	}
+}
+
+func TestListUnreadable(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		createFile(t, filepath.Join(dir, "file"), "content")
+		createFile(t, filepath.Join(dir, "vanishing"), "content")
+	}
+	// a dangling symlink can't be followed, even by root
+	if err := os.Symlink("missing", filepath.Join(dirA, "dangling")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	// a file removed after the scan can't be read when comparing, even by root
+	beforeCompareHook = func() {
+		os.Remove(filepath.Join(dirB, "vanishing"))
+	}
+	defer func() { beforeCompareHook = nil }()
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "-L", "--list-unreadable", dirA, dirB)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected the errored file to count as a difference, got: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 4 || lines[0] != "! vanishing" || lines[1] != "Unreadable paths:" ||
+		!strings.HasPrefix(lines[2], "  A: dangling (") || !strings.HasPrefix(lines[3], "  vanishing (") {
+		t.Errorf("expected the dangling symlink and the vanished file to be listed, got %q", stdout)
+	}
+}
+
+func TestBlockCompare(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	content := bytes.Repeat([]byte("a"), 10*BLOCK_COMPARE_SIZE)
+	createFile(t, filepath.Join(dirA, "big"), string(content))
+	changed := bytes.Clone(content)
+	changed[3*BLOCK_COMPARE_SIZE+42] = 'b' // only the fourth block differs
+	createFile(t, filepath.Join(dirB, "big"), string(changed))
+	createFile(t, filepath.Join(dirA, "grown"), string(content[:4*BLOCK_COMPARE_SIZE]))
+	createFile(t, filepath.Join(dirB, "grown"), string(content[:4*BLOCK_COMPARE_SIZE+100]))
+	createFile(t, filepath.Join(dirA, "small"), "a")
+	createFile(t, filepath.Join(dirB, "small"), "b")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+	}{
+		{"Without Blocks", nil, "~ big\n~ grown\n~ small\n"},
+		{"Changed Blocks", []string{"--block-compare"}, "~ big (1 of 10 blocks differ, 10.0%)\n~ grown (1 of 5 blocks differ, 20.0%)\n~ small\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestSortMagnitude(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "small"), strings.Repeat("a", 100))
+	createFile(t, filepath.Join(dirB, "small"), strings.Repeat("a", 110))
+	createFile(t, filepath.Join(dirA, "large"), strings.Repeat("a", 100))
+	createFile(t, filepath.Join(dirB, "large"), strings.Repeat("a", 5000))
+	createFile(t, filepath.Join(dirB, "added"), strings.Repeat("a", 1000))
+	createFile(t, filepath.Join(dirA, "removed"), strings.Repeat("a", 20))
+	// same size, but two of four blocks differ
+	createFile(t, filepath.Join(dirA, "blocks"), strings.Repeat("a", 4*BLOCK_COMPARE_SIZE))
+	createFile(t, filepath.Join(dirB, "blocks"), strings.Repeat("b", 2*BLOCK_COMPARE_SIZE)+strings.Repeat("a", 2*BLOCK_COMPARE_SIZE))
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+	}{
+		{"Size Delta", []string{"--sort", "magnitude"}, "~ large\n+ added\n- removed\n~ small\n~ blocks\n"},
+		{"Changed Blocks", []string{"--sort", "magnitude", "--block-compare"}, "~ blocks (2 of 4 blocks differ, 50.0%)\n~ large\n+ added\n- removed\n~ small\n"},
+		{"Reversed", []string{"--sort", "magnitude", "--reverse"}, "~ blocks\n~ small\n- removed\n+ added\n~ large\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+}
+
+func TestRootVanished(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		for i := range 10 {
+			createFile(t, filepath.Join(dir, fmt.Sprintf("file%d", i)), "content")
+		}
+	}
+	// the root of B disappears after scanning, e.g. because it was unmounted
+	beforeCompareHook = func() {
+		os.RemoveAll(dirB)
+	}
+	defer func() { beforeCompareHook = nil }()
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", dirA, dirB)
+	if !errors.Is(err, ErrRootVanished) || exitCode(err) != 6 {
+		t.Fatalf("expected %v with exit code 6, got: %v", ErrRootVanished, err)
+	}
+	if !strings.Contains(err.Error(), dirB) {
+		t.Errorf("expected the error to name the vanished directory, got: %v", err)
+	}
+	if stdout != "" {
+		t.Errorf("expected no per-file errors to be printed, got %q", stdout)
+	}
+
+	// an empty side can't vanish, also if its paths are stripped
+	stdout, _, err = runApp(t, "--no-color", "--silent", "--strip-prefix-b", "x", dirA, EMPTY_PATH)
+	if exitCode(err) != 4 {
+		t.Fatalf("expected exit code 4, got: %v", err)
+	}
+	if !strings.HasPrefix(stdout, "- file0\n") {
+		t.Errorf("expected the files of A to be removed, got %q", stdout)
+	}
+}
+
+func TestFlat(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "sub", "changed.txt"), "old\n")
+	createFile(t, filepath.Join(dirB, "sub", "changed.txt"), "new\n")
+	createFile(t, filepath.Join(dirA, "same.txt"), "same\n")
+	createFile(t, filepath.Join(dirB, "same.txt"), "same\n")
+	createFile(t, filepath.Join(dirA, "gone", "file.txt"), "gone\n")
+	createFile(t, filepath.Join(dirB, "new.txt"), "new\n")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedCode   int
+	}{
+		{"Statuses", []string{"--flat"}, "D gone\nA new.txt\nM sub/changed.txt\n", 1},
+		{"Identical Listed", []string{"--flat", "--print-identical"}, "D gone\nA new.txt\nI same.txt\nM sub/changed.txt\n", 1},
+		{"Show All", []string{"--flat", "--show-all"}, "D gone\nD gone/file.txt\nA new.txt\nM sub/changed.txt\n", 1},
+		{"Tree Conflict", []string{"--flat", "--tree"}, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// colors are forced on to check that --flat never prints them
+			args := append([]string{"--color", "always", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if code := exitCode(err); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expectedCode, code, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+
+		})
+	}
+}
+
+func TestWorkerPanic(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, name := range []string{"bad", "same1", "same2"} {
+		createFile(t, filepath.Join(dirA, name), "content")
+		createFile(t, filepath.Join(dirB, name), "content")
+	}
+	createFile(t, filepath.Join(dirA, "changed"), "old")
+	createFile(t, filepath.Join(dirB, "changed"), "new")
+
+	defer func(orig func(DirNode, DirNode, string, int64, int64, int64, CompareOptions) (bool, error)) {
+		compareContent = orig
+	}(compareContent)
+	compareContent = func(nodeA, nodeB DirNode, relPath string, sizeA, sizeB, limit int64, opts CompareOptions) (bool, error) {
+		if relPath == "bad" {
+			var m map[string]int
+			m["boom"] = 1 // a nil map panics
+		}
+		return compareFileContent(nodeA, nodeB, relPath, sizeA, sizeB, limit, opts)
+	}
+
+	for _, args := range [][]string{nil, {"--file-timeout", "1m"}} {
+		stdout, _, err := runApp(t, append(append([]string{"--no-color", "--silent", "--log-file", filepath.Join(t.TempDir(), "log")}, args...), dirA, dirB)...)
+		if exitCode(err) != 1 {
+			t.Errorf("expected exit code 1 with %v, got: %v", args, err)
+		}
+		if expected := "! bad\n~ changed\n"; stdout != expected {
+			t.Errorf("expected output %q with %v, got %q", expected, args, stdout)
+		}
+	}
+}
+
+func TestQuietProgress(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for i := range 5 {
+		createFile(t, filepath.Join(dirA, fmt.Sprintf("file%d", i)), "content")
+		createFile(t, filepath.Join(dirB, fmt.Sprintf("file%d", i)), "content")
+	}
+
+	_, stderr, err := runApp(t, "--no-color", "--quiet-progress", dirA, dirB)
+	if err != nil {
+		t.Fatalf("expected identical directories, got: %v", err)
+	}
+	if strings.Contains(stderr, "\r") {
+		t.Errorf("expected no progress bar frames, got %q", stderr)
+	}
+	lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "Compared 5/5 files in ") || !strings.HasSuffix(lines[0], "s") {
+		t.Errorf("expected a single summary line, got %q", stderr)
+	}
+}
+
+func TestSudoFlags(t *testing.T) {
+	tests := []struct {
+		name                 string
+		argv                 []string
+		isRemoteA, isRemoteB bool
+		wantA, wantB         bool
+		wantErr              bool
+	}{
+		{"no flags", []string{"dirdiff", "host:/a", "host:/b"}, true, true, false, false, false},
+		{"single flag applies to both remotes", []string{"dirdiff", "--sudo", "host:/a", "host:/b"}, true, true, true, true, false},
+		{"only remote A", []string{"dirdiff", "--sudo", "host:/etc", "/backup/etc"}, true, false, true, false, false},
+		{"only remote B", []string{"dirdiff", "-s", "/etc", "host:/backup/etc"}, false, true, false, true, false},
+		{"sudo for A on a shared host", []string{"dirdiff", "--sudo", "--no-sudo", "host:/etc", "host:/backup/etc"}, true, true, true, false, false},
+		{"sudo for B on a shared host", []string{"dirdiff", "-n", "-s", "host:/etc", "host:/backup/etc"}, true, true, false, true, false},
+		{"second flag unused with one remote", []string{"dirdiff", "--no-sudo", "--sudo", "/etc", "host:/backup/etc"}, false, true, false, false, false},
+		{"flags after terminator ignored", []string{"dirdiff", "--sudo", "--", "host:/a", "--no-sudo"}, true, false, true, false, false},
+		{"too many flags", []string{"dirdiff", "--sudo", "--sudo", "--no-sudo", "host:/a", "host:/b"}, true, true, false, false, true},
+		{"flag values ignored", []string{"dirdiff", "--label-a", "-n", "--sudo", "--label-b=-s", "host:/a", "host:/b"}, true, true, true, true, false},
+	}
+	flags := newApp().Flags
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sudoA, sudoB, err := mapSudoFlags(sudoFlags(tt.argv, flags), tt.isRemoteA, tt.isRemoteB)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if sudoA != tt.wantA || sudoB != tt.wantB {
+				t.Errorf("expected sudo A=%v B=%v, got A=%v B=%v", tt.wantA, tt.wantB, sudoA, sudoB)
+			}
+		})
+	}
+}
+
+func TestReportDupes(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "original.txt"), "same content")
+	createFile(t, filepath.Join(dirA, "sub", "copy.txt"), "same content")
+	createFile(t, filepath.Join(dirA, "other.txt"), "diff content")
+	createFile(t, filepath.Join(dirA, "empty1"), "")
+	createFile(t, filepath.Join(dirA, "empty2"), "")
+	createFile(t, filepath.Join(dirB, "original.txt"), "same content")
+
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--report-dupes", dirA, dirB)
+	if code := exitCode(err); code != 4 {
+		t.Fatalf("expected exit code 4, got %d (%v)", code, err)
+	}
+	out := stdout
+	if !strings.Contains(out, "Duplicate files in A:\n  original.txt = sub/copy.txt\n") {
+		t.Errorf("expected a duplicate group in A, got:\n%s", out)
+	}
+	if strings.Contains(out, "Duplicate files in B") || strings.Contains(out, "other.txt =") || strings.Contains(out, "empty1 =") {
+		t.Errorf("expected only the identical non-empty files to be grouped, got:\n%s", out)
+	}
+
+	// files larger than the limit are only hashed sparsely, so their group is marked
+	stdout, _, _ = runApp(t, "--no-color", "--silent", "--report-dupes", "--global-limit", "6", dirA, dirB)
+	if !strings.Contains(stdout, "  original.txt = sub/copy.txt (sparsely hashed, may differ)\n") {
+		t.Errorf("expected an approximate duplicate group in A, got:\n%s", stdout)
+	}
+}
+
+func TestDuplicateGroups(t *testing.T) {
+	dir := t.TempDir()
+	createFile(t, filepath.Join(dir, "a"), "abc")
+	createFile(t, filepath.Join(dir, "b"), "abc")
+	createFile(t, filepath.Join(dir, "c"), "abd")
+	node := &countingNode{DirNode: &LocalNode{root: dir}}
+	// vanished was listed by the scan, but can't be read anymore
+	files := map[string]FileMeta{"a": {Size: 3}, "b": {Size: 3}, "c": {Size: 3}, "vanished": {Size: 3}}
+	noLimit := func(string) int64 { return 0 }
+
+	cache := newSHACache()
+	sum, err := coreSHA(dir, "a", 0, false, TextNorm{}, HashOptions{})
+	if err != nil {
+		t.Fatalf("hashing failed: %v", err)
+	}
+	cache.add(node, shaKey{"a", 0, false}, sum)
+
+	groups, failed := duplicateGroups(node, files, noLimit, false, 2, cache)
+	if len(groups) != 1 || !slices.Equal(groups[0].Paths, []string{"a", "b"}) || groups[0].Approximate {
+		t.Errorf("expected the exact group a = b, got %+v", groups)
+	}
+	if _, ok := failed["vanished"]; !ok || len(failed) != 1 {
+		t.Errorf("expected the vanished file to be skipped with its error, got %v", failed)
+	}
+	if node.reads != 3 {
+		t.Errorf("expected the cached sum of a to be reused, got %d reads", node.reads)
+	}
+}
+
+func TestSummaryBytes(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "common"), "content")
+	createFile(t, filepath.Join(dirB, "common"), "content")
+	createFile(t, filepath.Join(dirB, "big"), strings.Repeat("x", 1000000))
+	createFile(t, filepath.Join(dirB, "small"), strings.Repeat("x", 500000))
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"Human Readable", nil, "Summary: 2 added files (1.5MB)\n"},
+		{"Raw Bytes", []string{"--bytes"}, "Summary: 2 added files (1500000)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent", "--summary"}, tt.args...)
+			_, stderr, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, ErrASubsetB) {
+				t.Errorf("expected error %v, got: %v", ErrASubsetB, err)
+			}
+			if stderr != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, stderr)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "changed"), "old")
+	createFile(t, filepath.Join(dirB, "changed"), "newer")
+	createFile(t, filepath.Join(dirA, "slow"), "content")
+	createFile(t, filepath.Join(dirB, "slow"), "CONTENT")
+
+	release := make(chan struct{})
+	defer close(release)
+	defer func(orig func(DirNode, DirNode, string, int64, int64, int64, CompareOptions) (bool, error)) {
+		compareContent = orig
+	}(compareContent)
+	compareContent = func(nodeA, nodeB DirNode, relPath string, sizeA, sizeB, limit int64, opts CompareOptions) (bool, error) {
+		if relPath == "slow" {
+			<-release // slower than any timeout
+			return false, nil
+		}
+		return compareFileContent(nodeA, nodeB, relPath, sizeA, sizeB, limit, opts)
+	}
+
+	start := time.Now()
+	stdout, _, err := runApp(t, "--no-color", "--silent", "--workers", "2", "--timeout", "100ms", dirA, dirB)
+	if !errors.Is(err, ErrTimeout) || exitCode(err) != 7 {
+		t.Errorf("expected %v with exit code 7, got: %v", ErrTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the run to be aborted, took %s", elapsed)
+	}
+	// the abandoned file is neither a difference nor an error
+	if expected := "~ changed\n"; stdout != expected {
+		t.Errorf("expected the partial output %q, got %q", expected, stdout)
+	}
+
+	if _, _, err := runApp(t, "--timeout", "-1s", dirA, dirB); err == nil || !strings.Contains(err.Error(), "invalid --timeout") {
+		t.Errorf("expected a negative timeout to be rejected, got: %v", err)
+	}
+
+	// any other cancellation of the run is returned as well
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	compareContent = func(nodeA, nodeB DirNode, relPath string, sizeA, sizeB, limit int64, opts CompareOptions) (bool, error) {
+		if relPath == "slow" {
+			cancel()
+			<-release
+			return false, nil
+		}
+		return compareFileContent(nodeA, nodeB, relPath, sizeA, sizeB, limit, opts)
+	}
+	app := newApp()
+	app.Writer, app.ErrWriter = io.Discard, io.Discard
+	if err := app.Run(ctx, []string{"dirdiff", "--silent", "--workers", "2", dirA, dirB}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got: %v", context.Canceled, err)
+	}
+}
+
+func TestScanCanceled(t *testing.T) {
+	dir := t.TempDir()
+	createFile(t, filepath.Join(dir, "file"), "content")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := coreScan(ctx, dir, ScanOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled scan to stop with %v, got: %v", context.Canceled, err)
+	}
+
+	// the agent stops a scan whose cancellation arrived first, and forgets it once done
+	agent := new(RpcAgent)
+	if err := agent.CancelScan(CancelArgs{ID: 1}, &CancelReply{}); err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	reply := &ScanReply{}
+	if err := agent.Scan(ScanArgs{ID: 1, Root: dir}, reply); err != nil || !strings.Contains(reply.Error, context.Canceled.Error()) {
+		t.Errorf("expected the scan to be canceled, got %q: %v", reply.Error, err)
+	}
+	reply = &ScanReply{}
+	if err := agent.Scan(ScanArgs{ID: 2, Root: dir}, reply); err != nil || reply.Error != "" || len(reply.Files) != 1 {
+		t.Errorf("expected another scan to complete, got %+v: %v", reply, err)
+	}
+	if len(agent.scans) != 0 {
+		t.Errorf("expected no scans to be left registered, got %d", len(agent.scans))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// EMPTY_PATH is the path argument of an empty baseline, listing everything on the other side.
+const EMPTY_PATH = ":empty:"
+
+// isEmptyPath reports whether the path string names the empty baseline, :empty: or /dev/null.
+func isEmptyPath(pathStr string) bool {
+	return pathStr == EMPTY_PATH || pathStr == os.DevNull
+}
+
+// EmptyNode is a directory without any entries. Compared against it, every entry
+// of the other side is added or removed. As it has no files, their content is never
+// requested and fails like for a missing file.
+type EmptyNode struct{}
+
+func (n *EmptyNode) Scan(ctx context.Context, opts ScanOptions) (map[string]FileMeta, map[string]FileMeta, []ScanIssue, error) {
+	// the patterns are still validated, as for any other node
+	for _, patterns := range [][]string{opts.Includes, opts.Excludes, opts.IncludeDirs, opts.ExcludeDirs} {
+		if _, err := compileGlobs(patterns, opts.Glob); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return map[string]FileMeta{}, map[string]FileMeta{}, nil, nil
+}
+
+func (n *EmptyNode) StatPaths(relPaths []string, followSym bool) (map[string]FileMeta, map[string]FileMeta, error) {
+	return map[string]FileMeta{}, map[string]FileMeta{}, nil
+}
+
+func (n *EmptyNode) GetMD5(relPath string, followSym bool) (string, bool, error) {
+	return "", false, os.ErrNotExist
+}
+
+func (n *EmptyNode) GetSHA(relPath string, limit int64, followSym bool, norm TextNorm) (string, error) {
+	return "", os.ErrNotExist
+}
+
+func (n *EmptyNode) GetXattrs(relPath string, followSym bool) (map[string]string, error) {
+	return nil, os.ErrNotExist
+}
+
+func (n *EmptyNode) GetSparseLayout(relPath string, followSym bool) (string, error) {
+	return "", os.ErrNotExist
+}
+
+// AttrsSupported is true since the empty directory has no entries whose attributes could differ.
+func (n *EmptyNode) AttrsSupported() bool { return true }
+
+func (n *EmptyNode) Close() error { return nil }
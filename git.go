@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// GIT_SCHEME prefixes path arguments naming a git ref of the repository in the working directory.
+const GIT_SCHEME = "git:"
+
+// isGitPath reports whether the path string has the form git:<ref>.
+func isGitPath(pathStr string) bool {
+	return strings.HasPrefix(pathStr, GIT_SCHEME)
+}
+
+// GitNode reads the tree of a git ref without checking it out.
+// Submodules are compared by their commit id only. Symlinks are stored as blobs
+// holding the target and are hashed like unfollowed symlinks of a LocalNode,
+// regardless of followSym.
+type GitNode struct {
+	ctx      context.Context
+	ref      string
+	hashOpts HashOptions
+}
+
+// NewGitNode creates a GitNode for a ref of the repository in the working directory,
+// hashing blobs with hashOpts.
+func NewGitNode(ctx context.Context, ref string, hashOpts HashOptions) (*GitNode, error) {
+	n := &GitNode{ctx: ctx, ref: ref, hashOpts: hashOpts}
+	if _, err := n.git("rev-parse", "--verify", "--quiet", ref+"^{tree}"); err != nil {
+		return nil, fmt.Errorf("invalid git ref %q: %w", ref, err)
+	}
+	return n, nil
+}
+
+// git runs a git command and returns its stdout.
+func (n *GitNode) git(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(n.ctx, "git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// SUBMODULE_PREFIX precedes the commit id in the Special field of a submodule entry.
+const SUBMODULE_PREFIX = "submodule "
+
+// isSubmodule reports whether an entry is a git submodule rather than a special file.
+func isSubmodule(meta FileMeta) bool {
+	return strings.HasPrefix(meta.Special, SUBMODULE_PREFIX)
+}
+
+// listTree returns all entries of the ref's tree. Git doesn't record modification times.
+func (n *GitNode) listTree() (map[string]FileMeta, map[string]FileMeta, error) {
+	out, err := n.git("ls-tree", "-r", "-t", "-z", "--long", "--full-tree", n.ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]FileMeta)
+	dirs := make(map[string]FileMeta)
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		if len(entry) == 0 {
+			continue
+		}
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		info, relPath, ok := strings.Cut(string(entry), "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 4 {
+			return nil, nil, fmt.Errorf("unexpected git ls-tree output %q", entry)
+		}
+		switch fields[1] {
+		case "tree":
+			dirs[relPath] = FileMeta{}
+		case "commit":
+			files[relPath] = FileMeta{Special: SUBMODULE_PREFIX + fields[2]}
+		default:
+			size, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unexpected git ls-tree output %q", entry)
+			}
+			files[relPath] = FileMeta{Size: size}
+		}
+	}
+	return files, dirs, nil
+}
+
+// Scan lists the ref's tree, applying the patterns like coreScan: excluded
+// directories are pruned, includes only restrict files and includeDirs select subtrees.
+// With NoRecurse, only the top level of the tree is listed.
+// The tree is listed by a git command bound to the context of the node.
+func (n *GitNode) Scan(ctx context.Context, opts ScanOptions) (map[string]FileMeta, map[string]FileMeta, []ScanIssue, error) {
+	var globs [4][]glob.Glob
+	for i, patterns := range [][]string{opts.Includes, opts.Excludes, opts.IncludeDirs, opts.ExcludeDirs} {
+		g, err := compileGlobs(patterns, opts.Glob)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		globs[i] = g
+	}
+	incGlobs, excGlobs, incDirGlobs, excDirGlobs := globs[0], globs[1], globs[2], globs[3]
+
+	files, dirs, err := n.listTree()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// keep reports whether a path is selected, given the directory containing it (or itself)
+	keep := func(relPath, dir string) bool {
+		for p := relPath; p != "."; p = path.Dir(p) {
+			if matchesAny(excGlobs, p, false) {
+				return false
+			}
+		}
+		dirIncluded := len(incDirGlobs) == 0
+		for d := dir; d != "."; d = path.Dir(d) {
+			if matchesAny(excDirGlobs, d, false) {
+				return false
+			}
+			dirIncluded = dirIncluded || matchesAny(incDirGlobs, d, false)
+		}
+		return dirIncluded
+	}
+
+	for d := range dirs {
+		if !keep(d, d) || opts.NoRecurse && strings.Contains(d, "/") {
+			delete(dirs, d)
+		}
+	}
+	for relPath := range files {
+		if !keep(relPath, path.Dir(relPath)) || !matchesAny(incGlobs, relPath, true) || opts.NoRecurse && strings.Contains(relPath, "/") {
+			delete(files, relPath)
+		}
+	}
+	return files, dirs, nil, nil
+}
+
+func (n *GitNode) StatPaths(relPaths []string, followSym bool) (map[string]FileMeta, map[string]FileMeta, error) {
+	allFiles, allDirs, err := n.listTree()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]FileMeta)
+	dirs := make(map[string]FileMeta)
+	for _, relPath := range relPaths {
+		if meta, ok := allFiles[relPath]; ok {
+			files[relPath] = meta
+		} else if meta, ok := allDirs[relPath]; ok {
+			dirs[relPath] = meta
+		}
+	}
+	return files, dirs, nil
+}
+
+// blob returns the content of a file of the ref.
+func (n *GitNode) blob(relPath string) ([]byte, error) {
+	return n.git("cat-file", "blob", n.ref+":"+relPath)
+}
+
+func (n *GitNode) GetMD5(relPath string, followSym bool) (string, bool, error) {
+	data, err := n.blob(relPath)
+	if err != nil {
+		return "", false, err
+	}
+	sum, err := sparseHashFile(bytes.NewReader(data), int64(len(data)), md5.New(), 1024, n.hashOpts)
+	return sum, looksBinary(data[:min(len(data), SNIFF_SIZE)]), err
+}
+
+func (n *GitNode) GetSHA(relPath string, limit int64, followSym bool, norm TextNorm) (string, error) {
+	data, err := n.blob(relPath)
+	if err != nil {
+		return "", err
+	}
+	if n.hashOpts.HashCmd != "" {
+		return commandHash(bytes.NewReader(data), n.hashOpts.HashCmd)
+	}
+	if norm.Enabled() && !looksBinary(data[:min(len(data), SNIFF_SIZE)]) {
+		return normalizedHash(data, sha256.New(), norm)
+	}
+	return sparseHashFile(bytes.NewReader(data), int64(len(data)), sha256.New(), limit, n.hashOpts)
+}
+
+// normalizedHash hashes the normalized content of a text blob.
+func normalizedHash(data []byte, h hash.Hash, norm TextNorm) (string, error) {
+	if err := copyNormalized(h, bufio.NewReader(bytes.NewReader(data)), norm); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (n *GitNode) GetXattrs(relPath string, followSym bool) (map[string]string, error) {
+	return nil, ErrXattrUnsupported
+}
+
+func (n *GitNode) GetSparseLayout(relPath string, followSym bool) (string, error) {
+	return "", ErrSparseUnsupported
+}
+
+// AttrsSupported is false since git doesn't record file attributes.
+func (n *GitNode) AttrsSupported() bool { return false }
+
+func (n *GitNode) Close() error { return nil }
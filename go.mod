@@ -7,9 +7,11 @@ toolchain go1.24.7
 require (
 	github.com/docker/go-units v0.5.0
 	github.com/fatih/color v1.18.0
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/gobwas/glob v0.2.3
 	github.com/schollz/progressbar/v3 v3.18.0
 	github.com/urfave/cli/v3 v3.6.1
+	golang.org/x/sys v0.29.0
 	golang.org/x/term v0.28.0
 )
 
@@ -18,5 +20,4 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.29.0 // indirect
 )
@@ -0,0 +1,53 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashCmd(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "readme.txt"), "Hello World\n")
+	createFile(t, filepath.Join(dirB, "readme.txt"), "hello world\n")
+	createFile(t, filepath.Join(dirA, "other.txt"), "abc\n")
+	createFile(t, filepath.Join(dirB, "other.txt"), "ABD\n")
+
+	script := filepath.Join(t.TempDir(), "lowercase")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ntr 'A-Z' 'a-z'\n"), 0755); err != nil {
+		t.Fatalf("failed to create hash command: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+	}{
+		{"Content Hashed", nil, "~ other.txt\n~ readme.txt\n"},
+		{"Lowercased", []string{"--hash-cmd", script}, "~ other.txt\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--no-color", "--silent"}, tt.args...)
+			stdout, _, err := runApp(t, append(args, dirA, dirB)...)
+			if !errors.Is(err, ErrDiffsFound) {
+				t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+			}
+			if stdout != tt.expectedOutput {
+				t.Errorf("expected output %q, got %q", tt.expectedOutput, stdout)
+			}
+		})
+	}
+
+	// the output of the command decides, so the content class can't be detected
+	for _, flag := range []string{"--only-text", "--only-binary"} {
+		_, _, err := runApp(t, "--silent", "--hash-cmd", script, flag, dirA, dirB)
+		if err == nil || !strings.Contains(err.Error(), "--hash-cmd can't be combined") {
+			t.Errorf("expected --hash-cmd with %s to be rejected, got: %v", flag, err)
+		}
+	}
+}
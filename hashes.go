@@ -1,46 +1,352 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
+	"log/slog"
+	"math"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/docker/go-units"
 )
 
-func coreMD5(rootDir, relPath string, followSym bool) (string, error) {
+// SNIFF_SIZE is the number of leading bytes inspected to detect binary files.
+const SNIFF_SIZE = 8000
+
+// BYTEWISE_BLOCK is the size of the blocks compared by --bytewise.
+const BYTEWISE_BLOCK = 64 * 1024
+
+// HashOptions select how file contents are read for hashing. They are sent along
+// with every hash request, so an agent hashes with the options of its master.
+type HashOptions struct {
+	BufferSize   int    // --buffer-size files are read with, 0 uses the default of io.Copy
+	SparseChunks int    // --sparse-chunks read by a sparse hash, 0 reads DEFAULT_SPARSE_CHUNKS
+	HashCmd      string // --hash-cmd program whose output replaces the content hash, empty to hash internally
+	ReadRetries  int    // --read-retries of a read failing with a transient error
+}
+
+// DEFAULT_SPARSE_CHUNKS is the number of chunks read by a sparse hash unless --sparse-chunks is given.
+const DEFAULT_SPARSE_CHUNKS = 3
+
+// parseBufferSize parses a --buffer-size, e.g. "1MB". An empty size is 0, the default.
+func parseBufferSize(size string) (int, error) {
+	if size == "" {
+		return 0, nil
+	}
+	n, err := units.RAMInBytes(size)
+	if err != nil || n <= 0 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid --buffer-size %q", size)
+	}
+	return int(n), nil
+}
+
+// readRetryBackoff is the wait before the first retry of a read, doubling with every further retry.
+var readRetryBackoff = 50 * time.Millisecond
+
+// isTransient reports whether a read error may go away if the read is repeated,
+// e.g. an I/O error or timeout of a network filesystem, unlike a missing file.
+func isTransient(err error) bool {
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, syscall.ESTALE)
+}
+
+// withReadRetries calls read, repeating it up to retries times with a backoff
+// while it fails with a transient error.
+func withReadRetries[T any](retries int, read func() (T, error)) (T, error) {
+	backoff := readRetryBackoff
+	for attempt := 1; ; attempt++ {
+		v, err := read()
+		if err == nil || attempt > retries || !isTransient(err) {
+			return v, err
+		}
+		slog.Debug("retrying read", "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// hashCmdSlots bounds the number of --hash-cmd processes running at once.
+var hashCmdSlots = make(chan struct{}, runtime.NumCPU())
+
+// checkHashCmd checks that a --hash-cmd splits into shell words, an empty one hashes internally.
+func checkHashCmd(cmdline string) error {
+	if words, err := splitShellWords(cmdline); err != nil || (cmdline != "" && len(words) == 0) {
+		return fmt.Errorf("invalid --hash-cmd %q", cmdline)
+	}
+	return nil
+}
+
+// commandHash pipes r to the --hash-cmd cmdline, split like shell words, and returns the SHA256 of its output.
+func commandHash(r io.Reader, cmdline string) (string, error) {
+	words, err := splitShellWords(cmdline)
+	if err != nil || len(words) == 0 {
+		return "", fmt.Errorf("invalid --hash-cmd %q", cmdline)
+	}
+	hashCmdSlots <- struct{}{}
+	defer func() { <-hashCmdSlots }()
+
+	h := sha256.New()
+	var stderr bytes.Buffer
+	cmd := exec.Command(words[0], words[1:]...)
+	cmd.Stdin = r
+	cmd.Stdout = h
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("--hash-cmd failed: %w: %s", err, msg)
+		}
+		return "", fmt.Errorf("--hash-cmd failed: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// computeCommandHash hashes the output of the --hash-cmd cmdline for the content of a file.
+func computeCommandHash(path string, followSym bool, cmdline string) (string, error) {
+	r, closeFile, err := openContent(path, followSym)
+	if err != nil {
+		return "", err
+	}
+	defer closeFile()
+	return commandHash(r, cmdline)
+}
+
+// hashReaderHook wraps every reader copied by copyToHash, if set (for testing purposes).
+var hashReaderHook func(r io.Reader) io.Reader
+
+// hashBuffers recycles the --buffer-size buffers of copyToHash.
+var hashBuffers sync.Pool
+
+// getHashBuffer returns a recycled buffer of the given size or allocates one.
+func getHashBuffer(size int) *[]byte {
+	if buf, ok := hashBuffers.Get().(*[]byte); ok && len(*buf) == size {
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// copyToHash copies n bytes of r into h, or all of r if n is negative,
+// through a buffer of bufferSize. Like io.CopyN, a short copy is an io.EOF.
+func copyToHash(h hash.Hash, r io.Reader, n int64, bufferSize int) error {
+	if hashReaderHook != nil {
+		r = hashReaderHook(r)
+	}
+	if n >= 0 {
+		r = io.LimitReader(r, n)
+	}
+	var written int64
+	var err error
+	if bufferSize > 0 {
+		buf := getHashBuffer(bufferSize)
+		defer hashBuffers.Put(buf)
+		// hiding a WriterTo, e.g. of *os.File, makes io.CopyBuffer use the buffer
+		written, err = io.CopyBuffer(h, struct{ io.Reader }{r}, *buf)
+	} else {
+		written, err = io.Copy(h, r)
+	}
+	if err == nil && n >= 0 && written < n {
+		err = io.EOF
+	}
+	return err
+}
+
+// coreMD5 computes the quick sparse MD5 of a file and reports whether it looks binary.
+func coreMD5(rootDir, relPath string, followSym bool, opts HashOptions) (string, bool, error) {
 	fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
-	return computeSparseHash(fullPath, md5.New(), 1024, followSym)
+	var binary bool
+	sum, err := withReadRetries(opts.ReadRetries, func() (string, error) {
+		var err error
+		var sum string
+		sum, binary, err = computeSniffedSparseHash(fullPath, md5.New(), 1024, followSym, opts)
+		return sum, err
+	})
+	return sum, binary, err
 }
 
-func coreSHA(rootDir, relPath string, limit int64, followSym bool) (string, error) {
+func coreSHA(rootDir, relPath string, limit int64, followSym bool, norm TextNorm, opts HashOptions) (string, error) {
 	fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
-	return computeSparseHash(fullPath, sha256.New(), limit, followSym)
+	return withReadRetries(opts.ReadRetries, func() (string, error) {
+		if opts.HashCmd != "" {
+			return computeCommandHash(fullPath, followSym, opts.HashCmd)
+		}
+		if norm.Enabled() {
+			return computeNormalizedHash(fullPath, sha256.New(), limit, followSym, norm, opts)
+		}
+		return computeSparseHash(fullPath, sha256.New(), limit, followSym, opts)
+	})
+}
+
+// ErrXattrUnsupported is returned if extended attributes can't be read on this platform or filesystem.
+var ErrXattrUnsupported = errors.New("extended attributes are not supported")
+
+func coreXattrs(rootDir, relPath string, followSym bool) (map[string]string, error) {
+	fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
+	return readXattrs(fullPath, followSym)
+}
+
+// ErrSparseUnsupported is returned if holes in files can't be detected on this platform or filesystem.
+var ErrSparseUnsupported = errors.New("sparse files are not supported")
+
+func coreSparseLayout(rootDir, relPath string, followSym bool) (string, error) {
+	fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
+	return readSparseLayout(fullPath, followSym)
+}
+
+// TextNorm selects the normalizations applied to text files before hashing.
+type TextNorm struct {
+	EOL        bool // treat CRLF and LF line endings as equal
+	TrailingWS bool // ignore trailing whitespace of each line
+	BOM        bool // ignore a leading UTF-8 byte order mark
+}
+
+// Enabled reports whether any normalization is selected.
+func (n TextNorm) Enabled() bool {
+	return n.EOL || n.TrailingWS || n.BOM
+}
+
+// looksBinary reports whether the sniffed beginning of a file contains a NUL byte
+// or is not valid UTF-8. A multi-byte rune cut off by the sniff window is ignored.
+func looksBinary(head []byte) bool {
+	if bytes.IndexByte(head, 0) != -1 {
+		return true
+	}
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		if len(head) < SNIFF_SIZE {
+			return true // the whole file was sniffed, nothing was cut off
+		}
+		head = head[:len(head)-1]
+	}
+	return !utf8.Valid(head)
+}
+
+// ContentClass restricts the comparison to text or binary files.
+type ContentClass int
+
+const (
+	ClassAny ContentClass = iota
+	ClassText
+	ClassBinary
+)
+
+// computeNormalizedHash hashes the full normalized content of a text file.
+// Binary files bypass the normalization and are hashed by computeSparseHash.
+func computeNormalizedHash(path string, h hash.Hash, limit int64, followSym bool, norm TextNorm, opts HashOptions) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 && !followSym {
+		return computeSparseHash(path, h, limit, followSym, opts)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, SNIFF_SIZE)
+	head, err := r.Peek(SNIFF_SIZE)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if looksBinary(head) {
+		return computeSparseHash(path, h, limit, followSym, opts)
+	}
+
+	if err := copyNormalized(h, r, norm); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// utf8BOM is the byte order mark some editors put at the beginning of UTF-8 text.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// copyNormalized copies r to w line by line, stripping a leading byte order mark,
+// carriage returns before line feeds and/or trailing whitespace depending on norm.
+func copyNormalized(w io.Writer, r *bufio.Reader, norm TextNorm) error {
+	if norm.BOM {
+		if head, _ := r.Peek(len(utf8BOM)); bytes.Equal(head, utf8BOM) {
+			r.Discard(len(utf8BOM))
+		}
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			hasLF := line[len(line)-1] == '\n'
+			if hasLF {
+				line = line[:len(line)-1]
+			}
+			if norm.TrailingWS {
+				line = bytes.TrimRight(line, " \t\r")
+			} else if norm.EOL && hasLF {
+				line = bytes.TrimSuffix(line, []byte{'\r'})
+			}
+			if hasLF {
+				line = append(line, '\n')
+			}
+			if _, werr := w.Write(line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 // computeSparseHash computes a sparse hash of a file if the file size is greater than the limit.
 // It reads roughly 1/3 of the file from the beginning, middle, and end.
-func computeSparseHash(path string, h hash.Hash, limit int64, followSym bool) (string, error) {
+func computeSparseHash(path string, h hash.Hash, limit int64, followSym bool, opts HashOptions) (string, error) {
+	sum, _, err := computeSniffedSparseHash(path, h, limit, followSym, opts)
+	return sum, err
+}
+
+// computeSniffedSparseHash is computeSparseHash that additionally reports whether
+// the file looks binary, reusing the already opened file for sniffing.
+// Symlinks that are not followed are hashed by their target and never binary.
+func computeSniffedSparseHash(path string, h hash.Hash, limit int64, followSym bool, opts HashOptions) (string, bool, error) {
 	info, err := os.Lstat(path)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	// If it's a symlink and we aren't following it, hash the target path string instead.
 	if info.Mode()&os.ModeSymlink != 0 && !followSym {
 		target, err := os.Readlink(path)
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
 		h.Write([]byte(target))
-		return hex.EncodeToString(h.Sum(nil)), nil
+		return hex.EncodeToString(h.Sum(nil)), false, nil
 	}
 
 	f, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	defer f.Close()
 
@@ -53,31 +359,192 @@ func computeSparseHash(path string, h hash.Hash, limit int64, followSym bool) (s
 		}
 	}
 
+	head := make([]byte, min(fileSize, SNIFF_SIZE))
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	binary := looksBinary(head[:n])
+
+	sum, err := sparseHashFile(f, fileSize, h, limit, opts)
+	return sum, binary, err
+}
+
+// sparseHashFile hashes an opened file from its beginning, sparsely if its size exceeds the limit.
+// A sparse hash reads opts.SparseChunks evenly spaced chunks, from the beginning to the end of the
+// file, which add up to the limit. A single chunk is just the beginning.
+func sparseHashFile(f io.ReadSeeker, fileSize int64, h hash.Hash, limit int64, opts HashOptions) (string, error) {
 	if limit <= 0 || fileSize <= limit {
-		if _, err := io.Copy(h, f); err != nil {
+		if err := copyToHash(h, f, -1, opts.BufferSize); err != nil {
 			return "", err
 		}
 		return hex.EncodeToString(h.Sum(nil)), nil
 	}
 
-	chunkSize := limit / 3
-	lastChunkSize := limit - (chunkSize * 2)
-
-	if _, err := io.CopyN(h, f, chunkSize); err != nil {
-		return "", err
+	chunks := int64(opts.SparseChunks)
+	if chunks == 0 {
+		chunks = DEFAULT_SPARSE_CHUNKS
 	}
-	if _, err := f.Seek((fileSize/2)-(chunkSize/2), io.SeekStart); err != nil {
-		return "", err
+	chunks = min(chunks, limit)
+	if chunks <= 1 {
+		if err := copyToHash(h, f, limit, opts.BufferSize); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
 	}
-	if _, err := io.CopyN(h, f, chunkSize); err != nil {
+
+	chunkSize := limit / chunks
+	lastChunkSize := limit - (chunkSize * (chunks - 1))
+
+	if err := copyToHash(h, f, chunkSize, opts.BufferSize); err != nil {
 		return "", err
 	}
+	// the inner chunks are centered on evenly spaced points, e.g. the middle for three chunks
+	for i := int64(1); i < chunks-1; i++ {
+		if _, err := f.Seek((fileSize*i/(chunks-1))-(chunkSize/2), io.SeekStart); err != nil {
+			return "", err
+		}
+		if err := copyToHash(h, f, chunkSize, opts.BufferSize); err != nil {
+			return "", err
+		}
+	}
 	if _, err := f.Seek(fileSize-lastChunkSize, io.SeekStart); err != nil {
 		return "", err
 	}
-	if _, err := io.CopyN(h, f, lastChunkSize); err != nil {
+	if err := copyToHash(h, f, lastChunkSize, opts.BufferSize); err != nil {
 		return "", err
 	}
 
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
+
+// compareLocalFiles compares two local files block by block and stops at the first difference.
+// Like hashing, a symlink which isn't followed is compared by its target path.
+func compareLocalFiles(pathA, pathB string, followSym bool) (bool, error) {
+	rA, closeA, err := openContent(pathA, followSym)
+	if err != nil {
+		return false, err
+	}
+	defer closeA()
+	rB, closeB, err := openContent(pathB, followSym)
+	if err != nil {
+		return false, err
+	}
+	defer closeB()
+	return compareReaders(rA, rB)
+}
+
+// openContent opens the content of a file, or the target of a symlink which isn't followed.
+func openContent(path string, followSym bool) (io.Reader, func() error, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 && !followSym {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bytes.NewReader([]byte(target)), func() error { return nil }, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// compareReaders reports whether both readers yield the same bytes, reading only
+// up to the first block which differs.
+func compareReaders(rA, rB io.Reader) (bool, error) {
+	offset, err := firstDifference(rA, rB)
+	return offset < 0, err
+}
+
+// firstDifference returns the offset of the first byte in which both readers differ,
+// including where the shorter one ends, or -1 if they yield the same bytes.
+func firstDifference(rA, rB io.Reader) (int64, error) {
+	bufA := make([]byte, BYTEWISE_BLOCK)
+	bufB := make([]byte, BYTEWISE_BLOCK)
+	var offset int64
+	for {
+		nA, errA := io.ReadFull(rA, bufA)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return 0, errA
+		}
+		nB, errB := io.ReadFull(rB, bufB)
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return 0, errB
+		}
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			i := 0
+			for i < min(nA, nB) && bufA[i] == bufB[i] {
+				i++
+			}
+			return offset + int64(i), nil
+		}
+		if nA < BYTEWISE_BLOCK {
+			return -1, nil
+		}
+		offset += int64(nA)
+	}
+}
+
+// firstLocalDifference returns the offset of the first differing byte of two local files,
+// or -1 if they are equal. Like hashing, a symlink which isn't followed is read as its target.
+func firstLocalDifference(pathA, pathB string, followSym bool) (int64, error) {
+	rA, closeA, err := openContent(pathA, followSym)
+	if err != nil {
+		return 0, err
+	}
+	defer closeA()
+	rB, closeB, err := openContent(pathB, followSym)
+	if err != nil {
+		return 0, err
+	}
+	defer closeB()
+	return firstDifference(rA, rB)
+}
+
+// BLOCK_COMPARE_SIZE is the size of the blocks compared by --block-compare.
+const BLOCK_COMPARE_SIZE = 64 * 1024
+
+// blockDifferences compares both readers block by block and returns how many blocks differ
+// out of the blocks of the longer one. Blocks beyond the end of the shorter one differ.
+func blockDifferences(rA, rB io.Reader, blockSize int) (changed, total int64, err error) {
+	bufA := make([]byte, blockSize)
+	bufB := make([]byte, blockSize)
+	for {
+		nA, errA := io.ReadFull(rA, bufA)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return 0, 0, errA
+		}
+		nB, errB := io.ReadFull(rB, bufB)
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return 0, 0, errB
+		}
+		if nA == 0 && nB == 0 {
+			return changed, total, nil
+		}
+		total++
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			changed++
+		}
+	}
+}
+
+// localBlockDifferences counts the differing blocks of two local files.
+// Like hashing, a symlink which isn't followed is read as its target.
+func localBlockDifferences(pathA, pathB string, followSym bool) (int64, int64, error) {
+	rA, closeA, err := openContent(pathA, followSym)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closeA()
+	rB, closeB, err := openContent(pathB, followSym)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closeB()
+	return blockDifferences(rA, rB, BLOCK_COMPARE_SIZE)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode is not supported on this platform.
+func fileInode(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+// fileRdev is not supported on this platform.
+func fileRdev(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/fatih/color"
+	"golang.org/x/term"
+)
+
+// MAX_PREVIEW_BYTES is the largest file shown as a text diff by --interactive.
+const MAX_PREVIEW_BYTES = 1024 * 1024
+
+// MAX_PREVIEW_LINES is the largest number of lines per side shown as a text diff by --interactive.
+const MAX_PREVIEW_LINES = 5000
+
+// isInteractiveInput reports whether commands can be read from r, i.e. r is a terminal.
+// It is a variable so tests can feed scripted input.
+var isInteractiveInput = func(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// confirm asks question on w and reports whether the answer read from r is yes.
+// Anything else, including end of input, declines.
+func confirm(r io.Reader, w io.Writer, question string) bool {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// keyReader reads single-key commands, from a terminal in raw mode without waiting for enter.
+type keyReader struct {
+	r  *bufio.Reader
+	fd int // -1 if the input is not a terminal
+}
+
+func newKeyReader(r io.Reader) *keyReader {
+	kr := &keyReader{r: bufio.NewReader(r), fd: -1}
+	if f, ok := r.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		kr.fd = int(f.Fd())
+	}
+	return kr
+}
+
+// readKey returns the next key, skipping whitespace. Ctrl-C and Ctrl-D read as q.
+func (kr *keyReader) readKey() (byte, error) {
+	if kr.fd >= 0 {
+		if state, err := term.MakeRaw(kr.fd); err == nil {
+			defer term.Restore(kr.fd, state)
+		}
+	}
+	for {
+		b, err := kr.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case 3, 4:
+			return 'q', nil
+		}
+		return b, nil
+	}
+}
+
+// reviewModified steps through the modified files of results, reading a command per file from r:
+// (v)iew a diff of the file, (s)kip it or (q)uit. End of input quits as well.
+func reviewModified(r io.Reader, w io.Writer, results []DiffItem, nodeA, nodeB DirNode, followSym bool) {
+	var modified []DiffItem
+	for _, item := range results {
+		if item.Type == Modified && !item.IsDir {
+			modified = append(modified, item)
+		}
+	}
+	keys := newKeyReader(r)
+	yellow := color.New(color.FgYellow).FprintfFunc()
+
+	for i, item := range modified {
+		var key byte
+		for key != 'v' && key != 's' && key != 'q' {
+			yellow(w, "[%d/%d] ~ %s", i+1, len(modified), item.Path)
+			fmt.Fprint(w, " (v)iew diff, (s)kip, (q)uit? ")
+			b, err := keys.readKey()
+			if err != nil {
+				fmt.Fprintln(w)
+				return
+			}
+			fmt.Fprintf(w, "%c\n", b)
+			key = byte(unicode.ToLower(rune(b)))
+		}
+		switch key {
+		case 'v':
+			printPreview(w, nodeA, nodeB, item.Path, followSym)
+		case 'q':
+			return
+		}
+	}
+}
+
+// printPreview prints a line diff of a file of both sides, if it is local, text and not too large.
+func printPreview(w io.Writer, nodeA, nodeB DirNode, relPath string, followSym bool) {
+	contentA, errA := readPreview(nodeA, relPath, followSym)
+	contentB, errB := readPreview(nodeB, relPath, followSym)
+	if errA != nil || errB != nil {
+		fmt.Fprintf(w, "  (no preview: %v)\n", firstError(errA, errB))
+		return
+	}
+	if bytes.IndexByte(contentA, 0) >= 0 || bytes.IndexByte(contentB, 0) >= 0 {
+		fmt.Fprintln(w, "  (binary files differ)")
+		return
+	}
+
+	linesA, linesB := splitLines(contentA), splitLines(contentB)
+	if len(linesA) > MAX_PREVIEW_LINES || len(linesB) > MAX_PREVIEW_LINES {
+		fmt.Fprintf(w, "  (no preview: more than %d lines)\n", MAX_PREVIEW_LINES)
+		return
+	}
+
+	red := color.New(color.FgRed).FprintfFunc()
+	green := color.New(color.FgGreen).FprintfFunc()
+	for _, line := range lineDiff(linesA, linesB) {
+		switch line[0] {
+		case '-':
+			red(w, "%s\n", line)
+		case '+':
+			green(w, "%s\n", line)
+		default:
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// readPreview reads a file of a local node for a preview.
+func readPreview(node DirNode, relPath string, followSym bool) ([]byte, error) {
+	path, ok := localPath(node, relPath)
+	if !ok {
+		return nil, fmt.Errorf("not a local file")
+	}
+	content, closeContent, err := openContent(path, followSym)
+	if err != nil {
+		return nil, err
+	}
+	defer closeContent()
+	data, err := io.ReadAll(io.LimitReader(content, MAX_PREVIEW_BYTES+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_PREVIEW_BYTES {
+		return nil, fmt.Errorf("larger than %d bytes", MAX_PREVIEW_BYTES)
+	}
+	return data, nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// lineDiff returns the lines of a and b prefixed by "-" if only in a,
+// "+" if only in b and " " if in both, along their longest common subsequence.
+// The subsequence is found with Hirschberg's algorithm in space linear in the number of lines.
+func lineDiff(a, b []string) []string {
+	var lines []string
+	diffLines(a, b, &lines)
+	return lines
+}
+
+// diffLines appends the diff of a and b to lines, splitting a in halves and b where
+// the common subsequences of both halves are longest together.
+func diffLines(a, b []string, lines *[]string) {
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			*lines = append(*lines, "+"+line)
+		}
+		return
+	case len(b) == 0:
+		for _, line := range a {
+			*lines = append(*lines, "-"+line)
+		}
+		return
+	case len(a) == 1:
+		k := slices.Index(b, a[0])
+		if k < 0 {
+			*lines = append(*lines, "-"+a[0])
+			diffLines(nil, b, lines)
+			return
+		}
+		diffLines(nil, b[:k], lines)
+		*lines = append(*lines, " "+a[0])
+		diffLines(nil, b[k+1:], lines)
+		return
+	}
+
+	mid := len(a) / 2
+	forward := lcsLengths(a[:mid], b)
+	backward := lcsLengths(reversed(a[mid:]), reversed(b))
+	split, longest := 0, -1
+	for j := range len(b) + 1 {
+		if n := forward[j] + backward[len(b)-j]; n > longest {
+			split, longest = j, n
+		}
+	}
+	diffLines(a[:mid], b[:split], lines)
+	diffLines(a[mid:], b[split:], lines)
+}
+
+// lcsLengths returns the length of the longest common subsequence of a and b[:j] for every j.
+func lcsLengths(a, b []string) []int {
+	row := make([]int, len(b)+1)
+	for _, line := range a {
+		diag := 0 // row[j-1] of the previous line of a
+		for j := 1; j <= len(b); j++ {
+			prev := row[j]
+			if line == b[j-1] {
+				row[j] = diag + 1
+			} else {
+				row[j] = max(row[j], row[j-1])
+			}
+			diag = prev
+		}
+	}
+	return row
+}
+
+func reversed(lines []string) []string {
+	r := slices.Clone(lines)
+	slices.Reverse(r)
+	return r
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+// parseLogLevel returns the log level selected by --log-level and --verbose.
+// Without --log-level, --verbose selects debug and warnings are logged otherwise.
+func parseLogLevel(cmd *cli.Command) (slog.Level, error) {
+	levelStr := cmd.String("log-level")
+	if levelStr == "" {
+		if cmd.Bool("verbose") {
+			return slog.LevelDebug, nil
+		}
+		return slog.LevelWarn, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(levelStr))); err != nil {
+		return 0, fmt.Errorf("invalid --log-level %q", levelStr)
+	}
+	return level, nil
+}
+
+// setupLogger installs the default slog logger writing to --log-file or cmd.ErrWriter.
+// The returned closer must be called once logging is done, it restores the previous
+// default logger before closing the log file.
+func setupLogger(cmd *cli.Command, level slog.Level) (io.Closer, error) {
+	if cmd.Bool("quiet") {
+		level = slog.LevelError
+	}
+
+	var w io.Writer = cmd.ErrWriter
+	var file *os.File
+	if logFile := cmd.String("log-file"); logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		w, file = f, f
+	}
+
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})))
+	return loggerCloser{prev: prev, file: file}, nil
+}
+
+// loggerCloser restores the default logger replaced by setupLogger and closes its log file.
+type loggerCloser struct {
+	prev *slog.Logger
+	file *os.File
+}
+
+func (c loggerCloser) Close() error {
+	slog.SetDefault(c.prev)
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
@@ -7,27 +7,42 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/rpc"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type PingArgs struct{}
-type PingReply struct{ Status string }
+type PingReply struct {
+	Status         string
+	AttrsSupported bool // the agent's scan reads file attributes
+}
 
 type ScanArgs struct {
+	ID      uint64 // identifies the scan to RpcAgent.CancelScan
+	Root    string
+	Options ScanOptions
+}
+
+type CancelArgs struct{ ID uint64 }
+type CancelReply struct{}
+
+type PathsArgs struct {
 	Root      string
-	Includes  []string
-	Excludes  []string
+	RelPaths  []string
 	FollowSym bool
 }
 
 type ScanReply struct {
-	Files map[string]int64
-	Dirs  []string
-	Error string
+	Files  map[string]FileMeta
+	Dirs   map[string]FileMeta
+	Issues []ScanIssue
+	Error  string
 }
 
 type HashArgs struct {
@@ -35,67 +50,242 @@ type HashArgs struct {
 	RelPath   string
 	Limit     int64
 	FollowSym bool
+	Norm      TextNorm
+	Options   HashOptions
 }
 
 type HashReply struct {
-	Hash  string
-	Error string
+	Hash   string
+	Binary bool
+	Error  string
+}
+
+type BatchHashArgs struct {
+	Root      string
+	RelPaths  []string
+	Limit     int64
+	FollowSym bool
+	Norm      TextNorm
+	Options   HashOptions
+}
+
+// BatchHashReply holds one reply per requested path, in the same order.
+type BatchHashReply struct {
+	Hashes []HashReply
+}
+
+type XattrReply struct {
+	Attrs       map[string]string
+	Unsupported bool
+	Error       string
+}
+
+type SparseReply struct {
+	Layout      string
+	Unsupported bool
+	Error       string
 }
 
 type DirNode interface {
-	Scan(includes, excludes []string, followSym bool) (map[string]int64, []string, error)
-	GetMD5(relPath string, followSym bool) (string, error)
-	GetSHA(relPath string, limit int64, followSym bool) (string, error)
+	Scan(ctx context.Context, opts ScanOptions) (map[string]FileMeta, map[string]FileMeta, []ScanIssue, error)
+	StatPaths(relPaths []string, followSym bool) (map[string]FileMeta, map[string]FileMeta, error)
+	GetMD5(relPath string, followSym bool) (string, bool, error)
+	GetSHA(relPath string, limit int64, followSym bool, norm TextNorm) (string, error)
+	GetXattrs(relPath string, followSym bool) (map[string]string, error)
+	GetSparseLayout(relPath string, followSym bool) (string, error)
+	// AttrsSupported reports whether the scan reads the file attributes compared by --check-attrs.
+	AttrsSupported() bool
 	Close() error
 }
 
-// createNode creates a LocalNode or RemoteNode depending on the path string.
-// For remote paths, it creates a RemoteNode using the provided agent binary and sudo flag.
-func createNode(ctx context.Context, pathStr, agentBin string, useSudo bool, verbose bool) (DirNode, string, error) {
-	if strings.Contains(pathStr, ":") && !filepath.IsAbs(pathStr) {
+// isRemotePath reports whether the path string has the form host:/path.
+// Paths of the git: scheme and the empty baseline are not remote.
+func isRemotePath(pathStr string) bool {
+	return strings.Contains(pathStr, ":") && !filepath.IsAbs(pathStr) && !isGitPath(pathStr) && !isEmptyPath(pathStr)
+}
+
+// createNode creates a LocalNode, RemoteNode, GitNode or EmptyNode depending on the path string.
+// For remote paths, it creates a RemoteNode using the provided agent binary, sudo flag and remote shell,
+// with at most maxCalls RPC calls in flight. All nodes hash with hashOpts.
+func createNode(ctx context.Context, pathStr, agentBin string, useSudo bool, rsh []string, maxCalls int, hashOpts HashOptions) (DirNode, string, error) {
+	if isEmptyPath(pathStr) {
+		return &EmptyNode{}, pathStr, nil
+	}
+	if isGitPath(pathStr) {
+		ref := strings.TrimPrefix(pathStr, GIT_SCHEME)
+		node, err := NewGitNode(ctx, ref, hashOpts)
+		return node, ref, err
+	}
+	if isRemotePath(pathStr) {
 		parts := strings.SplitN(pathStr, ":", 2)
 		host, rPath := parts[0], parts[1]
-		if verbose {
-			fmt.Fprintf(os.Stderr, "Connecting to %s via SSH...\n", host)
+		slog.Info("connecting to remote host", "host", host, "rsh", rshOrDefault(rsh)[0])
+		node, err := NewRemoteNode(ctx, host, rPath, agentBin, useSudo, rsh, maxCalls, hashOpts)
+		if err != nil && ctx.Err() == nil {
+			return nil, rPath, fmt.Errorf("%w: %s: %w", ErrRemoteConnection, host, err)
 		}
-		node, err := NewRemoteNode(ctx, host, rPath, agentBin, useSudo)
 		return node, rPath, err
 	}
 	absPath, err := filepath.Abs(pathStr)
 	if err != nil {
 		return nil, "", err
 	}
-	return &LocalNode{root: absPath}, absPath, nil
+	return &LocalNode{root: absPath, hashOpts: hashOpts}, absPath, nil
 }
 
-type LocalNode struct{ root string }
+type LocalNode struct {
+	root     string
+	hashOpts HashOptions
+}
 
-func (n *LocalNode) Scan(includes, excludes []string, followSym bool) (map[string]int64, []string, error) {
-	return coreScan(n.root, includes, excludes, followSym)
+func (n *LocalNode) Scan(ctx context.Context, opts ScanOptions) (map[string]FileMeta, map[string]FileMeta, []ScanIssue, error) {
+	return coreScan(ctx, n.root, opts)
+}
+func (n *LocalNode) StatPaths(relPaths []string, followSym bool) (map[string]FileMeta, map[string]FileMeta, error) {
+	return corePaths(n.root, relPaths, followSym)
 }
-func (n *LocalNode) GetMD5(relPath string, followSym bool) (string, error) {
-	return coreMD5(n.root, relPath, followSym)
+func (n *LocalNode) GetMD5(relPath string, followSym bool) (string, bool, error) {
+	return coreMD5(n.root, relPath, followSym, n.hashOpts)
 }
-func (n *LocalNode) GetSHA(relPath string, limit int64, followSym bool) (string, error) {
-	return coreSHA(n.root, relPath, limit, followSym)
+func (n *LocalNode) GetSHA(relPath string, limit int64, followSym bool, norm TextNorm) (string, error) {
+	return coreSHA(n.root, relPath, limit, followSym, norm, n.hashOpts)
 }
-func (n *LocalNode) Close() error { return nil }
+func (n *LocalNode) GetXattrs(relPath string, followSym bool) (map[string]string, error) {
+	return coreXattrs(n.root, relPath, followSym)
+}
+func (n *LocalNode) GetSparseLayout(relPath string, followSym bool) (string, error) {
+	return coreSparseLayout(n.root, relPath, followSym)
+}
+func (n *LocalNode) AttrsSupported() bool { return attrsSupported }
+func (n *LocalNode) Close() error         { return nil }
 
 type RemoteNode struct {
 	cmd    *exec.Cmd
 	client *rpc.Client
+	host   string
 	root   string
+	refs   *atomic.Int32 // nodes sharing cmd and client
+	calls  chan struct{} // bounds the RPC calls in flight on client, shared like it
+
+	hashOpts       HashOptions // sent along with every hash request
+	attrsSupported bool        // reported by the agent when connecting
+
+	batchMu sync.Mutex
+	queued  map[shaBatchKey][]*shaRequest // GetSHA calls waiting for a call slot
+}
+
+// shaBatchKey groups the GetSHA calls which can be sent in the same batch.
+type shaBatchKey struct {
+	limit     int64
+	followSym bool
+	norm      TextNorm
+}
+
+// shaRequest is a GetSHA call waiting for the reply of its batch.
+type shaRequest struct {
+	relPath string
+	hash    string
+	err     error
+	done    chan struct{}
+}
+
+// WithRoot returns a RemoteNode for another root on the same host sharing this node's connection.
+// The connection is closed once all nodes sharing it are closed.
+func (n *RemoteNode) WithRoot(root string) *RemoteNode {
+	n.refs.Add(1)
+	return &RemoteNode{cmd: n.cmd, client: n.client, host: n.host, root: root, refs: n.refs, calls: n.calls, hashOpts: n.hashOpts, attrsSupported: n.attrsSupported}
+}
+
+// remoteHost returns the host of a remote path string, or "" for local paths.
+func remoteHost(pathStr string) string {
+	if !isRemotePath(pathStr) {
+		return ""
+	}
+	return strings.SplitN(pathStr, ":", 2)[0]
+}
+
+// DEFAULT_RSH is the remote shell used to reach remote hosts.
+var DEFAULT_RSH = []string{"ssh"}
+
+// rshOrDefault returns the remote shell command, falling back to ssh.
+func rshOrDefault(rsh []string) []string {
+	if len(rsh) == 0 {
+		return DEFAULT_RSH
+	}
+	return rsh
+}
+
+// splitShellWords splits a command line into words like a POSIX shell,
+// honoring single quotes, double quotes and backslash escapes.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			if i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			}
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
 }
 
 // NewRemoteNode creates a new RemoteNode instance.
+// The agent is started through the remote shell command rsh (default ssh),
+// which is called with the host and the agent command line as arguments.
 // If sudo is required, user input is forwarded as the prompt is intercepted from stderr.
 // The creation is successful when the server responds with a ready message.
-func NewRemoteNode(ctx context.Context, host, root, agentBin string, useSudo bool) (*RemoteNode, error) {
+// At most maxCalls RPC calls are sent to the agent concurrently, regardless of the number of workers.
+// The agent hashes with hashOpts.
+func NewRemoteNode(ctx context.Context, host, root, agentBin string, useSudo bool, rsh []string, maxCalls int, hashOpts HashOptions) (*RemoteNode, error) {
 	if agentBin == "" {
 		agentBin = BIN_NAME
 	}
 
+	rsh = rshOrDefault(rsh)
 	var sshArgs []string
+	sshArgs = append(sshArgs, rsh[1:]...)
 	sshArgs = append(sshArgs, host)
 
 	// format the prompt so we can intercept it from stderr
@@ -109,7 +299,7 @@ func NewRemoteNode(ctx context.Context, host, root, agentBin string, useSudo boo
 	}
 
 	// SSH can prompt the user for passwords/2FA via TTY
-	cmd := exec.CommandContext(ctx, "ssh", sshArgs...)
+	cmd := exec.CommandContext(ctx, rsh[0], sshArgs...)
 
 	stdinPipe, err := cmd.StdinPipe()
 	if err != nil {
@@ -125,7 +315,7 @@ func NewRemoteNode(ctx context.Context, host, root, agentBin string, useSudo boo
 	}
 
 	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start ssh command: %w", err)
+		return nil, fmt.Errorf("failed to start remote shell %s: %w", rsh[0], err)
 	}
 
 	var stderrBuf bytes.Buffer
@@ -206,35 +396,156 @@ func NewRemoteNode(ctx context.Context, host, root, agentBin string, useSudo boo
 		return nil, fmt.Errorf("remote agent RPC ping failed: %w", err)
 	}
 
-	return &RemoteNode{cmd: cmd, client: client, root: root}, nil
+	refs := &atomic.Int32{}
+	refs.Store(1)
+	return &RemoteNode{
+		cmd: cmd, client: client, host: host, root: root, refs: refs, calls: make(chan struct{}, max(maxCalls, 1)),
+		hashOpts: hashOpts, attrsSupported: reply.AttrsSupported,
+	}, nil
 }
 
-func (n *RemoteNode) Scan(includes, excludes []string, followSym bool) (map[string]int64, []string, error) {
+// hostErr prefixes an error with the host of the node, so that failures are
+// attributed to the right side when both roots are remote.
+func (n *RemoteNode) hostErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", n.host, err)
+}
+
+// call calls an agent method once fewer than the maximum number of calls are in flight.
+func (n *RemoteNode) call(method string, args, reply any) error {
+	n.calls <- struct{}{}
+	defer func() { <-n.calls }()
+	return n.client.Call(method, args, reply)
+}
+
+// scanIDs numbers the scans of all agents, so a cancellation names the right one.
+var scanIDs atomic.Uint64
+
+// Scan scans the root on the agent. Once ctx is done, the agent is asked to stop the scan
+// and the error of ctx is returned.
+func (n *RemoteNode) Scan(ctx context.Context, opts ScanOptions) (map[string]FileMeta, map[string]FileMeta, []ScanIssue, error) {
+	n.calls <- struct{}{}
+	defer func() { <-n.calls }()
+
 	reply := &ScanReply{}
-	err := n.client.Call("RpcAgent.Scan", ScanArgs{Root: n.root, Includes: includes, Excludes: excludes, FollowSym: followSym}, reply)
+	args := ScanArgs{ID: scanIDs.Add(1), Root: n.root, Options: opts}
+	call := n.client.Go("RpcAgent.Scan", args, reply, nil)
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		// the cancellation bypasses the call slots, one of which the scan holds;
+		// an agent without CancelScan is left scanning in the background
+		if n.client.Call("RpcAgent.CancelScan", CancelArgs{ID: args.ID}, &CancelReply{}) == nil {
+			<-call.Done
+		}
+		return nil, nil, nil, n.hostErr(ctx.Err())
+	}
+	err := call.Error
 	if reply.Error != "" {
-		return nil, nil, errors.New(reply.Error)
+		return nil, nil, nil, n.hostErr(errors.New(reply.Error))
 	}
-	return reply.Files, reply.Dirs, err
+	return reply.Files, reply.Dirs, reply.Issues, n.hostErr(err)
 }
 
-func (n *RemoteNode) GetMD5(relPath string, followSym bool) (string, error) {
-	reply := &HashReply{}
-	err := n.client.Call("RpcAgent.GetMD5", HashArgs{Root: n.root, RelPath: relPath, FollowSym: followSym}, reply)
+func (n *RemoteNode) StatPaths(relPaths []string, followSym bool) (map[string]FileMeta, map[string]FileMeta, error) {
+	reply := &ScanReply{}
+	err := n.call("RpcAgent.StatPaths", PathsArgs{Root: n.root, RelPaths: relPaths, FollowSym: followSym}, reply)
 	if reply.Error != "" {
-		return "", errors.New(reply.Error)
+		return nil, nil, n.hostErr(errors.New(reply.Error))
 	}
-	return reply.Hash, err
+	return reply.Files, reply.Dirs, n.hostErr(err)
 }
-func (n *RemoteNode) GetSHA(relPath string, limit int64, followSym bool) (string, error) {
+
+func (n *RemoteNode) GetMD5(relPath string, followSym bool) (string, bool, error) {
 	reply := &HashReply{}
-	err := n.client.Call("RpcAgent.GetSHA", HashArgs{Root: n.root, RelPath: relPath, Limit: limit, FollowSym: followSym}, reply)
+	err := n.call("RpcAgent.GetMD5", HashArgs{Root: n.root, RelPath: relPath, FollowSym: followSym, Options: n.hashOpts}, reply)
 	if reply.Error != "" {
-		return "", errors.New(reply.Error)
+		return "", false, n.hostErr(errors.New(reply.Error))
 	}
-	return reply.Hash, err
+	return reply.Hash, reply.Binary, n.hostErr(err)
 }
+
+// GetSHA hashes a file through the agent's batch API. Calls made while all call slots
+// are taken are queued and sent as a single batch once a slot frees up, so concurrent
+// workers share round trips and the agent hashes their files in parallel.
+func (n *RemoteNode) GetSHA(relPath string, limit int64, followSym bool, norm TextNorm) (string, error) {
+	key := shaBatchKey{limit: limit, followSym: followSym, norm: norm}
+	req := &shaRequest{relPath: relPath, done: make(chan struct{})}
+
+	n.batchMu.Lock()
+	if n.queued == nil {
+		n.queued = make(map[shaBatchKey][]*shaRequest)
+	}
+	// the first queued call sends the batch, including all calls queued until it gets a slot
+	first := len(n.queued[key]) == 0
+	n.queued[key] = append(n.queued[key], req)
+	n.batchMu.Unlock()
+
+	if first {
+		n.calls <- struct{}{}
+		n.batchMu.Lock()
+		batch := n.queued[key]
+		delete(n.queued, key)
+		n.batchMu.Unlock()
+		n.sendSHABatch(key, batch)
+		<-n.calls
+	}
+	<-req.done
+	return req.hash, req.err
+}
+
+// sendSHABatch hashes the files of the queued calls in a single RPC call and completes them.
+// The caller holds a call slot.
+func (n *RemoteNode) sendSHABatch(key shaBatchKey, batch []*shaRequest) {
+	args := BatchHashArgs{Root: n.root, Limit: key.limit, FollowSym: key.followSym, Norm: key.norm, Options: n.hashOpts}
+	for _, req := range batch {
+		args.RelPaths = append(args.RelPaths, req.relPath)
+	}
+	reply := &BatchHashReply{}
+	err := n.client.Call("RpcAgent.GetSHABatch", args, reply)
+	for i, req := range batch {
+		switch {
+		case err != nil:
+			req.err = n.hostErr(err)
+		case i >= len(reply.Hashes):
+			req.err = n.hostErr(fmt.Errorf("no hash of %s in the batch reply", req.relPath))
+		case reply.Hashes[i].Error != "":
+			req.err = n.hostErr(errors.New(reply.Hashes[i].Error))
+		default:
+			req.hash = reply.Hashes[i].Hash
+		}
+		close(req.done)
+	}
+}
+func (n *RemoteNode) GetXattrs(relPath string, followSym bool) (map[string]string, error) {
+	reply := &XattrReply{}
+	err := n.call("RpcAgent.GetXattrs", HashArgs{Root: n.root, RelPath: relPath, FollowSym: followSym}, reply)
+	if reply.Unsupported {
+		return nil, ErrXattrUnsupported
+	}
+	if reply.Error != "" {
+		return nil, n.hostErr(errors.New(reply.Error))
+	}
+	return reply.Attrs, n.hostErr(err)
+}
+func (n *RemoteNode) GetSparseLayout(relPath string, followSym bool) (string, error) {
+	reply := &SparseReply{}
+	err := n.call("RpcAgent.GetSparseLayout", HashArgs{Root: n.root, RelPath: relPath, FollowSym: followSym}, reply)
+	if reply.Unsupported {
+		return "", ErrSparseUnsupported
+	}
+	if reply.Error != "" {
+		return "", n.hostErr(errors.New(reply.Error))
+	}
+	return reply.Layout, n.hostErr(err)
+}
+func (n *RemoteNode) AttrsSupported() bool { return n.attrsSupported }
 func (n *RemoteNode) Close() error {
+	if n.refs.Add(-1) > 0 {
+		return nil
+	}
 	n.client.Close()
 	return n.cmd.Wait()
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/urfave/cli/v3"
+)
+
+// PATTERN_FLAGS are the flags holding glob patterns, in the order they are checked.
+var PATTERN_FLAGS = []string{"include", "exclude", "include-a", "include-b", "exclude-a", "exclude-b", "include-dir", "exclude-dir", "fast"}
+
+// VCS_DIRS are the version control metadata directories excluded by --exclude-vcs.
+var VCS_DIRS = []string{".git", ".svn", ".hg", ".bzr", "CVS", "_darcs"}
+
+// GLOB_SYNTAXES are the valid values of --glob. With classic patterns, '*' also
+// matches '/'; with doublestar patterns only '**' crosses directories.
+var GLOB_SYNTAXES = []string{"classic", "doublestar"}
+
+// checkGlobSyntax fails if the syntax isn't one of the GLOB_SYNTAXES.
+func checkGlobSyntax(syntax string) error {
+	if !slices.Contains(GLOB_SYNTAXES, syntax) {
+		return fmt.Errorf("invalid --glob %q, expected one of %s", syntax, strings.Join(GLOB_SYNTAXES, ", "))
+	}
+	return nil
+}
+
+// scanOptions returns the scan options given on the command line, with the patterns
+// shared by both sides.
+func scanOptions(cmd *cli.Command) ScanOptions {
+	return ScanOptions{
+		Includes:    cmd.StringSlice("include"),
+		Excludes:    excludePatterns(cmd),
+		IncludeDirs: cmd.StringSlice("include-dir"),
+		ExcludeDirs: cmd.StringSlice("exclude-dir"),
+		FollowSym:   cmd.Bool("follow-symlinks"),
+		Glob:        cmd.String("glob"),
+		OneFS:       cmd.Bool("one-file-system"),
+		NoRecurse:   cmd.Bool("no-recurse"),
+	}
+}
+
+// excludePatterns returns the --exclude patterns, extended by patterns matching
+// the VCS_DIRS at any depth if --exclude-vcs is set.
+func excludePatterns(cmd *cli.Command) []string {
+	excludes := cmd.StringSlice("exclude")
+	if cmd.Bool("exclude-vcs") {
+		for _, dir := range VCS_DIRS {
+			if cmd.String("glob") == "doublestar" {
+				excludes = append(excludes, "**/"+dir)
+			} else {
+				excludes = append(excludes, dir, "*/"+dir)
+			}
+		}
+	}
+	return excludes
+}
+
+// compilePattern compiles a single glob pattern in the given --glob syntax, classic if empty.
+// The error names the pattern and, if it can be located, the position of the offending character.
+func compilePattern(pattern, syntax string) (glob.Glob, error) {
+	var g glob.Glob
+	var err error
+	if syntax == "doublestar" {
+		g, err = compileDoublestar(pattern)
+	} else {
+		g, err = glob.Compile(pattern)
+	}
+	if err == nil {
+		return g, nil
+	}
+	if pos := globErrorPos(pattern); pos >= 0 {
+		return nil, fmt.Errorf("invalid pattern %q: %v (at position %d: %q)", pattern, err, pos, pattern[pos])
+	}
+	return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+}
+
+// globErrorPos returns the byte position of an unbalanced bracket or brace,
+// a reversed character range or a trailing escape in a glob pattern, or -1 if none is found.
+// gobwas/glob doesn't report positions itself.
+func globErrorPos(pattern string) int {
+	var open []int // positions of unclosed '{'
+	classStart := -1
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\':
+			if i == len(pattern)-1 {
+				return i
+			}
+			i++
+		case classStart >= 0:
+			if c == ']' {
+				classStart = -1
+			} else if c == '-' && i > classStart+1 && i+1 < len(pattern) && pattern[i+1] != ']' && pattern[i+1] < pattern[i-1] {
+				return i - 1
+			}
+		case c == '[':
+			classStart = i
+		case c == ']':
+			return i
+		case c == '{':
+			open = append(open, i)
+		case c == '}':
+			if len(open) == 0 {
+				return i
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if classStart >= 0 {
+		return classStart
+	}
+	if len(open) > 0 {
+		return open[len(open)-1]
+	}
+	return -1
+}
+
+// doublestarGlob matches a slash separated path segment by segment: a "**" segment
+// matches any number of segments, including none, and no other wildcard matches '/'.
+type doublestarGlob struct {
+	segments []glob.Glob // nil for "**"
+}
+
+func compileDoublestar(pattern string) (glob.Glob, error) {
+	var g doublestarGlob
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			g.segments = append(g.segments, nil)
+			continue
+		}
+		sg, err := glob.Compile(segment)
+		if err != nil {
+			return nil, err
+		}
+		g.segments = append(g.segments, sg)
+	}
+	return g, nil
+}
+
+func (g doublestarGlob) Match(relPath string) bool {
+	return matchSegments(g.segments, strings.Split(relPath, "/"))
+}
+
+func matchSegments(globs []glob.Glob, parts []string) bool {
+	if len(globs) == 0 {
+		return len(parts) == 0
+	}
+	if globs[0] == nil {
+		for i := range len(parts) + 1 {
+			if matchSegments(globs[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(parts) > 0 && globs[0].Match(parts[0]) && matchSegments(globs[1:], parts[1:])
+}
+
+// matchesAny reports whether the path matches one of the globs, or ifEmpty if there are none.
+func matchesAny(globs []glob.Glob, relPath string, ifEmpty bool) bool {
+	if len(globs) == 0 {
+		return ifEmpty
+	}
+	for _, g := range globs {
+		if g.Match(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// runCheckPatterns compiles all glob patterns given on the command line and reports each invalid one.
+func runCheckPatterns(cmd *cli.Command) error {
+	invalid := 0
+	for _, name := range PATTERN_FLAGS {
+		for i, pattern := range cmd.StringSlice(name) {
+			if _, err := compilePattern(pattern, cmd.String("glob")); err != nil {
+				fmt.Fprintf(cmd.Writer, "--%s[%d]: %v\n", name, i, err)
+				invalid++
+			}
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid patterns", invalid)
+	}
+	return nil
+}
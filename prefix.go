@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// stripPrefix removes a leading path prefix from the scanned files and directories of one
+// side, so trees which are rooted differently align. Paths outside the prefix are kept.
+// It also returns the original path of every renamed file; paths which end up with the
+// same name are an error.
+func stripPrefix(files, dirs map[string]FileMeta, prefix string) (map[string]FileMeta, map[string]FileMeta, map[string]string, error) {
+	prefix = strings.Trim(path.Clean("/"+prefix), "/") + "/"
+	if prefix == "/" {
+		return files, dirs, nil, nil
+	}
+
+	stripped := make(map[string]FileMeta, len(files))
+	orig := make(map[string]string)
+	for relPath, meta := range files {
+		name, ok := strings.CutPrefix(relPath, prefix)
+		if !ok {
+			name = relPath
+		}
+		if _, dup := stripped[name]; dup {
+			return nil, nil, nil, fmt.Errorf("stripping prefix %q: %s collides with %s", strings.TrimSuffix(prefix, "/"), relPath, name)
+		}
+		stripped[name] = meta
+		if ok {
+			orig[name] = relPath
+		}
+	}
+
+	strippedDirs := make(map[string]FileMeta, len(dirs))
+	for d, meta := range dirs {
+		if d+"/" == prefix {
+			continue // the prefix itself becomes the root
+		}
+		name, _ := strings.CutPrefix(d, prefix)
+		if _, isFile := stripped[name]; isFile {
+			return nil, nil, nil, fmt.Errorf("stripping prefix %q: %s collides with %s", strings.TrimSuffix(prefix, "/"), d, name)
+		}
+		strippedDirs[name] = meta
+	}
+	return stripped, strippedDirs, orig, nil
+}
+
+// readRenameMap reads the --rename-map file, one "<pathA>\t<pathB>" pair per line.
+// Blank lines are skipped; every path may only be mapped once.
+func readRenameMap(source string) (map[string]string, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	renames := make(map[string]string)
+	targets := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		pathA, pathB, ok := strings.Cut(line, "\t")
+		if !ok || pathA == "" || pathB == "" {
+			return nil, fmt.Errorf("line %d: expected <pathA><TAB><pathB>, got %q", n, line)
+		}
+		pathA, pathB = path.Clean(pathA), path.Clean(pathB)
+		if _, dup := renames[pathA]; dup || targets[pathB] {
+			return nil, fmt.Errorf("line %d: %s or %s is already mapped", n, pathA, pathB)
+		}
+		renames[pathA] = pathB
+		targets[pathB] = true
+	}
+	return renames, scanner.Err()
+}
+
+// renameFiles renames the files of side B to the side A paths they are mapped to by renames,
+// so each pair is compared by content. Mappings whose B path is missing are ignored.
+// It also returns the original path of every renamed file; a renamed file colliding with
+// a file of the same name is an error.
+func renameFiles(files map[string]FileMeta, renames map[string]string) (map[string]FileMeta, map[string]string, error) {
+	renamed := make(map[string]FileMeta, len(files))
+	orig := make(map[string]string)
+	moved := make(map[string]bool)
+	for pathA, pathB := range renames {
+		if meta, ok := files[pathB]; ok {
+			renamed[pathA] = meta
+			orig[pathA] = pathB
+			moved[pathB] = true
+		}
+	}
+	for relPath, meta := range files {
+		if moved[relPath] {
+			continue
+		}
+		if pathB, ok := orig[relPath]; ok {
+			return nil, nil, fmt.Errorf("renaming %s: collides with %s", pathB, relPath)
+		}
+		renamed[relPath] = meta
+	}
+	return renamed, orig, nil
+}
+
+// foldCase renames the files and directories of side B to the names of side A they only differ
+// from in case, so both are compared regardless of case and shown by their A name. Names which
+// only differ in case on the same side are ambiguous; they are left as they are and returned.
+// It also returns the original path of every renamed file.
+func foldCase(filesA, dirsA, filesB, dirsB map[string]FileMeta) (map[string]FileMeta, map[string]FileMeta, map[string]string, []string) {
+	var ambiguous []string
+	// byLower maps the lowercase names of a side to their only name, or "" if ambiguous
+	byLower := func(entries map[string]FileMeta) map[string]string {
+		names := make(map[string]string, len(entries))
+		for name := range entries {
+			key := strings.ToLower(name)
+			if other, dup := names[key]; dup {
+				if other != "" {
+					ambiguous = append(ambiguous, other)
+				}
+				ambiguous = append(ambiguous, name)
+				names[key] = ""
+				continue
+			}
+			names[key] = name
+		}
+		return names
+	}
+	rename := func(entriesA, entriesB map[string]FileMeta, orig map[string]string) map[string]FileMeta {
+		namesA, namesB := byLower(entriesA), byLower(entriesB)
+		renamed := make(map[string]FileMeta, len(entriesB))
+		for name, meta := range entriesB {
+			key := strings.ToLower(name)
+			if nameA := namesA[key]; nameA != "" && namesB[key] != "" && nameA != name {
+				if orig != nil {
+					orig[nameA] = name
+				}
+				name = nameA
+			}
+			renamed[name] = meta
+		}
+		return renamed
+	}
+
+	orig := make(map[string]string)
+	renamedFiles := rename(filesA, filesB, orig)
+	renamedDirs := rename(dirsA, dirsB, nil)
+	slices.Sort(ambiguous)
+	return renamedFiles, renamedDirs, orig, ambiguous
+}
+
+// prefixedNode reads the files of a side whose paths were stripped or renamed by their original paths.
+type prefixedNode struct {
+	DirNode
+	orig map[string]string
+}
+
+func (n *prefixedNode) path(relPath string) string {
+	if p, ok := n.orig[relPath]; ok {
+		return p
+	}
+	return relPath
+}
+
+func (n *prefixedNode) GetMD5(relPath string, followSym bool) (string, bool, error) {
+	return n.DirNode.GetMD5(n.path(relPath), followSym)
+}
+
+func (n *prefixedNode) GetSHA(relPath string, limit int64, followSym bool, norm TextNorm) (string, error) {
+	return n.DirNode.GetSHA(n.path(relPath), limit, followSym, norm)
+}
+
+func (n *prefixedNode) GetXattrs(relPath string, followSym bool) (map[string]string, error) {
+	return n.DirNode.GetXattrs(n.path(relPath), followSym)
+}
+
+func (n *prefixedNode) GetSparseLayout(relPath string, followSym bool) (string, error) {
+	return n.DirNode.GetSparseLayout(n.path(relPath), followSym)
+}
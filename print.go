@@ -1,59 +1,361 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"sort"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/docker/go-units"
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v3"
 )
 
-func printAndDetermineExit(results []DiffItem, cmd *cli.Command, verbose bool) error {
-	// sort alphabetically
-	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
-
-	red := color.New(color.FgRed).FprintfFunc()
-	green := color.New(color.FgGreen).FprintfFunc()
-	yellow := color.New(color.FgYellow).FprintfFunc()
-	cyan := color.New(color.FgCyan).FprintfFunc()
+// relativeLabel shortens a local path to be relative to the base directory.
+// Remote paths, git refs, the empty baseline and paths outside the base directory are returned unchanged.
+func relativeLabel(pathStr, base string) string {
+	if isRemotePath(pathStr) || isGitPath(pathStr) || isEmptyPath(pathStr) {
+		return pathStr
+	}
+	absPath, err := filepath.Abs(pathStr)
+	if err != nil {
+		return pathStr
+	}
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return pathStr
+	}
+	rel, err := filepath.Rel(absBase, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return pathStr
+	}
+	return rel
+}
 
-	var addedFiles, removedFiles, modifiedFiles int
-	var addedDirs, removedDirs int
+// Stats holds the number of reported differences per category.
+type Stats struct {
+	AddedFiles    int `json:"added_files"`
+	RemovedFiles  int `json:"removed_files"`
+	ModifiedFiles int `json:"modified_files"`
+	ErroredFiles  int `json:"errored_files"`
+	LinkChanges   int `json:"link_changes"`
+	XattrChanges  int `json:"xattr_changes"`
+	AttrChanges   int `json:"attr_changes"`
+	AddedDirs     int `json:"added_dirs"`
+	RemovedDirs   int `json:"removed_dirs"`
+	ModifiedDirs  int `json:"modified_dirs"`
+}
 
-	// gather statistics
+// gatherStats counts the diff items per category.
+func gatherStats(results []DiffItem) Stats {
+	var stats Stats
 	for _, item := range results {
 		if item.IsDir {
 			switch item.Type {
 			case Added:
-				addedDirs++
+				stats.AddedDirs++
 			case Removed:
-				removedDirs++
+				stats.RemovedDirs++
+			case DirModified:
+				stats.ModifiedDirs++
 			}
 		} else {
 			switch item.Type {
 			case Added:
-				addedFiles++
+				stats.AddedFiles++
 			case Removed:
-				removedFiles++
+				stats.RemovedFiles++
 			case Modified:
-				modifiedFiles++
+				stats.ModifiedFiles++
+			case Errored:
+				stats.ErroredFiles++
+			case LinkChanged:
+				stats.LinkChanges++
+			case XattrChanged:
+				stats.XattrChanges++
+			case AttrChanged:
+				stats.AttrChanges++
 			}
 		}
 	}
+	return stats
+}
 
-	if !cmd.Bool("quiet") {
-		if cmd.Bool("tree") {
-			// tree output
-			args := cmd.Args().Slice()
-			pathA, pathB := "Dir A", "Dir B"
-			if len(args) >= 2 {
-				pathA, pathB = args[0], args[1]
+// fileBytes sums the sizes of the added and of the removed files.
+func fileBytes(results []DiffItem) (added, removed int64) {
+	for _, item := range results {
+		if item.IsDir {
+			continue
+		}
+		switch item.Type {
+		case Added:
+			added += item.Size
+		case Removed:
+			removed += item.Size
+		}
+	}
+	return added, removed
+}
+
+// HasModified reports whether entries present on both sides differ, unlike added or removed ones.
+func (s Stats) HasModified() bool {
+	return s.ModifiedFiles > 0 || s.ErroredFiles > 0 || s.LinkChanges > 0 || s.XattrChanges > 0 || s.AttrChanges > 0 || s.ModifiedDirs > 0
+}
+
+// Verdict returns nil for identical directories or the sentinel error describing the relationship.
+func (s Stats) Verdict() error {
+	hasAdded := s.AddedFiles > 0 || s.AddedDirs > 0
+	hasRemoved := s.RemovedFiles > 0 || s.RemovedDirs > 0
+
+	switch {
+	case s.HasModified() || (hasAdded && hasRemoved):
+		return ErrDiffsFound
+	case hasAdded:
+		return ErrASubsetB
+	case hasRemoved:
+		return ErrBSubsetA
+	}
+	return nil
+}
+
+// FAIL_ON_KEYS are the valid values of --fail-on, named like the change types.
+var FAIL_ON_KEYS = []string{"added", "removed", "modified", "errored", "link_changed", "xattr_changed", "attr_changed", "dir_modified"}
+
+// FailingOnly returns the stats reduced to the categories in failOn.
+// An empty failOn keeps all categories.
+func (s Stats) FailingOnly(failOn []string) Stats {
+	if len(failOn) == 0 {
+		return s
+	}
+	var f Stats
+	for _, key := range failOn {
+		switch key {
+		case "added":
+			f.AddedFiles, f.AddedDirs = s.AddedFiles, s.AddedDirs
+		case "removed":
+			f.RemovedFiles, f.RemovedDirs = s.RemovedFiles, s.RemovedDirs
+		case "modified":
+			f.ModifiedFiles = s.ModifiedFiles
+		case "errored":
+			f.ErroredFiles = s.ErroredFiles
+		case "link_changed":
+			f.LinkChanges = s.LinkChanges
+		case "xattr_changed":
+			f.XattrChanges = s.XattrChanges
+		case "attr_changed":
+			f.AttrChanges = s.AttrChanges
+		case "dir_modified":
+			f.ModifiedDirs = s.ModifiedDirs
+		}
+	}
+	return f
+}
+
+// formatSize renders a byte figure human-readably, e.g. 1.2GB, or as a plain number if raw (--bytes).
+func formatSize(n int64, raw bool) string {
+	if raw {
+		return strconv.FormatInt(n, 10)
+	}
+	return units.HumanSize(float64(n))
+}
+
+// modifiedDetails describes where a modified file differs and how much of it, if known.
+// Sizes are formatted by formatSize.
+func modifiedDetails(item DiffItem, rawBytes bool) string {
+	var details []string
+	if m := item.Mismatch; m != nil && m.Offset >= 0 {
+		details = append(details, fmt.Sprintf("differ at offset %d, sizes %s vs %s", m.Offset, formatSize(m.SizeA, rawBytes), formatSize(m.SizeB, rawBytes)))
+	} else if m != nil {
+		details = append(details, fmt.Sprintf("sizes %s vs %s", formatSize(m.SizeA, rawBytes), formatSize(m.SizeB, rawBytes)))
+	}
+	if b := item.Blocks; b != nil && b.Total > 0 {
+		details = append(details, fmt.Sprintf("%d of %d blocks differ, %.1f%%", b.Changed, b.Total, 100*float64(b.Changed)/float64(b.Total)))
+	}
+	return strings.Join(details, ", ")
+}
+
+// verdictName returns a machine-readable name for a verdict sentinel.
+func verdictName(verdict error) string {
+	switch verdict {
+	case nil:
+		return "identical"
+	case ErrASubsetB:
+		return "a_subset_b"
+	case ErrBSubsetA:
+		return "b_subset_a"
+	}
+	return "divergent"
+}
+
+// SORT_KEYS are the valid values of --sort.
+var SORT_KEYS = []string{"name", "size", "status", "type", "magnitude"}
+
+// pathOrder returns how paths are ordered in the output, by bytes or,
+// with --natural-sort, by naturalCompare.
+func pathOrder(cmd *cli.Command) func(a, b string) int {
+	if cmd.Bool("natural-sort") {
+		return naturalCompare
+	}
+	return strings.Compare
+}
+
+// naturalCompare compares two paths like strings.Compare, except that runs of digits are
+// compared by their numeric value, so "file2" sorts before "file10". Paths which only differ
+// in leading zeros fall back to byte order, so the order stays total.
+func naturalCompare(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return cmp.Compare(a[i], b[j])
 			}
-			printTree(results, pathA, pathB, cmd)
-		} else {
+			i++
+			j++
+			continue
+		}
+		startA, startB := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		numA := strings.TrimLeft(a[startA:i], "0")
+		numB := strings.TrimLeft(b[startB:j], "0")
+		if c := cmp.Compare(len(numA), len(numB)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(numA, numB); c != 0 {
+			return c
+		}
+	}
+	if c := cmp.Compare(len(a)-i, len(b)-j); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// magnitude estimates how many bytes of an item changed for --sort=magnitude: the size of an
+// added or removed file, and the changed blocks or else the size difference of a modified one.
+func magnitude(item DiffItem) int64 {
+	switch item.Type {
+	case Added, Removed:
+		return item.Size
+	case Modified:
+		if b := item.Blocks; b != nil {
+			return min(b.Changed*BLOCK_COMPARE_SIZE, item.Size)
+		}
+		return item.Delta
+	}
+	return 0
+}
+
+// sortResults sorts the diff items by the given key (name, size, status, type or magnitude).
+// Items with an equal key are ordered by path in the given order; reverse inverts the whole order.
+func sortResults(results []DiffItem, key string, reverse bool, order func(a, b string) int) {
+	less := func(a, b DiffItem) int {
+		switch key {
+		case "size":
+			return cmp.Compare(b.Size, a.Size) // largest first
+		case "status":
+			return cmp.Compare(a.Type, b.Type)
+		case "magnitude":
+			return cmp.Compare(magnitude(b), magnitude(a)) // most changed first
+		case "type":
+			if a.IsDir != b.IsDir {
+				if a.IsDir {
+					return -1
+				}
+				return 1
+			}
+		}
+		return 0
+	}
+	slices.SortStableFunc(results, func(a, b DiffItem) int {
+		c := less(a, b)
+		if c == 0 {
+			c = order(a.Path, b.Path)
+		}
+		if reverse {
+			return -c
+		}
+		return c
+	})
+}
+
+func printAndDetermineExit(results []DiffItem, cmd *cli.Command, verbose bool) error {
+	var pathA, pathB string
+	if args := cmd.Args().Slice(); len(args) >= 2 {
+		pathA, pathB = args[0], args[1]
+	}
+
+	sortResults(results, cmd.String("sort"), cmd.Bool("reverse"), pathOrder(cmd))
+
+	red := color.New(color.FgRed).FprintfFunc()
+	green := color.New(color.FgGreen).FprintfFunc()
+	yellow := color.New(color.FgYellow).FprintfFunc()
+	cyan := color.New(color.FgCyan).FprintfFunc()
+	magenta := color.New(color.FgMagenta).FprintfFunc()
+
+	stats := gatherStats(results)
+	sentinel := stats.Verdict()
+
+	// an expected subset relationship only needs the exit code
+	quietSubset := cmd.Bool("quiet-if-subset") && (sentinel == ErrASubsetB || sentinel == ErrBSubsetA)
+
+	if !cmd.Bool("quiet") && !quietSubset {
+		// labels of the compared directories for headers
+		labelA, labelB := pathA, pathB
+		if labelA == "" && labelB == "" {
+			labelA, labelB = "Dir A", "Dir B"
+		}
+		if relTo := cmd.String("relative-to"); relTo != "" {
+			labelA = relativeLabel(labelA, relTo)
+			labelB = relativeLabel(labelB, relTo)
+		}
+		if label := cmd.String("label-a"); label != "" {
+			labelA = label
+		}
+		if label := cmd.String("label-b"); label != "" {
+			labelB = label
+		}
+
+		switch {
+		case cmd.String("format") == "jsonl":
+			// items were already streamed while comparing
+		case cmd.Bool("null"):
+			// status and path terminated by NUL like git status -z, safe for any file name
+			for _, item := range results {
+				suffix := ""
+				if item.IsDir {
+					suffix = string(os.PathSeparator)
+				}
+				fmt.Fprintf(cmd.Writer, "%s %s%s\x00", item.Type.Symbol(), item.Path, suffix)
+			}
+		case cmd.Bool("flat"):
+			// a status letter and the slash separated path per line, nothing else
+			for _, item := range results {
+				fmt.Fprintf(cmd.Writer, "%s %s\n", item.Type.Letter(), item.Path)
+			}
+		case cmd.Bool("tree"):
+			// tree output
+			printTree(results, labelA, labelB, !cmd.Bool("no-header"), cmd)
+		case cmd.Bool("columns"):
+			// flat two-column output
+			printColumns(results, labelA, labelB, !cmd.Bool("no-header"), cmd)
+		default:
 			// standard line-by-line output
+			if cmd.Bool("header") {
+				cyan(cmd.Writer, "--- %s\n+++ %s\n", labelA, labelB)
+			}
 			for _, item := range results {
 				suffix := ""
 				if item.IsDir {
@@ -64,73 +366,197 @@ func printAndDetermineExit(results []DiffItem, cmd *cli.Command, verbose bool) e
 					green(cmd.Writer, "+ %s%s\n", item.Path, suffix)
 				case Removed:
 					red(cmd.Writer, "- %s%s\n", item.Path, suffix)
-				case Modified:
-					yellow(cmd.Writer, "~ %s%s\n", item.Path, suffix)
+				case Modified, DirModified:
+					if item.TargetA != "" {
+						// a retargeted symlink names both targets
+						yellow(cmd.Writer, "~ %s (%s -> %s)\n", item.Path, item.TargetA, item.TargetB)
+					} else if details := modifiedDetails(item, cmd.Bool("bytes")); details != "" {
+						yellow(cmd.Writer, "~ %s (%s)\n", item.Path, details)
+					} else {
+						yellow(cmd.Writer, "~ %s%s\n", item.Path, suffix)
+					}
+				case Errored:
+					magenta(cmd.Writer, "! %s%s\n", item.Path, suffix)
+				case LinkChanged:
+					cyan(cmd.Writer, "& %s%s\n", item.Path, suffix)
+				case XattrChanged:
+					cyan(cmd.Writer, "@ %s%s\n", item.Path, suffix)
+				case AttrChanged:
+					cyan(cmd.Writer, "^ %s%s\n", item.Path, suffix)
+				case Identical:
+					fmt.Fprintf(cmd.Writer, "= %s%s\n", item.Path, suffix)
 				}
 			}
 		}
 	}
 
-	hasAdded := addedFiles > 0 || addedDirs > 0
-	hasRemoved := removedFiles > 0 || removedDirs > 0
-	hasModified := modifiedFiles > 0
+	if cmd.Bool("rollup") && !cmd.Bool("quiet") && !quietSubset {
+		differences := slices.DeleteFunc(slices.Clone(results), func(item DiffItem) bool { return item.Type == Identical })
+		for _, r := range buildRollups(differences, pathOrder(cmd)) {
+			if cmd.String("format") == "jsonl" {
+				json.NewEncoder(cmd.Writer).Encode(jsonRollup{Type: "rollup", Rollup: r})
+			} else {
+				fmt.Fprintf(cmd.Writer, "%s\t%s/\tadded=%d removed=%d modified=%d\n", r.Status, r.Path, r.Added, r.Removed, r.Modified)
+			}
+		}
+	}
 
 	if verbose {
 		fmt.Fprintln(cmd.ErrWriter) // spacing
 	}
 
-	if len(results) == 0 {
-		if verbose {
-			green(cmd.ErrWriter, "Directories are identical.\n")
-		}
-		return nil
-	}
-
-	if verbose {
+	// --summary prints the summary line without the rest of the verbose output, even with --quiet
+	if verbose && len(results) > 0 || cmd.Bool("summary") {
 		var parts []string
-		if modifiedFiles > 0 {
-			parts = append(parts, fmt.Sprintf("%d modified files", modifiedFiles))
+		if stats.ModifiedFiles > 0 {
+			parts = append(parts, fmt.Sprintf("%d modified files", stats.ModifiedFiles))
+		}
+		if stats.ErroredFiles > 0 {
+			parts = append(parts, fmt.Sprintf("%d unreadable files", stats.ErroredFiles))
+		}
+		if stats.LinkChanges > 0 {
+			parts = append(parts, fmt.Sprintf("%d hardlink changes", stats.LinkChanges))
+		}
+		if stats.XattrChanges > 0 {
+			parts = append(parts, fmt.Sprintf("%d xattr changes", stats.XattrChanges))
 		}
-		if addedFiles > 0 {
-			parts = append(parts, fmt.Sprintf("%d added files", addedFiles))
+		if stats.AttrChanges > 0 {
+			parts = append(parts, fmt.Sprintf("%d attribute changes", stats.AttrChanges))
 		}
-		if removedFiles > 0 {
-			parts = append(parts, fmt.Sprintf("%d removed files", removedFiles))
+		addedBytes, removedBytes := fileBytes(results)
+		if stats.AddedFiles > 0 {
+			parts = append(parts, fmt.Sprintf("%d added files (%s)", stats.AddedFiles, formatSize(addedBytes, cmd.Bool("bytes"))))
 		}
-		if addedDirs > 0 {
-			parts = append(parts, fmt.Sprintf("%d added dirs", addedDirs))
+		if stats.RemovedFiles > 0 {
+			parts = append(parts, fmt.Sprintf("%d removed files (%s)", stats.RemovedFiles, formatSize(removedBytes, cmd.Bool("bytes"))))
 		}
-		if removedDirs > 0 {
-			parts = append(parts, fmt.Sprintf("%d removed dirs", removedDirs))
+		if stats.AddedDirs > 0 {
+			parts = append(parts, fmt.Sprintf("%d added dirs", stats.AddedDirs))
+		}
+		if stats.RemovedDirs > 0 {
+			parts = append(parts, fmt.Sprintf("%d removed dirs", stats.RemovedDirs))
+		}
+		if stats.ModifiedDirs > 0 {
+			parts = append(parts, fmt.Sprintf("%d dirs with changed mtime", stats.ModifiedDirs))
 		}
 
 		summary := strings.Join(parts, ", ")
+		if summary == "" {
+			summary = "no differences"
+		}
 
 		// append note if directories were skipped and --show-all isn't active
-		if !cmd.Bool("show-all") && (addedDirs > 0 || removedDirs > 0) {
+		if !cmd.Bool("show-all") && (stats.AddedDirs > 0 || stats.RemovedDirs > 0) {
 			summary += " (subdirectories/files inside them not listed)"
 		}
 
 		cyan(cmd.ErrWriter, "Summary: %s\n", summary)
 	}
 
-	if hasModified || (hasAdded && hasRemoved) {
-		if verbose {
+	if verbose {
+		switch sentinel {
+		case nil:
+			green(cmd.ErrWriter, "Directories are identical.\n")
+		case ErrDiffsFound:
 			red(cmd.ErrWriter, "Directories are divergent.\n")
-		}
-		return ErrDiffsFound
-	}
-	if hasAdded {
-		if verbose {
+		case ErrASubsetB:
 			yellow(cmd.ErrWriter, "Directory A is a subset of directory B.\n")
-		}
-		return ErrASubsetB
-	}
-	if hasRemoved {
-		if verbose {
+		case ErrBSubsetA:
 			yellow(cmd.ErrWriter, "Directory B is a subset of directory A.\n")
 		}
-		return ErrBSubsetA
 	}
-	return nil
+
+	if cmd.String("format") == "jsonl" && !cmd.Bool("quiet") {
+		json.NewEncoder(cmd.Writer).Encode(jsonSummary{Type: "summary", Verdict: verdictName(sentinel), Stats: stats})
+	}
+
+	// --fail-on only changes the exit code, not what was reported above
+	failing := stats.FailingOnly(cmd.StringSlice("fail-on")).Verdict()
+	if failing == nil {
+		return nil
+	}
+	return &VerdictError{Verdict: failing, PathA: pathA, PathB: pathB, Stats: stats}
+}
+
+// printFingerprints prints the fingerprints of both sides and whether they match,
+// as a single record with --format=jsonl.
+func printFingerprints(cmd *cli.Command, fpA, fpB string) {
+	if cmd.String("format") == "jsonl" {
+		json.NewEncoder(cmd.Writer).Encode(jsonFingerprint{Type: "fingerprint", A: fpA, B: fpB, Match: fpA == fpB})
+		return
+	}
+	fmt.Fprintf(cmd.Writer, "A: %s\nB: %s\n", fpA, fpB)
+	if fpA == fpB {
+		fmt.Fprintln(cmd.Writer, "Fingerprints match.")
+	} else {
+		fmt.Fprintln(cmd.Writer, "Fingerprints differ.")
+	}
+}
+
+// jsonItem is a single diff item line of the jsonl output format.
+type jsonItem struct {
+	Type  string `json:"type"`
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+
+	TargetA  string     `json:"target_a,omitempty"`
+	TargetB  string     `json:"target_b,omitempty"`
+	Mismatch *Mismatch  `json:"mismatch,omitempty"`
+	Blocks   *BlockDiff `json:"blocks,omitempty"`
+}
+
+// jsonRollup is a directory rollup line of the jsonl output format.
+type jsonRollup struct {
+	Type string `json:"type"`
+	Rollup
+}
+
+// jsonSummary is the final line of the jsonl output format.
+type jsonSummary struct {
+	Type    string `json:"type"`
+	Verdict string `json:"verdict"`
+	Stats
+}
+
+// jsonFingerprint is the --fingerprint line of the jsonl output format.
+type jsonFingerprint struct {
+	Type  string `json:"type"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+	Match bool   `json:"match"`
+}
+
+// runSummary is the content of the --stats-json sidecar.
+type runSummary struct {
+	Verdict string `json:"verdict"`
+	Stats
+	BytesHashed int64   `json:"bytes_hashed"` // upper bound, comparisons may stop early
+	Elapsed     float64 `json:"elapsed_seconds"`
+	Workers     int     `json:"workers"`
+}
+
+// writeJSONFile writes v as indented JSON to the file at path.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// jsonlWriter streams diff items as JSON lines as soon as they are found.
+type jsonlWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	return &jsonlWriter{enc: json.NewEncoder(w)}
+}
+
+// Emit writes a single diff item. Each write goes straight to the underlying writer.
+func (j *jsonlWriter) Emit(item DiffItem) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(jsonItem{Type: item.Type.String(), Path: item.Path, IsDir: item.IsDir, TargetA: item.TargetA, TargetB: item.TargetB, Mismatch: item.Mismatch, Blocks: item.Blocks})
 }
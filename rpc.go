@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/rpc"
 	"os"
+	"runtime"
+	"sync"
 )
 
-type RpcAgent struct{}
+type RpcAgent struct {
+	mu    sync.Mutex
+	scans map[uint64]context.CancelFunc // running or already canceled scans by ID
+}
 
 // runAgent starts an RPC server that listens on stdin and stdout.
 // It prints a ready message just before starting the server.
@@ -25,33 +32,134 @@ func runAgent() error {
 
 func (a *RpcAgent) Ping(args PingArgs, reply *PingReply) error {
 	reply.Status = "OK"
+	reply.AttrsSupported = attrsSupported
 	return nil
 }
 
 func (a *RpcAgent) Scan(args ScanArgs, reply *ScanReply) error {
-	files, dirs, err := coreScan(args.Root, args.Includes, args.Excludes, args.FollowSym)
+	ctx, done := a.startScan(args.ID)
+	defer done()
+	files, dirs, issues, err := coreScan(ctx, args.Root, args.Options)
 	if err != nil {
 		reply.Error = err.Error()
 	}
 	reply.Files = files
 	reply.Dirs = dirs
+	reply.Issues = issues
 	return nil
 }
 
-func (a *RpcAgent) GetMD5(args HashArgs, reply *HashReply) error {
-	hashStr, err := coreMD5(args.Root, args.RelPath, args.FollowSym)
+// startScan registers a scan, returning the context CancelScan cancels and a function
+// to call once the scan is done.
+func (a *RpcAgent) startScan(id uint64) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.scans == nil {
+		a.scans = make(map[uint64]context.CancelFunc)
+	}
+	if _, ok := a.scans[id]; ok {
+		cancel() // the cancellation overtook the scan
+	}
+	a.scans[id] = cancel
+	return ctx, func() {
+		a.mu.Lock()
+		delete(a.scans, id)
+		a.mu.Unlock()
+		cancel()
+	}
+}
+
+// CancelScan stops a running scan, which then replies with the cancellation as its error.
+// The requests are served concurrently, so a scan which didn't start yet is canceled once it does.
+func (a *RpcAgent) CancelScan(args CancelArgs, reply *CancelReply) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cancel, ok := a.scans[args.ID]; ok {
+		cancel()
+		return nil
+	}
+	if a.scans == nil {
+		a.scans = make(map[uint64]context.CancelFunc)
+	}
+	a.scans[args.ID] = func() {}
+	return nil
+}
+
+func (a *RpcAgent) StatPaths(args PathsArgs, reply *ScanReply) error {
+	files, dirs, err := corePaths(args.Root, args.RelPaths, args.FollowSym)
 	if err != nil {
 		reply.Error = err.Error()
 	}
-	reply.Hash = hashStr
+	reply.Files = files
+	reply.Dirs = dirs
 	return nil
 }
 
-func (a *RpcAgent) GetSHA(args HashArgs, reply *HashReply) error {
-	hashStr, err := coreSHA(args.Root, args.RelPath, args.Limit, args.FollowSym)
+func (a *RpcAgent) GetMD5(args HashArgs, reply *HashReply) error {
+	hashStr, binary, err := coreMD5(args.Root, args.RelPath, args.FollowSym, args.Options)
 	if err != nil {
 		reply.Error = err.Error()
 	}
 	reply.Hash = hashStr
+	reply.Binary = binary
+	return nil
+}
+
+// batchHashWorkers is the number of files the agent hashes concurrently in a batch.
+var batchHashWorkers = runtime.NumCPU()
+
+// batchHashHook is called by every batch worker before hashing a file (for testing purposes).
+var batchHashHook func(relPath string)
+
+// GetSHABatch hashes the files of a batch with a pool of workers. The master sends all
+// its SHA256 requests through it, so concurrent ones share a single round trip.
+func (a *RpcAgent) GetSHABatch(args BatchHashArgs, reply *BatchHashReply) error {
+	reply.Hashes = make([]HashReply, len(args.RelPaths))
+	jobCh := make(chan int)
+	var wg sync.WaitGroup
+	for range max(min(batchHashWorkers, len(args.RelPaths)), 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobCh {
+				if batchHashHook != nil {
+					batchHashHook(args.RelPaths[i])
+				}
+				hashStr, err := coreSHA(args.Root, args.RelPaths[i], args.Limit, args.FollowSym, args.Norm, args.Options)
+				if err != nil {
+					reply.Hashes[i].Error = err.Error()
+				}
+				reply.Hashes[i].Hash = hashStr
+			}
+		}()
+	}
+	for i := range args.RelPaths {
+		jobCh <- i
+	}
+	close(jobCh)
+	wg.Wait()
+	return nil
+}
+
+func (a *RpcAgent) GetXattrs(args HashArgs, reply *XattrReply) error {
+	attrs, err := coreXattrs(args.Root, args.RelPath, args.FollowSym)
+	if errors.Is(err, ErrXattrUnsupported) {
+		reply.Unsupported = true
+	} else if err != nil {
+		reply.Error = err.Error()
+	}
+	reply.Attrs = attrs
+	return nil
+}
+
+func (a *RpcAgent) GetSparseLayout(args HashArgs, reply *SparseReply) error {
+	layout, err := coreSparseLayout(args.Root, args.RelPath, args.FollowSym)
+	if errors.Is(err, ErrSparseUnsupported) {
+		reply.Unsupported = true
+	} else if err != nil {
+		reply.Error = err.Error()
+	}
+	reply.Layout = layout
 	return nil
 }
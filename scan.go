@@ -1,53 +1,145 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
-// coreScan scans a directory tree and returns a map of relative file names
-// to file sizes and the corresponding list of files.
-// If includes is empty, all files are included if they are not excluded.
+// FileMeta holds the metadata of a scanned file.
+type FileMeta struct {
+	Size    int64
+	ModTime int64  // unix nanoseconds
+	Dev     uint64 // device and inode number, 0 if unsupported
+	Ino     uint64
+	Special string // set for FIFOs, sockets and devices, which are never opened
+	Link    string // target of a symlink which isn't followed
+	Attrs   uint32 // Windows readonly, hidden, system and archive bits, 0 elsewhere
+}
+
+// ScanIssue records a path which could not be read during a scan.
+type ScanIssue struct {
+	Path string
+	Err  string
+	Dir  bool // a directory whose entries could not be listed
+}
+
+// specialType describes a file that is neither regular, a directory nor a symlink, e.g. "fifo".
+// Device files include their device number. Regular files yield "".
+func specialType(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		kind := "block device"
+		if mode&os.ModeCharDevice != 0 {
+			kind = "char device"
+		}
+		if rdev, ok := fileRdev(info); ok {
+			return fmt.Sprintf("%s %d", kind, rdev)
+		}
+		return kind
+	case mode&os.ModeIrregular != 0:
+		return "irregular"
+	}
+	return ""
+}
+
+// ScanOptions select the entries listed by a scan.
+type ScanOptions struct {
+	Includes    []string
+	Excludes    []string
+	IncludeDirs []string
+	ExcludeDirs []string
+	FollowSym   bool
+	Glob        string // --glob syntax of the patterns, classic if empty
+	OneFS       bool   // --one-file-system: don't cross into another device than the root
+	NoRecurse   bool   // --no-recurse: list only the direct children of the root
+}
+
+// deviceOf returns the device a file resides on (replaceable for testing purposes).
+var deviceOf = func(info os.FileInfo) (uint64, bool) {
+	dev, _, ok := fileInode(info)
+	return dev, ok
+}
+
+// scannedMeta returns the metadata of a file from its stat info.
+// For a symlink which isn't followed, info is that of the link itself and its target is read.
+func scannedMeta(fullPath string, info os.FileInfo) FileMeta {
+	meta := FileMeta{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Special: specialType(info)}
+	meta.Dev, meta.Ino, _ = fileInode(info)
+	meta.Attrs = fileAttrs(info)
+	if info.Mode()&os.ModeSymlink != 0 {
+		// an unreadable target is left empty, the link is then hashed like before
+		meta.Link, _ = os.Readlink(fullPath)
+	}
+	return meta
+}
+
+// coreScan scans a directory tree and returns maps of relative file and
+// directory names to their metadata.
+// Paths which cannot be read are skipped and returned as issues.
+// If Includes is empty, all files are included if they are not excluded.
 // Exclusion is applied after inclusion.
-func coreScan(rootDir string, includes, excludes []string, followSym bool) (map[string]int64, []string, error) {
-	files := make(map[string]int64)
-	var dirs []string
+// IncludeDirs and ExcludeDirs only apply to directories: excluded directories are not
+// descended into, and if IncludeDirs is set, only directories matching it and their
+// subtrees are listed, together with the files inside them.
+// With FollowSym, a directory reachable through several symlinks is only listed below
+// the first of them in walk order, which is by name.
+// With OneFS, directories on another device than the root, i.e. mount points, are listed
+// without descending into them and other entries on another device are skipped.
+// With NoRecurse, subdirectories are listed without descending into them.
+// The walk stops with the error of ctx once it is done.
+func coreScan(ctx context.Context, rootDir string, opts ScanOptions) (map[string]FileMeta, map[string]FileMeta, []ScanIssue, error) {
+	files := make(map[string]FileMeta)
+	dirs := make(map[string]FileMeta)
+	var issues []ScanIssue
+	followSym := opts.FollowSym
 
-	incGlobs, err := compileGlobs(includes)
+	incGlobs, err := compileGlobs(opts.Includes, opts.Glob)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	excGlobs, err := compileGlobs(opts.Excludes, opts.Glob)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	incDirGlobs, err := compileGlobs(opts.IncludeDirs, opts.Glob)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	excGlobs, err := compileGlobs(excludes)
+	excDirGlobs, err := compileGlobs(opts.ExcludeDirs, opts.Glob)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	visitedPaths := make(map[string]bool)
 
-	var walk func(currPath string) error
-	walk = func(currPath string) error {
-		info, err := os.Lstat(currPath)
-		if err != nil {
-			return nil
-		}
+	var rootDev uint64
+	checkDev := opts.OneFS
 
-		isSym := info.Mode()&os.ModeSymlink != 0
-		if isSym && followSym {
-			realPath, err := filepath.EvalSymlinks(currPath)
-			if err != nil {
-				return nil
-			}
-			if visitedPaths[realPath] {
-				return nil // Cycle detected, bail out
-			}
-			visitedPaths[realPath] = true
+	// the tree is walked depth-first with an explicit stack instead of recursion,
+	// so arbitrarily deep trees don't grow the goroutine stack
+	type walkEntry struct {
+		path        string
+		dirIncluded bool
+	}
+	stack := []walkEntry{{rootDir, len(incDirGlobs) == 0}}
 
-			// Swap our stat info to the symlink target
-			info, err = os.Stat(realPath)
-			if err != nil {
-				return nil
-			}
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return files, dirs, issues, err
 		}
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		currPath, dirIncluded := entry.path, entry.dirIncluded
 
 		rel, err := filepath.Rel(rootDir, currPath)
 		if err != nil || rel == "." {
@@ -56,46 +148,130 @@ func coreScan(rootDir string, includes, excludes []string, followSym bool) (map[
 
 		slashRel := filepath.ToSlash(rel)
 
-		if slashRel != "" {
-			for _, g := range excGlobs {
-				if g.Match(slashRel) {
-					return nil
-				}
+		// skip records an unreadable path and leaves it out of the scan
+		skip := func(err error) {
+			issuePath := slashRel
+			if issuePath == "" {
+				issuePath = "."
+			}
+			if errors.Is(err, syscall.ENAMETOOLONG) {
+				err = fmt.Errorf("path of %d bytes exceeds the length limit of the OS", len(currPath))
 			}
+			issues = append(issues, ScanIssue{Path: issuePath, Err: err.Error()})
+		}
+
+		info, err := os.Lstat(currPath)
+		if currPath == rootDir {
+			// the root itself is always resolved, even if it is a symlink,
+			// and a missing root is an error rather than an empty tree
+			if info, err = os.Stat(currPath); err != nil {
+				return files, dirs, issues, err
+			}
+		}
+		if err != nil {
+			skip(err)
+			continue
+		}
+
+		isSym := info.Mode()&os.ModeSymlink != 0
+		if isSym && followSym {
+			// Swap our stat info to the symlink target
+			if info, err = os.Stat(currPath); err != nil {
+				skip(err)
+				continue
+			}
+		}
+
+		otherDev := false
+		if checkDev {
+			dev, ok := deviceOf(info)
+			if !ok {
+				slog.Warn("devices are not supported, scanning across file systems")
+				checkDev = false
+			} else if currPath == rootDir {
+				rootDev = dev
+			} else if otherDev = dev != rootDev; otherDev && !info.IsDir() {
+				continue
+			}
+		}
+
+		if slashRel != "" && matchesAny(excGlobs, slashRel, false) {
+			continue
 		}
 
 		if info.IsDir() {
+			if slashRel != "" && matchesAny(excDirGlobs, slashRel, false) {
+				continue
+			}
+			if followSym {
+				// every directory is walked once: a symlinked directory whose target was
+				// already walked, directly or through an earlier symlink, is skipped, which
+				// also breaks cycles. os.ReadDir sorts by name, so the first one always wins.
+				realPath, err := filepath.EvalSymlinks(currPath)
+				if err != nil {
+					skip(err)
+					continue
+				}
+				if isSym && visitedPaths[realPath] {
+					continue
+				}
+				visitedPaths[realPath] = true
+			}
 			if slashRel != "" {
-				dirs = append(dirs, slashRel)
+				dirIncluded = dirIncluded || matchesAny(incDirGlobs, slashRel, false)
+				if dirIncluded {
+					dirs[slashRel] = FileMeta{ModTime: info.ModTime().UnixNano()}
+				}
+			}
+			if (opts.NoRecurse && currPath != rootDir) || otherDev {
+				continue
 			}
 			entries, err := os.ReadDir(currPath)
 			if err != nil {
-				return nil
+				skip(err)
+				issues[len(issues)-1].Dir = true // its entries are unknown, not missing
+				continue
 			}
-			for _, e := range entries {
-				walk(filepath.Join(currPath, e.Name()))
+			// pushed in reverse so that entries are popped in name order
+			for i := len(entries) - 1; i >= 0; i-- {
+				stack = append(stack, walkEntry{filepath.Join(currPath, entries[i].Name()), dirIncluded})
 			}
-			return nil
+			continue
 		}
 
-		if slashRel != "" {
-			if len(incGlobs) > 0 {
-				matched := false
-				for _, g := range incGlobs {
-					if g.Match(slashRel) {
-						matched = true
-						break
-					}
-				}
-				if !matched {
-					return nil
-				}
+		if slashRel != "" && dirIncluded {
+			if len(incGlobs) > 0 && !matchesAny(incGlobs, slashRel, false) {
+				continue
 			}
-			files[slashRel] = info.Size()
+			files[slashRel] = scannedMeta(currPath, info)
 		}
-		return nil
 	}
+	return files, dirs, issues, nil
+}
 
-	err = walk(rootDir)
-	return files, dirs, err
+// corePaths stats only the given relative paths instead of walking the whole tree.
+// It returns the metadata of the paths that are files and of the paths that
+// are directories; paths missing in the tree are left out of both.
+func corePaths(rootDir string, relPaths []string, followSym bool) (map[string]FileMeta, map[string]FileMeta, error) {
+	files := make(map[string]FileMeta)
+	dirs := make(map[string]FileMeta)
+
+	for _, relPath := range relPaths {
+		fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 && followSym {
+			if info, err = os.Stat(fullPath); err != nil {
+				continue
+			}
+		}
+		if info.IsDir() {
+			dirs[relPath] = FileMeta{ModTime: info.ModTime().UnixNano()}
+			continue
+		}
+		files[relPath] = scannedMeta(fullPath, info)
+	}
+	return files, dirs, nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v3"
+)
+
+// SELFTEST_ALGOS are the hash algorithms benchmarked by --selftest.
+var SELFTEST_ALGOS = []string{"md5", "sha1", "sha256", "sha512"}
+
+// runSelftest generates a temporary pair of identical trees and prints the
+// comparison throughput for several worker counts and the hashing throughput
+// of the supported algorithms. The temporary trees are removed afterwards.
+func runSelftest(ctx context.Context, cmd *cli.Command) error {
+	totalSize, err := units.RAMInBytes(cmd.String("selftest-size"))
+	if err != nil || totalSize <= 0 {
+		return fmt.Errorf("invalid --selftest-size")
+	}
+	numFiles := int(cmd.Int("selftest-files"))
+	if numFiles <= 0 {
+		return fmt.Errorf("invalid --selftest-files")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "dirdiff_selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dirA, dirB := filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b")
+	if err := generateSelftestTree(dirA, dirB, totalSize, numFiles); err != nil {
+		return fmt.Errorf("failed to generate test tree: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(cmd.Writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Benchmark\tSetting\tTime\tThroughput\n")
+
+	workerCounts := []int{1, 2, 4, runtime.NumCPU()}
+	slices.Sort(workerCounts)
+	for _, workers := range slices.Compact(workerCounts) {
+		app := newApp()
+		app.Writer, app.ErrWriter = io.Discard, io.Discard
+		start := time.Now()
+		err := app.Run(ctx, []string{BIN_NAME, "--quiet", "--workers", strconv.Itoa(workers), dirA, dirB})
+		if err != nil {
+			return fmt.Errorf("comparison with %d workers failed: %w", workers, err)
+		}
+		elapsed := time.Since(start)
+		fmt.Fprintf(tw, "compare\tworkers=%d\t%v\t%s\n", workers, elapsed.Round(time.Microsecond), throughput(2*totalSize, elapsed))
+	}
+
+	files, _, _, err := coreScan(ctx, dirA, ScanOptions{})
+	if err != nil {
+		return err
+	}
+	for _, algo := range SELFTEST_ALGOS {
+		start := time.Now()
+		for relPath := range files {
+			h, _ := newHash(algo)
+			if _, err := computeSparseHash(filepath.Join(dirA, relPath), h, 0, false, HashOptions{}); err != nil {
+				return err
+			}
+		}
+		elapsed := time.Since(start)
+		fmt.Fprintf(tw, "hash\t%s\t%v\t%s\n", algo, elapsed.Round(time.Microsecond), throughput(totalSize, elapsed))
+	}
+
+	return tw.Flush()
+}
+
+// generateSelftestTree writes numFiles random files of totalSize bytes overall into dirA and identical copies into dirB.
+func generateSelftestTree(dirA, dirB string, totalSize int64, numFiles int) error {
+	rng := rand.New(rand.NewSource(1))
+	fileSize := max(totalSize/int64(numFiles), 1)
+	data := make([]byte, fileSize)
+	for i := range numFiles {
+		rng.Read(data)
+		relPath := filepath.Join(fmt.Sprintf("dir%02d", i%8), fmt.Sprintf("file%04d.dat", i))
+		for _, dir := range []string{dirA, dirB} {
+			fullPath := filepath.Join(dir, relPath)
+			if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(fullPath, bytes.Clone(data), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// throughput formats bytes per second in human readable form.
+func throughput(size int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "-"
+	}
+	return units.HumanSize(float64(size)/elapsed.Seconds()) + "/s"
+}
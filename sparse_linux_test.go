@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSparseAware(t *testing.T) {
+	const size = 4 << 20
+	dirA, dirB := t.TempDir(), t.TempDir()
+
+	// A: hole followed by a small data block at the end
+	f, err := os.Create(filepath.Join(dirA, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("tail"), size-4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// B: the same content fully materialized
+	content := make([]byte, size)
+	copy(content[size-4:], "tail")
+	if err := os.WriteFile(filepath.Join(dirB, "disk.img"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layoutA, errA := readSparseLayout(filepath.Join(dirA, "disk.img"), false)
+	layoutB, errB := readSparseLayout(filepath.Join(dirB, "disk.img"), false)
+	if errA != nil || errB != nil || layoutA == layoutB {
+		t.Skipf("filesystem does not report holes (A=%q %v, B=%q %v)", layoutA, errA, layoutB, errB)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		shouldContain string
+	}{
+		{"Without Flag", []string{dirA, dirB}, nil, ""},
+		{"With Flag", []string{"--sparse-aware", dirA, dirB}, ErrDiffsFound, "~ disk.img"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if !strings.Contains(stdout, tt.shouldContain) {
+				t.Errorf("expected output to contain %q, but got:\n%s", tt.shouldContain, stdout)
+			}
+		})
+	}
+}
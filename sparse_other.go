@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// readSparseLayout is not supported on this platform.
+func readSparseLayout(path string, followSym bool) (string, error) {
+	return "", ErrSparseUnsupported
+}
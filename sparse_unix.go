@@ -0,0 +1,55 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readSparseLayout returns the data extents of a file as "start-end" ranges,
+// found by alternating SEEK_DATA and SEEK_HOLE. Symlinks are only followed if followSym is set.
+func readSparseLayout(path string, followSym bool) (string, error) {
+	if !followSym {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	var extents []string
+	var offset int64
+	for {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // no more data after offset
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return "", ErrSparseUnsupported
+		}
+		if err != nil {
+			return "", err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return "", err
+		}
+		extents = append(extents, fmt.Sprintf("%d-%d", start, end))
+		offset = end
+	}
+	return strings.Join(extents, ","), nil
+}
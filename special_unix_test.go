@@ -0,0 +1,101 @@
+//go:build unix
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	dirA, dirB, dirC := t.TempDir(), t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "file"), "content")
+	createFile(t, filepath.Join(dirB, "file"), "content")
+	createFile(t, filepath.Join(dirB, "pipe"), "not a pipe")
+	createFile(t, filepath.Join(dirC, "file"), "content")
+	for _, dir := range []string{dirA, dirC} {
+		if err := syscall.Mkfifo(filepath.Join(dir, "pipe"), 0644); err != nil {
+			t.Skipf("FIFOs not supported: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		expectedOut   string
+		expectedLog   string
+	}{
+		{"Skipped", []string{dirA, dirB}, ErrASubsetB, "+ pipe\n", "skipping special file"},
+		{"Skipped On Both Sides", []string{dirA, dirC}, nil, "", "type=fifo"},
+		{"Compared By Type", []string{"--special-files", dirA, dirB}, ErrDiffsFound, "~ pipe\n", ""},
+		{"Same Type", []string{"--special-files", dirA, dirC}, nil, "", ""},
+		{"Fingerprint", []string{"--special-files", "--fingerprint", dirA, dirC}, nil, "Fingerprints match.", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr string
+			done := make(chan error, 1)
+			go func() {
+				var err error
+				stdout, stderr, err = runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+				done <- err
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("comparison hung on a FIFO")
+			}
+
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if !strings.Contains(stdout, tt.expectedOut) || (tt.expectedOut == "" && stdout != "") {
+				t.Errorf("expected output %q, but got %q", tt.expectedOut, stdout)
+			}
+			if !strings.Contains(stderr, tt.expectedLog) {
+				t.Errorf("expected log to contain %q, but got:\n%s", tt.expectedLog, stderr)
+			}
+		})
+	}
+}
+
+func TestVerifySpecialFiles(t *testing.T) {
+	root := t.TempDir()
+	createFile(t, filepath.Join(root, "file"), "content")
+	for _, name := range []string{"listed", "unlisted"} {
+		if err := syscall.Mkfifo(filepath.Join(root, name), 0644); err != nil {
+			t.Skipf("FIFOs not supported: %v", err)
+		}
+	}
+	sha := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	sumsPath := filepath.Join(t.TempDir(), "SHA256SUMS")
+	if err := os.WriteFile(sumsPath, []byte(sha("content")+"  file\n"+sha("listed")+"  listed\n"), 0644); err != nil {
+		t.Fatalf("failed to write sums file: %v", err)
+	}
+
+	stdout, stderr, err := runApp(t, "--no-color", "--silent", "--verify-against", sumsPath, root)
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if expected := "~ listed\n"; stdout != expected {
+		t.Errorf("expected output %q, but got %q", expected, stdout)
+	}
+	for _, want := range []string{"special file can't be verified", "skipping special file"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("expected log to contain %q, but got:\n%s", want, stderr)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v3"
+)
+
+// stateHeader is the first line of a state file and ties it to the compared directories
+// and the options deciding how they were compared.
+type stateHeader struct {
+	PathA   string            `json:"path_a"`
+	PathB   string            `json:"path_b"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// STATE_OPTIONS are the flags changing the outcome of comparing a file. A state file
+// is only resumed with the same values of those given on the command line.
+var STATE_OPTIONS = []string{
+	"follow-symlinks", "special-files", "glob", "fast", "fast-limit", "global-limit", "sparse-chunks",
+	"strong", "hash-cmd", "ignore-eol", "ignore-trailing-ws", "ignore-bom", "only-text", "only-binary",
+	"check-xattr", "check-attrs", "sparse-aware",
+}
+
+// stateOptions returns the values of the STATE_OPTIONS set on the command line.
+func stateOptions(cmd *cli.Command) map[string]string {
+	options := make(map[string]string)
+	for _, name := range STATE_OPTIONS {
+		if cmd.IsSet(name) {
+			options[name] = fmt.Sprint(cmd.Value(name))
+		}
+	}
+	return options
+}
+
+// stateEntry records the outcome of comparing one common file.
+type stateEntry struct {
+	Path    string       `json:"path"`
+	SizeA   int64        `json:"size_a"`
+	ModA    int64        `json:"mtime_a"`
+	SizeB   int64        `json:"size_b"`
+	ModB    int64        `json:"mtime_b"`
+	Changes []ChangeType `json:"changes"`
+}
+
+// compareState persists the compared files of a run in a JSON lines file,
+// so an interrupted run can be resumed without comparing them again.
+type compareState struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	enc  *json.Encoder
+	err  error // the first failed write
+	done map[string]stateEntry
+}
+
+// openState loads the entries of an existing state file for the same directories
+// and opens it for appending. A state file of other directories is started over,
+// while one of the same directories compared with other options is refused.
+func openState(path, pathA, pathB string, options map[string]string) (*compareState, error) {
+	header := stateHeader{PathA: pathA, PathB: pathB, Options: options}
+	s := &compareState{path: path, done: make(map[string]stateEntry)}
+
+	f, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		var got stateHeader
+		if scanner.Scan() && json.Unmarshal(scanner.Bytes(), &got) == nil && got.PathA == pathA && got.PathB == pathB {
+			if !maps.Equal(got.Options, options) {
+				f.Close()
+				return nil, fmt.Errorf("state file %s was written with other options (%s), remove it to start over", path, changedOptions(got.Options, options))
+			}
+			for scanner.Scan() {
+				var entry stateEntry
+				if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+					break // a torn last line of an interrupted run
+				}
+				s.done[entry.Path] = entry
+			}
+		}
+		f.Close()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	// rewrite the loaded entries so a torn line doesn't break appending
+	if s.f, err = os.Create(path); err != nil {
+		return nil, fmt.Errorf("failed to create state file: %w", err)
+	}
+	s.enc = json.NewEncoder(s.f)
+	if err := s.enc.Encode(header); err != nil {
+		return nil, err
+	}
+	for _, entry := range s.done {
+		if err := s.enc.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// changedOptions returns the names of the options which differ, comma separated.
+func changedOptions(a, b map[string]string) string {
+	var changed []string
+	for _, name := range STATE_OPTIONS {
+		valA, okA := a[name]
+		valB, okB := b[name]
+		if valA != valB || okA != okB {
+			changed = append(changed, "--"+name)
+		}
+	}
+	return strings.Join(changed, ", ")
+}
+
+// Lookup returns the recorded changes of a file if both sides are unchanged since.
+func (s *compareState) Lookup(relPath string, metaA, metaB FileMeta) ([]ChangeType, bool) {
+	entry, ok := s.done[relPath]
+	if !ok || entry.SizeA != metaA.Size || entry.ModA != metaA.ModTime || entry.SizeB != metaB.Size || entry.ModB != metaB.ModTime {
+		return nil, false
+	}
+	return entry.Changes, true
+}
+
+// Record appends the outcome of a compared file. Once a write failed,
+// nothing more is recorded and Close returns the error.
+func (s *compareState) Record(relPath string, metaA, metaB FileMeta, changes []ChangeType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	entry := stateEntry{Path: relPath, SizeA: metaA.Size, ModA: metaA.ModTime, SizeB: metaB.Size, ModB: metaB.ModTime, Changes: changes}
+	if err := s.enc.Encode(entry); err != nil {
+		s.err = fmt.Errorf("failed to write state file: %w", err)
+	}
+}
+
+// Close closes the state file and removes it if the run completed.
+// It returns the error of a failed Record, if any.
+func (s *compareState) Close(completed bool) error {
+	err := s.f.Close()
+	if err == nil && completed {
+		err = os.Remove(s.path)
+	}
+	return errors.Join(s.err, err)
+}
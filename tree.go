@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"sort"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 
@@ -24,6 +27,9 @@ const (
 	LAST_OTHER_MARKER       = "└×  "
 	CHILD                   = "│   "
 	LAST_CHILD              = "    "
+	ELLIPSIS_GROUP          = "…   "
+	CONNECTOR_WIDTH         = 4
+	MIN_NAME_WIDTH          = 4
 )
 
 const (
@@ -31,6 +37,10 @@ const (
 	StatusAdded
 	StatusRemoved
 	StatusModified
+	StatusErrored
+	StatusLinkChanged
+	StatusXattrChanged
+	StatusAttrChanged
 )
 
 type TreeNode struct {
@@ -54,8 +64,11 @@ type TreeLine struct {
 
 // getTerminalWidth returns the current terminal width or a default on error
 func getTerminalWidth() int {
-	// for testing purposes
-	if os.Getenv("TEST_FIX_WIDTH") != "" {
+	// for testing purposes, a non-numeric value fixes the standard width
+	if fixWidth := os.Getenv("TEST_FIX_WIDTH"); fixWidth != "" {
+		if width, err := strconv.Atoi(fixWidth); err == nil && width > 0 {
+			return width
+		}
 		return FALLBACK_TERMINAL_WIDTH // standard width
 	}
 	width, _, err := term.GetSize(int(os.Stdout.Fd()))
@@ -79,6 +92,8 @@ func truncate(s string, maxLen int) string {
 
 // formatSide cleanly truncates the text if needed and applies the color to the immediate marker + filename,
 // and returns the final string to print + its raw uncolored length.
+// Truncation never cuts through a connector: the filename is ellipsized first, and if the
+// connectors alone do not fit, whole leading connector groups are replaced by a single "…" group.
 func formatSide(ancestors, marker, name string, maxWidth int, col *color.Color) (string, int) {
 	if ancestors == "" && marker == "" && name == "" {
 		return "", 0
@@ -88,21 +103,30 @@ func formatSide(ancestors, marker, name string, maxWidth int, col *color.Color)
 	mLen := utf8.RuneCountInString(marker)
 	nLen := utf8.RuneCountInString(name)
 
-	// cascading truncation: prioritize ancestors and markers over the full filename
 	if aLen+mLen+nLen > maxWidth {
+		// drop whole leading connector groups until the shortened name fits
+		minName := min(nLen, MIN_NAME_WIDTH)
+		groups := []rune(ancestors)
+		dropped := false
+		for len(groups) >= CONNECTOR_WIDTH && len(groups)+mLen+minName > maxWidth {
+			groups = groups[CONNECTOR_WIDTH:]
+			dropped = true
+		}
+		if dropped {
+			if len(groups) >= CONNECTOR_WIDTH {
+				groups = groups[CONNECTOR_WIDTH:]
+			}
+			groups = append([]rune(ELLIPSIS_GROUP), groups...)
+		}
+		ancestors = string(groups)
+		aLen = len(groups)
+
 		allowedForName := maxWidth - aLen - mLen
-		if allowedForName > 1 {
-			name = string([]rune(name)[:allowedForName-1]) + "…"
-		} else {
-			name = ""
-			allowedForMarker := maxWidth - aLen
-			if allowedForMarker > 1 {
-				marker = string([]rune(marker)[:allowedForMarker-1]) + "…"
+		if nLen > allowedForName {
+			if allowedForName > 1 {
+				name = string([]rune(name)[:allowedForName-1]) + "…"
 			} else {
-				marker = ""
-				if aLen > maxWidth && maxWidth > 1 {
-					ancestors = string([]rune(ancestors)[:maxWidth-1]) + "…"
-				}
+				name = ""
 			}
 		}
 	}
@@ -118,9 +142,9 @@ func formatSide(ancestors, marker, name string, maxWidth int, col *color.Color)
 	return ancestors + coloredPart, rawLen
 }
 
-// printTree aggregates the diff into an internal tree structure,
-// recursively maps the gnu tree connectors on both sides, and prints them.
-func printTree(results []DiffItem, pathA, pathB string, cmd *cli.Command) {
+// buildTree aggregates the diff items into a tree of path components.
+// Intermediate directories without a diff item of their own have StatusNone.
+func buildTree(results []DiffItem) *TreeNode {
 	root := &TreeNode{
 		Name:     ".",
 		IsDir:    true,
@@ -151,39 +175,68 @@ func printTree(results []DiffItem, pathA, pathB string, cmd *cli.Command) {
 					curr.Children[part].Status = StatusAdded
 				case Removed:
 					curr.Children[part].Status = StatusRemoved
-				case Modified:
+				case Modified, DirModified:
 					curr.Children[part].Status = StatusModified
+				case Errored:
+					curr.Children[part].Status = StatusErrored
+				case LinkChanged:
+					if curr.Children[part].Status == StatusNone {
+						curr.Children[part].Status = StatusLinkChanged
+					}
+				case XattrChanged:
+					if curr.Children[part].Status == StatusNone {
+						curr.Children[part].Status = StatusXattrChanged
+					}
+				case AttrChanged:
+					if curr.Children[part].Status == StatusNone {
+						curr.Children[part].Status = StatusAttrChanged
+					}
 				}
 			}
 			curr = curr.Children[part]
 		}
 	}
+	return root
+}
+
+// printColumnHeader prints the compared paths side by side above the A and B columns,
+// followed by a separator rule.
+func printColumnHeader(w io.Writer, pathA, pathB string, leftWidth, maxColWidth int) {
+	cyan := color.New(color.FgCyan).SprintFunc()
+	headA := truncate(pathA, leftWidth)
+	headB := truncate(pathB, maxColWidth)
+
+	headerPadding := strings.Repeat(" ", leftWidth-utf8.RuneCountInString(headA))
+	fmt.Fprintf(w, "%s%s%s%s\n", cyan(headA), headerPadding, SEPARATOR, cyan(headB))
+	fmt.Fprintln(w, strings.Repeat(HEADER_SEPARATOR, leftWidth+utf8.RuneCountInString(headB)+3))
+}
+
+// printTree aggregates the diff into an internal tree structure,
+// recursively maps the gnu tree connectors on both sides, and prints them.
+// With header, the compared paths and a separator rule are printed first.
+func printTree(results []DiffItem, pathA, pathB string, header bool, cmd *cli.Command) {
+	root := buildTree(results)
 
 	var lines []TreeLine
-	generateTreeLines(root, "", "", &lines)
+	generateTreeLines(root, "", "", &lines, pathOrder(cmd))
 
 	// calculate column widths
 	termWidth := getTerminalWidth()
 	maxColWidth := (termWidth - utf8.RuneCountInString(SEPARATOR)) / 2 // subtract the separator size
 
-	longestLeft := utf8.RuneCountInString(pathA)
+	longestLeft := 0
+	if header {
+		longestLeft = utf8.RuneCountInString(pathA)
+	}
 	for _, l := range lines {
 		longestLeft = max(longestLeft, utf8.RuneCountInString(l.LeftAncestor+l.LeftMarker+l.LeftName))
 	}
 
 	leftWidth := min(longestLeft+2, maxColWidth)
 
-	cyan := color.New(color.FgCyan).SprintFunc()
-
-	// print headers side-by-side
-	headA := truncate(pathA, leftWidth)
-	headB := truncate(pathB, maxColWidth)
-
-	headerPadding := strings.Repeat(" ", leftWidth-utf8.RuneCountInString(headA))
-	fmt.Fprintf(cmd.Writer, "%s%s%s%s\n", cyan(headA), headerPadding, SEPARATOR, cyan(headB))
-
-	// separator
-	fmt.Fprintln(cmd.Writer, strings.Repeat(HEADER_SEPARATOR, leftWidth+utf8.RuneCountInString(headB)+3))
+	if header {
+		printColumnHeader(cmd.Writer, pathA, pathB, leftWidth, maxColWidth)
+	}
 
 	// print parsed lines with styles
 	for _, l := range lines {
@@ -197,12 +250,81 @@ func printTree(results []DiffItem, pathA, pathB string, cmd *cli.Command) {
 	}
 }
 
-func generateTreeLines(node *TreeNode, prefixLeft, prefixRight string, lines *[]TreeLine) {
+// printColumns prints each diff item as aligned A and B columns without the tree connectors.
+// An added item leaves the A column blank and a removed item the B column.
+func printColumns(results []DiffItem, pathA, pathB string, header bool, cmd *cli.Command) {
+	termWidth := getTerminalWidth()
+	maxColWidth := (termWidth - utf8.RuneCountInString(SEPARATOR)) / 2
+
+	names := make([]string, len(results))
+	longestLeft := 0
+	if header {
+		longestLeft = utf8.RuneCountInString(pathA)
+	}
+	for i, item := range results {
+		names[i] = item.Path
+		if item.IsDir {
+			names[i] += string(os.PathSeparator)
+		}
+		// without color, the status is only conveyed by a textual marker
+		if color.NoColor {
+			switch item.Type {
+			case Modified, DirModified:
+				names[i] += " (M)"
+			case Errored:
+				names[i] += " (!)"
+			case LinkChanged:
+				names[i] += " (L)"
+			case XattrChanged:
+				names[i] += " (X)"
+			case AttrChanged:
+				names[i] += " (T)"
+			}
+		}
+		if item.Type != Added {
+			longestLeft = max(longestLeft, utf8.RuneCountInString(names[i]))
+		}
+	}
+	leftWidth := min(longestLeft+2, maxColWidth)
+
+	if header {
+		printColumnHeader(cmd.Writer, pathA, pathB, leftWidth, maxColWidth)
+	}
+
+	for i, item := range results {
+		col := color.New(color.FgYellow)
+		switch item.Type {
+		case Added:
+			col = color.New(color.FgGreen)
+		case Removed:
+			col = color.New(color.FgRed)
+		case Errored:
+			col = color.New(color.FgMagenta)
+		case LinkChanged, XattrChanged, AttrChanged:
+			col = color.New(color.FgCyan)
+		case Identical:
+			col = nil
+		}
+
+		var leftStr, rightStr string
+		leftRawLen := 0
+		if item.Type != Added {
+			leftStr, leftRawLen = formatSide("", "", names[i], leftWidth, col)
+		}
+		if item.Type != Removed {
+			rightStr, _ = formatSide("", "", names[i], maxColWidth, col)
+		}
+		padding := strings.Repeat(" ", max(leftWidth-leftRawLen, 0))
+		fmt.Fprintf(cmd.Writer, "%s%s%s%s\n", leftStr, padding, SEPARATOR, rightStr)
+	}
+}
+
+func generateTreeLines(node *TreeNode, prefixLeft, prefixRight string, lines *[]TreeLine, order func(a, b string) int) {
 	var keys []string
 	for k := range node.Children {
 		keys = append(keys, k)
 	}
-	sort.Strings(keys) // Keep files and folders grouped alphabetically
+	slices.SortFunc(keys, order) // Keep files and folders grouped alphabetically
 
 	for i, k := range keys {
 		child := node.Children[k]
@@ -230,6 +352,26 @@ func generateTreeLines(node *TreeNode, prefixLeft, prefixRight string, lines *[]
 
 		nameStr := child.Name + suffix
 
+		// without color, the status is only conveyed by a textual marker
+		if color.NoColor {
+			switch child.Status {
+			case StatusAdded:
+				nameStr += " (+)"
+			case StatusRemoved:
+				nameStr += " (-)"
+			case StatusModified:
+				nameStr += " (M)"
+			case StatusErrored:
+				nameStr += " (!)"
+			case StatusLinkChanged:
+				nameStr += " (L)"
+			case StatusXattrChanged:
+				nameStr += " (X)"
+			case StatusAttrChanged:
+				nameStr += " (T)"
+			}
+		}
+
 		nextPrefixLeft := prefixLeft + childPrefixExt
 		nextPrefixRight := prefixRight + childPrefixExt
 
@@ -250,15 +392,22 @@ func generateTreeLines(node *TreeNode, prefixLeft, prefixRight string, lines *[]
 			line.LeftName = nameStr
 			line.LeftColor = color.New(color.FgRed)
 			nextPrefixRight = ""
-		case StatusModified:
+		case StatusModified, StatusErrored, StatusLinkChanged, StatusXattrChanged, StatusAttrChanged:
+			col := color.New(color.FgYellow)
+			switch child.Status {
+			case StatusErrored:
+				col = color.New(color.FgMagenta)
+			case StatusLinkChanged, StatusXattrChanged, StatusAttrChanged:
+				col = color.New(color.FgCyan)
+			}
 			line.LeftAncestor = prefixLeft
 			line.LeftMarker = marker
 			line.LeftName = nameStr
-			line.LeftColor = color.New(color.FgYellow)
+			line.LeftColor = col
 			line.RightAncestor = prefixRight
 			line.RightMarker = marker
 			line.RightName = nameStr
-			line.RightColor = color.New(color.FgYellow)
+			line.RightColor = col
 		case StatusNone:
 			line.LeftAncestor = prefixLeft
 			line.LeftMarker = marker
@@ -270,6 +419,63 @@ func generateTreeLines(node *TreeNode, prefixLeft, prefixRight string, lines *[]
 
 		*lines = append(*lines, line)
 
-		generateTreeLines(child, nextPrefixLeft, nextPrefixRight, lines)
+		generateTreeLines(child, nextPrefixLeft, nextPrefixRight, lines, order)
+	}
+}
+
+// Rollup summarizes the changes of a directory and its direct children.
+type Rollup struct {
+	Path     string `json:"path"`
+	Status   string `json:"status"` // identical, added, removed or modified
+	Added    int    `json:"added"`
+	Removed  int    `json:"removed"`
+	Modified int    `json:"modified"`
+}
+
+// rollupStatus returns the summary status of a tree node: its own status if it
+// was added or removed, modified if anything below it changed, identical otherwise.
+func rollupStatus(node *TreeNode) string {
+	switch node.Status {
+	case StatusAdded:
+		return "added"
+	case StatusRemoved:
+		return "removed"
+	case StatusNone:
+		if len(node.Children) == 0 {
+			return "identical"
+		}
+	}
+	return "modified"
+}
+
+// buildRollups returns the rollups of all directories in the diff tree, depth first and sorted by name
+// in the given order.
+func buildRollups(results []DiffItem, order func(a, b string) int) []Rollup {
+	var rollups []Rollup
+	var walk func(node *TreeNode, relPath string)
+	walk = func(node *TreeNode, relPath string) {
+		r := Rollup{Path: relPath, Status: rollupStatus(node)}
+		var keys []string
+		for k, child := range node.Children {
+			keys = append(keys, k)
+			switch rollupStatus(child) {
+			case "added":
+				r.Added++
+			case "removed":
+				r.Removed++
+			case "modified":
+				r.Modified++
+			}
+		}
+		rollups = append(rollups, r)
+
+		slices.SortFunc(keys, order)
+		for _, k := range keys {
+			if child := node.Children[k]; child.IsDir {
+				walk(child, path.Join(relPath, k))
+			}
+		}
 	}
+	walk(buildTree(results), ".")
+	return rollups
 }
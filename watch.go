@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
+)
+
+// WATCH_DEBOUNCE is the quiet period after the last filesystem event before re-running.
+const WATCH_DEBOUNCE = 200 * time.Millisecond
+
+// runWatch re-runs the comparison whenever one of the local directories changes.
+// Instead of an exit code, the verdict is printed after each cycle.
+// It returns when the context is cancelled or a runtime error occurs.
+func runWatch(ctx context.Context, args *ParsedArgs, cmd *cli.Command) error {
+	if isRemotePath(args.PathA) || isRemotePath(args.PathB) || isGitPath(args.PathA) || isGitPath(args.PathB) ||
+		isEmptyPath(args.PathA) || isEmptyPath(args.PathB) {
+		return fmt.Errorf("--watch only supports local directories")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	for _, root := range []string{args.PathA, args.PathB} {
+		if err := watchRecursive(watcher, root); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", root, err)
+		}
+	}
+
+	clear := cmd.Writer == os.Stdout && term.IsTerminal(int(os.Stdout.Fd()))
+	for {
+		if clear {
+			fmt.Fprint(cmd.Writer, "\033[H\033[2J")
+		}
+		err := runMaster(ctx, args, cmd)
+		if code := exitCode(err); code == 2 || code == 5 {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		fmt.Fprintf(cmd.ErrWriter, "[%s] %s\n", time.Now().Format(time.TimeOnly), verdictText(err))
+
+		if err := waitForChange(ctx, watcher); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// watchRecursive adds the directory and all its subdirectories to the watcher.
+func watchRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// waitForChange blocks until a filesystem event occurred and no further event
+// followed within WATCH_DEBOUNCE. Newly created directories are watched as well.
+func waitForChange(ctx context.Context, watcher *fsnotify.Watcher) error {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchRecursive(watcher, event.Name)
+				}
+			}
+			debounce = time.After(WATCH_DEBOUNCE)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			return err
+		case <-debounce:
+			return nil
+		}
+	}
+}
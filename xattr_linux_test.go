@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCheckXattr(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "labeled"), "content")
+	createFile(t, filepath.Join(dirB, "labeled"), "content")
+	if err := unix.Setxattr(filepath.Join(dirA, "labeled"), "user.dirdiff_test", []byte("A"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		shouldContain string
+	}{
+		{"Without Flag", []string{dirA, dirB}, nil, ""},
+		{"With Flag", []string{"--check-xattr", dirA, dirB}, ErrDiffsFound, "@ labeled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runApp(t, append([]string{"--no-color", "--silent"}, tt.args...)...)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("expected error %v, got: %v", tt.expectedError, err)
+			}
+			if !strings.Contains(stdout, tt.shouldContain) {
+				t.Errorf("expected output to contain %q, but got:\n%s", tt.shouldContain, stdout)
+			}
+		})
+	}
+}
+
+func TestCheckXattrModified(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(dirA, "labeled"), "old content")
+	createFile(t, filepath.Join(dirB, "labeled"), "new content")
+	if err := unix.Setxattr(filepath.Join(dirA, "labeled"), "user.dirdiff_test", []byte("A"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %v", err)
+	}
+
+	// a single file reporting both changes must not block the workers
+	done := make(chan struct{})
+	var stdout string
+	var err error
+	go func() {
+		defer close(done)
+		stdout, _, err = runApp(t, "--no-color", "--silent", "--check-xattr", dirA, dirB)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the run to finish")
+	}
+	if !errors.Is(err, ErrDiffsFound) {
+		t.Errorf("expected error %v, got: %v", ErrDiffsFound, err)
+	}
+	if expected := "~ labeled\n@ labeled\n"; stdout != expected {
+		t.Errorf("expected output %q, got %q", expected, stdout)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// readXattrs is not supported on this platform.
+func readXattrs(path string, followSym bool) (map[string]string, error) {
+	return nil, ErrXattrUnsupported
+}
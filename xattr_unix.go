@@ -0,0 +1,53 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file.
+// Symlinks are only followed if followSym is set.
+func readXattrs(path string, followSym bool) (map[string]string, error) {
+	list, get := unix.Llistxattr, unix.Lgetxattr
+	if followSym {
+		list, get = unix.Listxattr, unix.Getxattr
+	}
+
+	size, err := list(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, ErrXattrUnsupported
+		}
+		return nil, err
+	}
+	attrs := make(map[string]string)
+	if size == 0 {
+		return attrs, nil
+	}
+	buf := make([]byte, size)
+	size, err = list(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		valSize, err := get(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, valSize)
+		valSize, err = get(path, name, val)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = string(val[:valSize])
+	}
+	return attrs, nil
+}